@@ -0,0 +1,222 @@
+// Package documents renders the printable documents used when fulfilling orders, like packing slips
+// and shipping labels, as PDFs
+package documents
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+
+	"github.com/thomastaylor312/printing-api/types"
+	"golang.org/x/image/draw"
+)
+
+const (
+	slipMargin    = 54.0
+	slipRowHeight = 68.0
+	thumbnailSize = 56.0
+)
+
+// Thumbnail is a small JPEG version of a picture that can be included in documents
+type Thumbnail struct {
+	JPEG   []byte
+	Width  int
+	Height int
+}
+
+// NewThumbnail scales the image so its longest side is at most maxSize pixels and encodes it as a
+// JPEG
+func NewThumbnail(img image.Image, maxSize int) (Thumbnail, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return Thumbnail{}, errors.New("image is empty")
+	}
+	if width > maxSize || height > maxSize {
+		if width >= height {
+			height = height * maxSize / width
+			width = maxSize
+		} else {
+			width = width * maxSize / height
+			height = maxSize
+		}
+		if width == 0 {
+			width = 1
+		}
+		if height == 0 {
+			height = 1
+		}
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, scaled, &jpeg.Options{Quality: 80}); err != nil {
+		return Thumbnail{}, fmt.Errorf("error encoding thumbnail: %w", err)
+	}
+	return Thumbnail{JPEG: buf.Bytes(), Width: width, Height: height}, nil
+}
+
+// PackingSlip renders a letter sized packing slip listing every print in the order. Thumbnails are
+// keyed by picture ID and prints without one are listed without a picture. The customer is
+// optional
+func PackingSlip(order types.Order, customer *types.User, thumbnails map[string]Thumbnail) []byte {
+	doc := newPDFDocument()
+	imageNames := make(map[string]string, len(thumbnails))
+	for pictureID, thumb := range thumbnails {
+		imageNames[pictureID] = doc.addJPEG(thumb.JPEG, thumb.Width, thumb.Height)
+	}
+
+	page := doc.addPage(8.5, 11)
+	y := slipMargin + 18
+	page.text(slipMargin, y, 20, true, "Packing Slip")
+	page.text(400, y, 11, false, fmt.Sprintf("Order #%s", order.ID()))
+	y += 16
+	if !order.CreatedAt.IsZero() {
+		page.text(400, y, 11, false, order.CreatedAt.Format("January 2, 2006"))
+	}
+
+	y += 28
+	page.text(slipMargin, y, 11, true, "Ship To")
+	page.text(320, y, 11, true, "Customer")
+	addressY := y
+	for _, line := range addressLines(order.ShippingDetails.Address) {
+		addressY += 14
+		page.text(slipMargin, addressY, 11, false, line)
+	}
+	customerY := y
+	if customer != nil {
+		for _, line := range []string{customer.Username, customer.Email} {
+			if line == "" {
+				continue
+			}
+			customerY += 14
+			page.text(320, customerY, 11, false, line)
+		}
+	}
+	customerY += 14
+	page.text(320, customerY, 11, false, fmt.Sprintf("Shipping: %s", order.ShippingDetails.ShippingProfile.Name))
+
+	y = math.Max(addressY, customerY) + 36
+	header := func(page *pdfPage, y float64) {
+		page.text(slipMargin+thumbnailSize+12, y, 10, true, "Size")
+		page.text(240, y, 10, true, "Paper")
+		page.text(400, y, 10, true, "Border")
+		page.text(480, y, 10, true, "Quantity")
+		page.line(slipMargin, y+6, 612-slipMargin, y+6, 0.75)
+	}
+	header(page, y)
+	y += 12
+
+	for _, print := range order.Prints {
+		// Start a new page if the row won't fit
+		if y+slipRowHeight > 792-slipMargin {
+			page = doc.addPage(8.5, 11)
+			y = slipMargin + 12
+			header(page, y)
+			y += 12
+		}
+		if name, ok := imageNames[print.PictureID]; ok {
+			thumb := thumbnails[print.PictureID]
+			w, h := fitWithin(float64(thumb.Width), float64(thumb.Height), thumbnailSize)
+			page.image(name, slipMargin+(thumbnailSize-w)/2, y+6+(thumbnailSize-h)/2, w, h)
+		} else {
+			page.rect(slipMargin, y+6, thumbnailSize, thumbnailSize, 0.5)
+		}
+		textY := y + 6 + thumbnailSize/2 + 4
+		page.text(slipMargin+thumbnailSize+12, textY, 11, false, fmt.Sprintf("%g\" x %g\"", print.Width, print.Height))
+		page.text(240, textY, 11, false, paperDescription(print))
+		page.text(400, textY, 11, false, fmt.Sprintf("%g\"", print.BorderSize))
+		page.text(480, textY, 11, false, fmt.Sprintf("%d", print.Count()))
+		page.text(slipMargin+thumbnailSize+12, textY+13, 8, false, fmt.Sprintf("Picture %s", print.PictureID))
+		y += slipRowHeight
+		page.line(slipMargin, y, 612-slipMargin, y, 0.25)
+	}
+
+	return doc.bytes()
+}
+
+// ShippingLabel renders a 4x6 inch shipping label for the order. The order must have a shipping
+// address
+func ShippingLabel(order types.Order, from types.Address) ([]byte, error) {
+	if order.ShippingDetails.Address == nil {
+		return nil, errors.New("order does not have a shipping address")
+	}
+
+	doc := newPDFDocument()
+	page := doc.addPage(4, 6)
+	const margin = 14.0
+	width := 4 * pointsPerInch
+
+	y := margin + 8
+	page.text(margin, y, 8, true, "FROM")
+	for _, line := range addressLines(&from) {
+		y += 10
+		page.text(margin, y, 8, false, line)
+	}
+
+	y += 14
+	page.line(margin, y, width-margin, y, 1.5)
+	y += 22
+	page.text(margin, y, 11, true, "SHIP TO")
+	for _, line := range addressLines(order.ShippingDetails.Address) {
+		y += 20
+		page.text(margin+12, y, 15, true, strings.ToUpper(line))
+	}
+
+	y += 24
+	page.line(margin, y, width-margin, y, 1.5)
+	y += 20
+	page.text(margin, y, 12, true, strings.ToUpper(order.ShippingDetails.ShippingProfile.Name))
+	y += 16
+	page.text(margin, y, 10, false, fmt.Sprintf("Order #%s", order.ID()))
+	if order.ShippingDetails.TrackingNumber != nil {
+		y += 14
+		page.text(margin, y, 10, false, fmt.Sprintf("Tracking: %s", *order.ShippingDetails.TrackingNumber))
+	}
+
+	page.rect(margin/2, margin/2, width-margin, 6*pointsPerInch-margin, 1)
+	return doc.bytes(), nil
+}
+
+// addressLines formats the address as it should be printed
+func addressLines(address *types.Address) []string {
+	if address == nil {
+		return []string{"No address provided"}
+	}
+	lines := []string{address.Name, address.Line1}
+	if address.Line2 != "" {
+		lines = append(lines, address.Line2)
+	}
+	cityLine := address.City
+	if address.State != "" {
+		cityLine += ", " + address.State
+	}
+	if address.PostalCode != "" {
+		cityLine += " " + address.PostalCode
+	}
+	return append(lines, cityLine, address.Country)
+}
+
+func paperDescription(print types.Print) string {
+	if print.Paper == nil {
+		return fmt.Sprintf("Paper %s", print.PaperTypeID)
+	}
+	if print.Paper.Finish == "" {
+		return print.Paper.Name
+	}
+	return fmt.Sprintf("%s (%s)", print.Paper.Name, print.Paper.Finish)
+}
+
+// fitWithin scales the dimensions so they fit in a square of the given size, keeping the aspect
+// ratio
+func fitWithin(width float64, height float64, size float64) (float64, float64) {
+	if width >= height {
+		return size, height * size / width
+	}
+	return width * size / height, size
+}
@@ -0,0 +1,81 @@
+package documents_test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/documents"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// requireValidPDF checks the structure of the PDF, making sure every xref entry points at the
+// object it should
+func requireValidPDF(t *testing.T, pdf []byte) {
+	require.True(t, bytes.HasPrefix(pdf, []byte("%PDF-1.4")))
+	require.True(t, bytes.HasSuffix(pdf, []byte("%%EOF\n")))
+
+	matches := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	require.NotNil(t, matches)
+	xrefOffset, err := strconv.Atoi(string(matches[1]))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(pdf[xrefOffset:], []byte("xref\n")))
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xrefOffset:], -1)
+	require.NotEmpty(t, entries)
+	for i, entry := range entries {
+		offset, err := strconv.Atoi(string(entry[1]))
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(pdf[offset:], []byte(fmt.Sprintf("%d 0 obj", i+1))), "xref entry %d does not point at its object", i+1)
+	}
+}
+
+func TestPackingSlip(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	for x := 0; x < 600; x++ {
+		img.Set(x, 200, color.RGBA{R: 255, A: 255})
+	}
+	thumb, err := documents.NewThumbnail(img, 300)
+	require.NoError(t, err)
+	require.Equal(t, 300, thumb.Width)
+	require.Equal(t, 200, thumb.Height)
+
+	prints := make([]types.Print, 0, 20)
+	for i := 0; i < 20; i++ {
+		prints = append(prints, types.Print{Width: 8, Height: 10, PictureID: "1", Quantity: 2, Paper: &types.PaperType{Name: "Lustre (Pro)", Finish: types.PaperFinishLuster}})
+	}
+	order := types.Order{
+		OrderID: "42",
+		UserID:  "1",
+		Prints:  prints,
+		ShippingDetails: types.ShippingDetails{
+			Address: &types.Address{Name: "A Customer", Line1: "1 Main St", City: "Portland", State: "OR", PostalCode: "97201", Country: "US"},
+		},
+	}
+
+	pdf := documents.PackingSlip(order, &types.User{Username: "customer"}, map[string]documents.Thumbnail{"1": thumb})
+	requireValidPDF(t, pdf)
+	// 20 rows don't fit on a single page
+	require.False(t, bytes.Contains(pdf, []byte("/Count 1 ")), "packing slip should have multiple pages")
+	require.True(t, bytes.Contains(pdf, []byte(`(Lustre \(Pro\) \(luster\))`)), "paper names should be escaped")
+}
+
+func TestShippingLabel(t *testing.T) {
+	_, err := documents.ShippingLabel(types.Order{OrderID: "1"}, types.Address{})
+	require.Error(t, err, "orders without an address should not get a label")
+
+	label, err := documents.ShippingLabel(types.Order{
+		OrderID: "1",
+		ShippingDetails: types.ShippingDetails{
+			Address: &types.Address{Name: "A Customer", Line1: "1 Main St", City: "Portland", State: "OR", PostalCode: "97201", Country: "US"},
+		},
+	}, types.Address{Name: "Print Shop", Line1: "2 Side St", City: "Portland", State: "OR", PostalCode: "97202", Country: "US"})
+	require.NoError(t, err)
+	requireValidPDF(t, label)
+	require.True(t, bytes.Contains(label, []byte("/MediaBox [0 0 288.00 432.00]")), "label should be 4x6")
+}
@@ -0,0 +1,156 @@
+package documents
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Points per inch, the unit PDF coordinates are given in
+const pointsPerInch = 72.0
+
+// pdfDocument is a minimal PDF writer that supports the handful of things our documents need:
+// text in the built in Helvetica fonts, lines, rectangles and JPEG images. Coordinates are in points
+// measured from the top left of the page
+type pdfDocument struct {
+	pages  []*pdfPage
+	images []pdfImage
+}
+
+type pdfPage struct {
+	width   float64
+	height  float64
+	content bytes.Buffer
+}
+
+type pdfImage struct {
+	data   []byte
+	width  int
+	height int
+}
+
+func newPDFDocument() *pdfDocument {
+	return &pdfDocument{}
+}
+
+// addPage adds a page of the given size in inches
+func (d *pdfDocument) addPage(widthInches float64, heightInches float64) *pdfPage {
+	page := &pdfPage{width: widthInches * pointsPerInch, height: heightInches * pointsPerInch}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// addJPEG adds a JPEG image that can be drawn on any page and returns its name
+func (d *pdfDocument) addJPEG(data []byte, width int, height int) string {
+	d.images = append(d.images, pdfImage{data: data, width: width, height: height})
+	return fmt.Sprintf("Im%d", len(d.images))
+}
+
+// text draws a single line of text with its baseline at y
+func (p *pdfPage) text(x float64, y float64, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, p.height-y, escapePDFText(text))
+}
+
+// line draws a line from x1, y1 to x2, y2
+func (p *pdfPage) line(x1 float64, y1 float64, x2 float64, y2 float64, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, p.height-y1, x2, p.height-y2)
+}
+
+// rect draws the outline of a rectangle with its top left corner at x, y
+func (p *pdfPage) rect(x float64, y float64, w float64, h float64, lineWidth float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f %.2f %.2f re S\n", lineWidth, x, p.height-y-h, w, h)
+}
+
+// image draws a previously added image with its top left corner at x, y
+func (p *pdfPage) image(name string, x float64, y float64, w float64, h float64) {
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /%s Do Q\n", w, h, x, p.height-y-h, name)
+}
+
+// bytes renders the document
+func (d *pdfDocument) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	startObject := func() int {
+		offsets = append(offsets, out.Len())
+		id := len(offsets)
+		fmt.Fprintf(&out, "%d 0 obj\n", id)
+		return id
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Object IDs are assigned in the order they are written, so work out the IDs of the objects
+	// that are referenced before they are written
+	const catalogID, pagesID, regularFontID, boldFontID = 1, 2, 3, 4
+	firstImageID := 5
+	firstPageID := firstImageID + len(d.images)
+
+	startObject()
+	fmt.Fprintf(&out, "<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", pagesID)
+
+	startObject()
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		// Each page is followed by its content stream
+		kids[i] = fmt.Sprintf("%d 0 R", firstPageID+i*2)
+	}
+	fmt.Fprintf(&out, "<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(d.pages))
+
+	startObject()
+	out.WriteString("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>\nendobj\n")
+	startObject()
+	out.WriteString("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>\nendobj\n")
+
+	xObjects := make([]string, len(d.images))
+	for i, img := range d.images {
+		id := startObject()
+		xObjects[i] = fmt.Sprintf("/Im%d %d 0 R", i+1, id)
+		fmt.Fprintf(&out, "<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n", img.width, img.height, len(img.data))
+		out.Write(img.data)
+		out.WriteString("\nendstream\nendobj\n")
+	}
+
+	for _, page := range d.pages {
+		id := startObject()
+		fmt.Fprintf(&out, "<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >> /XObject << %s >> >> /Contents %d 0 R >>\nendobj\n",
+			pagesID, page.width, page.height, regularFontID, boldFontID, strings.Join(xObjects, " "), id+1)
+		startObject()
+		fmt.Fprintf(&out, "<< /Length %d >>\nstream\n", page.content.Len())
+		out.Write(page.content.Bytes())
+		out.WriteString("endstream\nendobj\n")
+	}
+
+	xrefOffset := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, catalogID, xrefOffset)
+	return out.Bytes()
+}
+
+// escapePDFText escapes text for use in a PDF string. Characters that can't be represented in
+// WinAnsiEncoding are replaced with a question mark
+func escapePDFText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32:
+			b.WriteRune(' ')
+		case r < 128:
+			b.WriteRune(r)
+		case r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteRune('?')
+		}
+	}
+	return b.String()
+}
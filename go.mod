@@ -3,19 +3,27 @@ module github.com/thomastaylor312/printing-api
 go 1.20
 
 require (
-	github.com/adrg/xdg v0.4.0 // indirect
-	github.com/aws/aws-sdk-go v1.44.276 // indirect
-	github.com/coreos/go-oidc/v3 v3.6.0 // indirect
+	github.com/adrg/xdg v0.4.0
+	github.com/aws/aws-sdk-go v1.44.276
+	github.com/coreos/go-oidc/v3 v3.6.0
+	github.com/go-chi/chi/v5 v5.0.8
+	github.com/go-chi/httplog v0.3.0
+	github.com/rs/zerolog v1.29.1
+	github.com/stretchr/testify v1.8.4
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/image v0.10.0
+)
+
+require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.2.0 // indirect
-	github.com/go-chi/chi/v5 v5.0.8 // indirect
-	github.com/go-chi/httplog v0.3.0 // indirect
 	github.com/go-chi/jwtauth/v5 v5.1.0 // indirect
 	github.com/go-chi/oauth v0.0.0-20210913085627-d937e221b3ef // indirect
 	github.com/go-jose/go-jose/v3 v3.0.0 // indirect
 	github.com/goccy/go-json v0.10.2 // indirect
 	github.com/gofrs/uuid v4.4.0+incompatible // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/lestrrat-go/blackmagic v1.0.1 // indirect
 	github.com/lestrrat-go/httpcc v1.0.1 // indirect
 	github.com/lestrrat-go/httprc v1.0.4 // indirect
@@ -25,10 +33,7 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/rs/zerolog v1.29.1 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
-	go.etcd.io/bbolt v1.3.7 // indirect
 	golang.org/x/crypto v0.9.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/oauth2 v0.8.0 // indirect
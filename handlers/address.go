@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// postalCodeFormats are the postal code formats for countries where a postal code is required.
+// Countries not in this list can optionally have a postal code of any format
+var postalCodeFormats = map[string]*regexp.Regexp{
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"AU": regexp.MustCompile(`^\d{4}$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+}
+
+// stateRequired contains the countries where a state, province or territory is required
+var stateRequired = map[string]bool{
+	"US": true,
+	"CA": true,
+	"AU": true,
+}
+
+var countryCodeFormat = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// normalizeAddress trims and upper cases the address fields that are codes and validates that all
+// fields required for the country are set
+func normalizeAddress(address types.Address) (types.Address, error) {
+	address.Name = strings.TrimSpace(address.Name)
+	address.Line1 = strings.TrimSpace(address.Line1)
+	address.Line2 = strings.TrimSpace(address.Line2)
+	address.City = strings.TrimSpace(address.City)
+	address.State = strings.ToUpper(strings.TrimSpace(address.State))
+	address.PostalCode = strings.ToUpper(strings.TrimSpace(address.PostalCode))
+	address.Country = strings.ToUpper(strings.TrimSpace(address.Country))
+
+	if !countryCodeFormat.MatchString(address.Country) {
+		return types.Address{}, errors.New("country must be a 2 letter country code")
+	}
+	if address.Name == "" {
+		return types.Address{}, errors.New("name is required")
+	}
+	if address.Line1 == "" {
+		return types.Address{}, errors.New("address line 1 is required")
+	}
+	if address.City == "" {
+		return types.Address{}, errors.New("city is required")
+	}
+	if stateRequired[address.Country] && address.State == "" {
+		return types.Address{}, fmt.Errorf("state is required for addresses in %s", address.Country)
+	}
+	if format, ok := postalCodeFormats[address.Country]; ok {
+		if address.PostalCode == "" {
+			return types.Address{}, fmt.Errorf("postal code is required for addresses in %s", address.Country)
+		}
+		if !format.MatchString(address.PostalCode) {
+			return types.Address{}, fmt.Errorf("postal code %s is not valid for %s", address.PostalCode, address.Country)
+		}
+	}
+
+	return address, nil
+}
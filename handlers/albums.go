@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// albumLock serializes changes to albums so that a picture that is being deleted can't be added
+// back to an album at the same time
+var albumLock sync.Mutex
+
+type AlbumHandlers struct {
+	db store.DataStore
+}
+
+func NewAlbumHandlers(db store.DataStore) *AlbumHandlers {
+	return &AlbumHandlers{db: db}
+}
+
+func userAlbumsKey(userID string) string {
+	return fmt.Sprintf("albums:%s", userID)
+}
+
+// GetAlbumsByUser gets all of a user's albums in the order the user has arranged them
+func (a *AlbumHandlers) GetAlbumsByUser(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	keys, err := getKeys(a.db, userAlbumsKey(userID))
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting albums: %v", err), http.StatusInternalServerError)
+		return
+	}
+	albums, err := fetchByKeys[types.Album](a.db, keys)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting albums: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(albums); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// GetAlbum gets a single album
+func (a *AlbumHandlers) GetAlbum(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	albumID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("albumID", albumID).Logger()
+	album, err := getAlbum(a.db, albumID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	if err := json.NewEncoder(w).Encode(album); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// CreateAlbum creates an album for the user. The album can be created with pictures already in it
+func (a *AlbumHandlers) CreateAlbum(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	var album types.Album
+	if err := json.NewDecoder(r.Body).Decode(&album); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding album: %v", err), http.StatusBadRequest)
+		return
+	}
+	album.UserID = userID
+	album.Name = strings.TrimSpace(album.Name)
+	if album.Name == "" {
+		writeHttpError(r.Context(), w, fmt.Errorf("album name is required"), http.StatusBadRequest)
+		return
+	}
+
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	pictureIDs, code, err := validateAlbumPictures(a.db, userID, album.PictureIDs)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, code)
+		return
+	}
+	album.PictureIDs = pictureIDs
+	album.CreatedAt = time.Now().UTC()
+	created, err := addOne[*types.Album](a.db, "albums", &album, nil, func(album *types.Album) error {
+		// Add the album to the end of the user's albums
+		keys, err := getKeys(a.db, userAlbumsKey(userID))
+		if err != nil {
+			return fmt.Errorf("error getting current albums: %v", err)
+		}
+		return storeOne(a.db, userAlbumsKey(userID), append(keys, fmt.Sprintf("albums:%s", album.ID())))
+	})
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error adding album: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// UpdateAlbum replaces the name and pictures of an album. This is how albums are renamed and how
+// the pictures in them are reordered. Leaving out the pictures keeps the current ones, and an empty
+// list empties the album
+func (a *AlbumHandlers) UpdateAlbum(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	albumID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("albumID", albumID).Logger()
+	var update types.Album
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding album: %v", err), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(update.Name)
+	if name == "" {
+		writeHttpError(r.Context(), w, fmt.Errorf("album name is required"), http.StatusBadRequest)
+		return
+	}
+
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	album, err := getAlbum(a.db, albumID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	if update.PictureIDs != nil {
+		pictureIDs, code, err := validateAlbumPictures(a.db, userID, update.PictureIDs)
+		if err != nil {
+			writeHttpError(r.Context(), w, err, code)
+			return
+		}
+		album.PictureIDs = pictureIDs
+	}
+	album.Name = name
+	if err := storeOne(a.db, fmt.Sprintf("albums:%s", albumID), album); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating album: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(album); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// ReorderAlbums sets the order of the user's albums. The body is a list of every one of the user's
+// album IDs in the new order
+func (a *AlbumHandlers) ReorderAlbums(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	var albumIDs []string
+	if err := json.NewDecoder(r.Body).Decode(&albumIDs); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding album order: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	keys, err := getKeys(a.db, userAlbumsKey(userID))
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting albums: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(albumIDs) != len(keys) {
+		writeHttpError(r.Context(), w, fmt.Errorf("order must include each of the %d albums exactly once", len(keys)), http.StatusBadRequest)
+		return
+	}
+	unordered := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		unordered[key] = true
+	}
+	ordered := make([]string, 0, len(albumIDs))
+	for _, albumID := range albumIDs {
+		key := fmt.Sprintf("albums:%s", albumID)
+		if !unordered[key] {
+			writeHttpError(r.Context(), w, fmt.Errorf("album %s is not one of the user's albums or is listed more than once", albumID), http.StatusBadRequest)
+			return
+		}
+		unordered[key] = false
+		ordered = append(ordered, key)
+	}
+	if err := storeOne(a.db, userAlbumsKey(userID), ordered); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating albums: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	albums, err := fetchByKeys[types.Album](a.db, ordered)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting albums: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(albums); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// AddAlbumPictures adds pictures to the end of an album. The body is a list of picture IDs, and
+// pictures that are already in the album are left where they are
+func (a *AlbumHandlers) AddAlbumPictures(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	albumID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("albumID", albumID).Logger()
+	var pictureIDs []string
+	if err := json.NewDecoder(r.Body).Decode(&pictureIDs); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding pictures: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	album, err := getAlbum(a.db, albumID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	pictureIDs, code, err := validateAlbumPictures(a.db, userID, append(album.PictureIDs, pictureIDs...))
+	if err != nil {
+		writeHttpError(r.Context(), w, err, code)
+		return
+	}
+	album.PictureIDs = pictureIDs
+	if err := storeOne(a.db, fmt.Sprintf("albums:%s", albumID), album); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating album: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(album); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// RemoveAlbumPicture removes a picture from an album. The picture itself is not deleted
+func (a *AlbumHandlers) RemoveAlbumPicture(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	albumID := chi.URLParam(r, "id")
+	pictureID := chi.URLParam(r, "pictureId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("albumID", albumID).Str("pictureID", pictureID).Logger()
+
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	album, err := getAlbum(a.db, albumID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	remaining, removed := withoutPicture(album.PictureIDs, pictureID)
+	if !removed {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture is not in the album"), http.StatusNotFound)
+		return
+	}
+	album.PictureIDs = remaining
+	if err := storeOne(a.db, fmt.Sprintf("albums:%s", albumID), album); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating album: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(album); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// DeleteAlbum deletes an album. The pictures in it are not deleted
+func (a *AlbumHandlers) DeleteAlbum(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	albumID := chi.URLParam(r, "id")
+
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	if _, err := getAlbum(a.db, albumID, userID, w, r); err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	// Remove the album from the lists first so a failure can't leave a list pointing at nothing
+	key := fmt.Sprintf("albums:%s", albumID)
+	if err := removeKey(a.db, userAlbumsKey(userID), key); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error removing album from user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := removeKey(a.db, "albums", key); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error removing album from albums: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := a.db.Delete(key); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("error deleting album: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func getAlbum(db store.DataStore, albumID string, userID string, w http.ResponseWriter, r *http.Request) (types.Album, error) {
+	album, err := fetchOne[types.Album](db, fmt.Sprintf("albums:%s", albumID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		formattedErr := fmt.Errorf("album not found")
+		writeHttpError(r.Context(), w, formattedErr, http.StatusNotFound)
+		return types.Album{}, formattedErr
+	} else if err != nil {
+		formattedErr := fmt.Errorf("error getting album: %v", err)
+		writeHttpError(r.Context(), w, formattedErr, http.StatusInternalServerError)
+		return types.Album{}, formattedErr
+	}
+	if album.UserID != userID {
+		formattedErr := fmt.Errorf("user does not have album with specified ID")
+		writeHttpError(r.Context(), w, formattedErr, http.StatusNotFound)
+		return types.Album{}, formattedErr
+	}
+	return *album, nil
+}
+
+// validateAlbumPictures checks that the user has all of the pictures and returns their IDs with
+// duplicates removed, keeping the first of each. If they don't, it returns the status code to
+// respond with. The caller must hold albumLock
+func validateAlbumPictures(db store.DataStore, userID string, pictureIDs []string) ([]string, int, error) {
+	seen := make(map[string]bool, len(pictureIDs))
+	valid := make([]string, 0, len(pictureIDs))
+	for _, pictureID := range pictureIDs {
+		if seen[pictureID] {
+			continue
+		}
+		seen[pictureID] = true
+		picture, err := fetchOne[types.Picture](db, fmt.Sprintf("pictures:%s", pictureID))
+		if errors.Is(err, store.ErrKeyNotFound) {
+			return nil, http.StatusBadRequest, fmt.Errorf("picture %s not found", pictureID)
+		} else if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("error getting picture: %v", err)
+		}
+		// Deleted pictures are only kept for the orders that use them
+		if picture.UserID != userID || picture.DeletedAt != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("picture %s not found", pictureID)
+		}
+		valid = append(valid, pictureID)
+	}
+	return valid, 0, nil
+}
+
+// removePictureFromAlbums removes a picture that is being deleted from all of the user's albums
+func removePictureFromAlbums(db store.DataStore, userID string, pictureID string) error {
+	albumLock.Lock()
+	defer albumLock.Unlock()
+	keys, err := getKeys(db, userAlbumsKey(userID))
+	if err != nil {
+		return fmt.Errorf("error getting albums: %v", err)
+	}
+	albums, err := fetchByKeys[types.Album](db, keys)
+	if err != nil {
+		return fmt.Errorf("error getting albums: %v", err)
+	}
+	for _, album := range albums {
+		remaining, removed := withoutPicture(album.PictureIDs, pictureID)
+		if !removed {
+			continue
+		}
+		album.PictureIDs = remaining
+		if err := storeOne(db, fmt.Sprintf("albums:%s", album.ID()), album); err != nil {
+			return fmt.Errorf("error updating album: %v", err)
+		}
+	}
+	return nil
+}
+
+// withoutPicture returns the picture IDs without the given picture and whether it was there
+func withoutPicture(pictureIDs []string, pictureID string) ([]string, bool) {
+	for i, id := range pictureIDs {
+		if id == pictureID {
+			return append(pictureIDs[:i:i], pictureIDs[i+1:]...), true
+		}
+	}
+	return pictureIDs, false
+}
@@ -0,0 +1,168 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestAlbumsAndTags(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{})
+
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	albumHandlers := handlers.NewAlbumHandlers(db)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}", pictureHandlers.CreatePicture)
+	r.Get("/pictures/{userId}", pictureHandlers.GetPicturesByUser)
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	r.Delete("/pictures/{userId}/{id}", pictureHandlers.DeletePicture)
+	r.Put("/pictures/{userId}/{id}/tags", pictureHandlers.PutPictureTags)
+	r.Get("/albums/{userId}", albumHandlers.GetAlbumsByUser)
+	r.Post("/albums/{userId}", albumHandlers.CreateAlbum)
+	r.Put("/albums/{userId}/order", albumHandlers.ReorderAlbums)
+	r.Get("/albums/{userId}/{id}", albumHandlers.GetAlbum)
+	r.Put("/albums/{userId}/{id}", albumHandlers.UpdateAlbum)
+	r.Delete("/albums/{userId}/{id}", albumHandlers.DeleteAlbum)
+	r.Post("/albums/{userId}/{id}/pictures", albumHandlers.AddAlbumPictures)
+	r.Delete("/albums/{userId}/{id}/pictures/{pictureId}", albumHandlers.RemoveAlbumPicture)
+	do := func(method string, path string, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	listIDs := func(query string) []string {
+		rr := do(http.MethodGet, "/pictures/u1"+query, "", nil)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var pictures []types.Picture
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures))
+		ids := []string{}
+		for _, picture := range pictures {
+			ids = append(ids, picture.ID())
+		}
+		return ids
+	}
+	decodeAlbum := func(rr *httptest.ResponseRecorder) types.Album {
+		var album types.Album
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&album))
+		return album
+	}
+
+	names := []string{"Beach sunset", "Mountain", "beach party"}
+	ids := make([]string, len(names))
+	for i, name := range names {
+		body, err := json.Marshal(types.Picture{UserID: "u1", Name: name})
+		require.NoError(t, err)
+		rr := do(http.MethodPost, "/pictures/u1", "application/json", body)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var picture types.Picture
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+		ids[i] = picture.ID()
+	}
+	sunset, mountain, party := ids[0], ids[1], ids[2]
+	rr := do(http.MethodPost, "/pictures/u2", "application/json", []byte(`{"userId": "u2", "name": "other"}`))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var other types.Picture
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&other))
+
+	rr = do(http.MethodPut, "/pictures/u1/"+sunset+"/tags", "application/json", []byte(`[" Summer ", "summer", "Travel", ""]`))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var tagged types.Picture
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&tagged))
+	require.Equal(t, []string{"summer", "travel"}, tagged.Tags)
+	rr = do(http.MethodPut, "/pictures/u1/"+mountain+"/tags", "application/json", []byte(`["travel"]`))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 64, 48)), nil))
+	rr = do(http.MethodPut, "/pictures/u1/"+party, "image/jpeg", buf.Bytes())
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = do(http.MethodPost, "/albums/u1", "application/json", []byte(`{"name": "Trip", "pictureIds": ["`+other.ID()+`"]}`))
+	require.Equal(t, http.StatusBadRequest, rr.Code, "albums can only have the user's pictures: %s", rr.Body.String())
+	rr = do(http.MethodPost, "/albums/u1", "application/json", []byte(`{"name": " Trip ", "pictureIds": ["`+mountain+`", "`+sunset+`", "`+mountain+`"]}`))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	trip := decodeAlbum(rr)
+	require.Equal(t, "Trip", trip.Name)
+	require.Equal(t, []string{mountain, sunset}, trip.PictureIDs)
+
+	require.Equal(t, []string{mountain, sunset}, listIDs("?album="+trip.ID()), "albums should keep their order")
+	require.Equal(t, []string{sunset}, listIDs("?tag=TRAVEL&tag=summer"))
+	require.Equal(t, []string{sunset, party}, listIDs("?name=beach"))
+	require.Equal(t, []string{sunset}, listIDs("?name=beach&album="+trip.ID()))
+	yesterday := time.Now().UTC().Add(-24 * time.Hour).Format(time.DateOnly)
+	require.Equal(t, []string{party}, listIDs("?uploadedAfter="+yesterday), "only uploaded pictures have an upload date")
+	require.Empty(t, listIDs("?uploadedBefore="+yesterday))
+	rr = do(http.MethodGet, "/pictures/u1?uploadedAfter=yesterday", "", nil)
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+	rr = do(http.MethodGet, "/pictures/u2?album="+trip.ID(), "", nil)
+	require.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+
+	// Rename and reorder, then add and remove pictures
+	rr = do(http.MethodPut, "/albums/u1/"+trip.ID(), "application/json", []byte(`{"name": "Road trip", "pictureIds": ["`+sunset+`", "`+mountain+`"]}`))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	trip = decodeAlbum(rr)
+	require.Equal(t, "Road trip", trip.Name)
+	require.Equal(t, []string{sunset, mountain}, trip.PictureIDs)
+	rr = do(http.MethodPut, "/albums/u1/"+trip.ID(), "application/json", []byte(`{"name": "Road trip 2023"}`))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	trip = decodeAlbum(rr)
+	require.Equal(t, "Road trip 2023", trip.Name)
+	require.Equal(t, []string{sunset, mountain}, trip.PictureIDs, "renaming without pictures should keep them")
+	rr = do(http.MethodPost, "/albums/u1/"+trip.ID()+"/pictures", "application/json", []byte(`["`+party+`", "`+sunset+`"]`))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, []string{sunset, mountain, party}, decodeAlbum(rr).PictureIDs)
+	rr = do(http.MethodDelete, "/albums/u1/"+trip.ID()+"/pictures/"+mountain, "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, []string{sunset, party}, decodeAlbum(rr).PictureIDs)
+	rr = do(http.MethodDelete, "/albums/u1/"+trip.ID()+"/pictures/"+mountain, "", nil)
+	require.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+
+	rr = do(http.MethodPost, "/albums/u1", "application/json", []byte(`{"name": "Favorites"}`))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	favorites := decodeAlbum(rr)
+	rr = do(http.MethodPut, "/albums/u1/order", "application/json", []byte(`["`+favorites.ID()+`"]`))
+	require.Equal(t, http.StatusBadRequest, rr.Code, "every album has to be ordered: %s", rr.Body.String())
+	rr = do(http.MethodPut, "/albums/u1/order", "application/json", []byte(`["`+favorites.ID()+`", "`+trip.ID()+`"]`))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(http.MethodGet, "/albums/u1", "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var albums []types.Album
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&albums))
+	require.Len(t, albums, 2)
+	require.Equal(t, favorites.ID(), albums[0].ID())
+	require.Equal(t, trip.ID(), albums[1].ID())
+
+	// Deleting a picture takes it out of its albums, and deleting an album leaves its pictures
+	rr = do(http.MethodDelete, "/pictures/u1/"+sunset, "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(http.MethodGet, "/albums/u1/"+trip.ID(), "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, []string{party}, decodeAlbum(rr).PictureIDs)
+	rr = do(http.MethodDelete, "/albums/u1/"+trip.ID(), "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(http.MethodGet, "/albums/u1/"+trip.ID(), "", nil)
+	require.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+	require.Equal(t, []string{mountain, party}, listIDs(""))
+}
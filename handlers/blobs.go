@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// The image store container uploaded pictures are stored in, by the SHA-256 of their contents
+const blobContainer = "blobs"
+
+// blobLock serializes changes to blob references. They are changed by the picture, order and upload
+// handlers, and a lost update could delete a picture that is still in use
+var blobLock sync.Mutex
+
+// blob is what is stored for each unique picture file. References are the database keys of the
+// pictures and orders that use it, and the file is deleted when the last one is released
+type blob struct {
+	Size       int64
+	References []string
+	CreatedAt  time.Time
+}
+
+func blobKey(hash string) string {
+	return fmt.Sprintf("blobs:%s", hash)
+}
+
+// spooledPicture is an upload written to a temporary file, so pictures aren't held in memory while
+// they are checked and stored
+type spooledPicture struct {
+	file *os.File
+	size int64
+	// The SHA-256 of the contents
+	sum []byte
+}
+
+// spoolPicture copies at most limit bytes of the reader to a temporary file, hashing them as they
+// are copied. The picture has to be closed to remove the file
+func spoolPicture(reader io.Reader, limit int64) (*spooledPicture, error) {
+	file, err := os.CreateTemp("", "picture-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, digest), io.LimitReader(reader, limit))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &spooledPicture{file: file, size: size, sum: digest.Sum(nil)}, nil
+}
+
+func (s *spooledPicture) ReadAt(p []byte, offset int64) (int, error) {
+	return s.file.ReadAt(p, offset)
+}
+
+// reader returns a reader for the whole picture. Each reader starts from the beginning
+func (s *spooledPicture) reader() io.Reader {
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+func (s *spooledPicture) hash() string {
+	return hex.EncodeToString(s.sum)
+}
+
+func (s *spooledPicture) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// storeBlob stores the picture by its hash, unless the same picture is already stored, and adds the
+// reference to it. It returns the hash
+func storeBlob(db store.DataStore, storage store.ImageStore, picture *spooledPicture, reference string) (string, error) {
+	hash := picture.hash()
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	existing, err := fetchOne[blob](db, blobKey(hash))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		if _, err := storage.Set(blobContainer, hash, uint(picture.size), io.NopCloser(picture.reader())); err != nil {
+			return "", err
+		}
+		existing = &blob{Size: picture.size, CreatedAt: time.Now().UTC()}
+	} else if err != nil {
+		return "", fmt.Errorf("error getting blob: %v", err)
+	}
+	existing.References = addReference(existing.References, reference)
+	if err := storeOne(db, blobKey(hash), existing); err != nil {
+		return "", fmt.Errorf("error updating blob: %v", err)
+	}
+	return hash, nil
+}
+
+// addBlobReference adds a reference to a blob that is already stored, so it is kept until the
+// reference is released
+func addBlobReference(db store.DataStore, hash string, reference string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	existing, err := fetchOne[blob](db, blobKey(hash))
+	if err != nil {
+		return fmt.Errorf("error getting blob %s: %v", hash, err)
+	}
+	existing.References = addReference(existing.References, reference)
+	return storeOne(db, blobKey(hash), existing)
+}
+
+// releaseBlob removes a reference to a blob, deleting the blob once nothing references it.
+// Releasing a blob that is already gone isn't an error
+func releaseBlob(db store.DataStore, storage store.ImageStore, hash string, reference string) error {
+	blobLock.Lock()
+	defer blobLock.Unlock()
+	existing, err := fetchOne[blob](db, blobKey(hash))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting blob %s: %v", hash, err)
+	}
+	references := make([]string, 0, len(existing.References))
+	for _, existingRef := range existing.References {
+		if existingRef != reference {
+			references = append(references, existingRef)
+		}
+	}
+	if len(references) > 0 {
+		existing.References = references
+		return storeOne(db, blobKey(hash), existing)
+	}
+	// Delete the record first so a failure leaves a stray file rather than a record without one
+	if err := db.Delete(blobKey(hash)); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		return fmt.Errorf("error deleting blob %s: %v", hash, err)
+	}
+	if err := storage.Delete(blobContainer, hash); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+		return fmt.Errorf("error deleting blob %s: %v", hash, err)
+	}
+	return nil
+}
+
+func addReference(references []string, reference string) []string {
+	for _, existing := range references {
+		if existing == reference {
+			return references
+		}
+	}
+	return append(references, reference)
+}
+
+// pictureFile returns where the picture's upload is stored. Pictures uploaded before uploads were
+// stored by hash are under the user's container
+func pictureFile(picture types.Picture) (string, string) {
+	if picture.Hash != "" {
+		return blobContainer, picture.Hash
+	}
+	return picture.UserID, picture.PictureID
+}
+
+// openPrintPicture opens the picture for a print. Ordered prints record the hash of the picture when
+// they were ordered, so they keep using that upload even if the picture is uploaded again
+func openPrintPicture(db store.DataStore, storage store.ImageStore, print types.Print) (io.ReadCloser, error) {
+	if print.PictureHash != "" {
+		return storage.Open(blobContainer, print.PictureHash)
+	}
+	picture, err := fetchOne[types.Picture](db, fmt.Sprintf("pictures:%s", print.PictureID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil, store.ErrImageNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting picture: %v", err)
+	}
+	return storage.Open(pictureFile(*picture))
+}
+
+// referenceOrderPictures adds the order as a reference to the pictures it prints, so they are kept
+// while the order exists
+func referenceOrderPictures(db store.DataStore, order *types.Order) error {
+	for _, print := range order.Prints {
+		if print.PictureHash == "" {
+			continue
+		}
+		if err := addBlobReference(db, print.PictureHash, fmt.Sprintf("orders:%s", order.ID())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseOrderPictures releases the order's references to the pictures it prints
+func releaseOrderPictures(db store.DataStore, storage store.ImageStore, order *types.Order) error {
+	for _, print := range order.Prints {
+		if print.PictureHash == "" {
+			continue
+		}
+		if err := releaseBlob(db, storage, print.PictureHash, fmt.Sprintf("orders:%s", order.ID())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
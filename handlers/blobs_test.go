@@ -0,0 +1,162 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestContentAddressedPictures(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{
+		MaxSize:      17.0,
+		PrintQuality: types.PrintQualitySettings{WarnBelowDPI: 1, RejectBelowDPI: 1},
+		Costs: types.SupplyCosts{
+			ShippingProfiles: []types.ShippingProfile{{ShippingMethod: types.ShippingMethodStandard, Cost: 5, Name: "Standard"}},
+		},
+	})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.25})
+
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	orderHandlers := handlers.NewOrderHandlers(db, storage, conf, &fakePayment{}, nil, nil)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}", pictureHandlers.CreatePicture)
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	r.Delete("/pictures/{userId}/{id}", pictureHandlers.DeletePicture)
+	r.Post("/orders/{userId}", orderHandlers.AddOrder)
+	r.Delete("/orders/{userId}/{id}", orderHandlers.DeleteOrder)
+	do := func(method string, path string, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 64, 48)), nil))
+	data := buf.Bytes()
+
+	// Upload the same file to two pictures
+	pictures := make([]types.Picture, 2)
+	for i := range pictures {
+		rr := do(http.MethodPost, "/pictures/u1", "application/json", []byte(`{"userId": "u1", "name": "beach"}`))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures[i]))
+		rr = do(http.MethodPut, "/pictures/u1/"+pictures[i].ID(), "image/jpeg", data)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures[i]))
+	}
+	hash := pictures[0].Hash
+	require.Len(t, hash, 64)
+	require.Equal(t, hash, pictures[1].Hash, "identical uploads should have the same hash")
+	blobPath := filepath.Join(tmpdir, "storage", "blobs", hash)
+	require.FileExists(t, blobPath)
+	_, err = os.Stat(filepath.Join(tmpdir, "storage", "u1"))
+	require.ErrorIs(t, err, os.ErrNotExist, "uploads should only be stored by hash")
+
+	putCart(t, db, types.Cart{
+		UserID: "u1",
+		Prints: []types.Print{{PictureID: pictures[0].ID(), PaperTypeID: "1", Width: 8, Height: 10, Cost: 20, Quantity: 1}},
+	})
+	rr := do(http.MethodPost, "/orders/u1", "application/json", []byte(`{"shippingProfile": {"shippingMethod": "standard"}}`))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var order types.Order
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&order))
+	require.Equal(t, hash, order.Prints[0].PictureHash)
+
+	// The file is kept until nothing uses it
+	rr = do(http.MethodDelete, "/pictures/u1/"+pictures[1].ID(), "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.FileExists(t, blobPath, "the other picture and the order still use the file")
+	rr = do(http.MethodDelete, "/orders/u1/"+order.ID(), "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.FileExists(t, blobPath, "the other picture still uses the file")
+	rr = do(http.MethodDelete, "/pictures/u1/"+pictures[0].ID(), "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoFileExists(t, blobPath)
+}
+
+func TestOrderPicturesComeFromTheUser(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{
+		MaxSize:      17.0,
+		PrintQuality: types.PrintQualitySettings{WarnBelowDPI: 1, RejectBelowDPI: 1},
+		Costs: types.SupplyCosts{
+			ShippingProfiles: []types.ShippingProfile{{ShippingMethod: types.ShippingMethodStandard, Cost: 5, Name: "Standard"}},
+		},
+	})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.25})
+
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}", pictureHandlers.CreatePicture)
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	r.Put("/carts/{userId}", handlers.NewCartHandlers(db, conf, nil).PutCart)
+	r.Post("/orders/{userId}", handlers.NewOrderHandlers(db, storage, conf, &fakePayment{}, nil, nil).AddOrder)
+	do := func(method string, path string, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	uploaded := map[string]types.Picture{}
+	for i, userID := range []string{"u1", "u2"} {
+		rr := do(http.MethodPost, "/pictures/"+userID, "application/json", []byte(`{"userId": "`+userID+`", "name": "beach"}`))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var picture types.Picture
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+		buf := new(bytes.Buffer)
+		require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 64+i, 48)), nil))
+		rr = do(http.MethodPut, "/pictures/"+userID+"/"+picture.ID(), "image/jpeg", buf.Bytes())
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+		uploaded[userID] = picture
+	}
+	placeOrder := func(print types.Print) *httptest.ResponseRecorder {
+		print.PaperTypeID, print.Width, print.Height, print.Cost, print.Quantity = "1", 8, 10, 20, 1
+		body, err := json.Marshal(types.Cart{UserID: "u1", Prints: []types.Print{print}})
+		require.NoError(t, err)
+		rr := do(http.MethodPut, "/carts/u1", "application/json", body)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		return do(http.MethodPost, "/orders/u1", "application/json", []byte(`{"shippingProfile": {"shippingMethod": "standard"}}`))
+	}
+
+	rr := placeOrder(types.Print{PictureID: uploaded["u2"].PictureID})
+	require.Equal(t, http.StatusBadRequest, rr.Code, "other users' pictures can't be ordered: %s", rr.Body.String())
+	rr = placeOrder(types.Print{PictureID: "missing"})
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	// The upload always comes from the picture, never from the cart
+	rr = placeOrder(types.Print{PictureID: uploaded["u1"].PictureID, PictureHash: uploaded["u2"].Hash})
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var order types.Order
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&order))
+	require.Equal(t, uploaded["u1"].Hash, order.Prints[0].PictureHash)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
@@ -16,12 +17,13 @@ import (
 )
 
 type CartHandlers struct {
-	db     store.DataStore
-	config atomic.Value
+	db       store.DataStore
+	config   *atomic.Value
+	webhooks *WebhookDispatcher
 }
 
-func NewCartHandlers(db store.DataStore, conf atomic.Value) *CartHandlers {
-	return &CartHandlers{db: db, config: conf}
+func NewCartHandlers(db store.DataStore, conf *atomic.Value, webhooks *WebhookDispatcher) *CartHandlers {
+	return &CartHandlers{db: db, config: conf, webhooks: webhooks}
 }
 
 // GetCarts gets all carts
@@ -75,8 +77,9 @@ func (c *CartHandlers) PutCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, print := range cart.Prints {
-		if err := c.normalizePrint(&print); err != nil {
+	config := loadConfig(c.config)
+	for i := range cart.Prints {
+		if _, err := normalizePrint(c.db, config, &cart.Prints[i]); err != nil {
 			writeHttpError(r.Context(), w, err, http.StatusBadRequest)
 			return
 		}
@@ -93,12 +96,16 @@ func (c *CartHandlers) PutCart(w http.ResponseWriter, r *http.Request) {
 		writeHttpError(r.Context(), w, fmt.Errorf("error updating cart: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if err := markPicturesUsed(c.db, time.Now().UTC(), printPictureIDs(cart.Prints)...); err != nil {
+		logger.Warn().Err(err).Msg("Error marking pictures as used")
+	}
 	w.WriteHeader(http.StatusOK)
 
 	if err := c.ensureCart(userID); err != nil {
 		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
 		return
 	}
+	c.webhooks.Publish(types.WebhookCartUpdated, cart)
 
 	if err := json.NewEncoder(w).Encode(cart); err != nil {
 		logger.Error().Err(err).Msg("Error writing paper response")
@@ -119,7 +126,7 @@ func (c *CartHandlers) AddPrintToCart(w http.ResponseWriter, r *http.Request) {
 
 	logger.Debug().Msg("Validating print")
 
-	if err := c.normalizePrint(&print); err != nil {
+	if _, err := normalizePrint(c.db, loadConfig(c.config), &print); err != nil {
 		writeHttpError(r.Context(), w, err, http.StatusBadRequest)
 		return
 	}
@@ -157,6 +164,11 @@ func (c *CartHandlers) AddPrintToCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := markPicturesUsed(c.db, time.Now().UTC(), print.PictureID); err != nil {
+		logger.Warn().Err(err).Msg("Error marking picture as used")
+	}
+	c.webhooks.Publish(types.WebhookCartUpdated, cart)
+
 	logger.Debug().Msg("Writing response")
 
 	if err := json.NewEncoder(w).Encode(cart); err != nil {
@@ -192,24 +204,35 @@ func (c *CartHandlers) ensureCart(userID string) error {
 	return nil
 }
 
-func (c *CartHandlers) normalizePrint(print *types.Print) error {
+// normalizePrint validates the print against the given config and sets its cost from the current
+// paper and supply prices. The paper the print uses is returned
+func normalizePrint(db store.DataStore, config types.Config, print *types.Print) (*types.PaperType, error) {
 	// Fetch the paper type by ID, if the key doesn't exist, return bad request
-	paper, err := fetchOne[types.PaperType](c.db, fmt.Sprintf("papers:%s", print.PaperTypeID))
+	paper, err := fetchOne[types.PaperType](db, fmt.Sprintf("papers:%s", print.PaperTypeID))
 	if errors.Is(err, store.ErrKeyNotFound) {
-		return fmt.Errorf("invalid paper ID given")
+		return nil, fmt.Errorf("invalid paper ID given")
 	} else if err != nil {
-		return fmt.Errorf("error validating ID: %v", err)
+		return nil, fmt.Errorf("error validating ID: %v", err)
+	}
+	if paper.Archived {
+		return nil, fmt.Errorf("paper %s is no longer available", paper.Name)
 	}
 
 	// Check that width and height are not greater than the configured max size
-	config := c.config.Load().(*types.Config)
 	if print.Width > config.MaxSize && print.Height > config.MaxSize {
-		return fmt.Errorf("print is too large")
+		return nil, fmt.Errorf("print is too large")
+	}
+
+	// The upload a print uses is only ever set from the picture when the order is placed
+	print.PictureHash = ""
+	if err := checkPrintQuality(db, config, print); err != nil {
+		return nil, err
 	}
 
 	// Set the correct cost
-	rawMaterialsCost := (paper.CostPerSquareInch * print.Width * print.Height) + (config.Costs.InkPerSquareInch * print.Width * print.Height)
-	print.Cost = rawMaterialsCost + (rawMaterialsCost * config.Costs.DesiredProfitMargin)
+	price := pricePrint(*paper, config.Costs, *print)
+	print.Price = &price
+	print.Cost = price.UnitPrice
 
-	return nil
+	return paper, nil
 }
@@ -2,12 +2,14 @@ package handlers_test
 
 import (
 	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/require"
@@ -24,13 +26,18 @@ func TestHappyPath(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	conf := atomic.Value{}
+	conf := &atomic.Value{}
 
 	conf.Store(types.Config{
 		MaxSize: 17.0,
+		Costs: types.SupplyCosts{
+			InkPerSquareInch:    0.125,
+			DesiredProfitMargin: 0.5,
+		},
 	})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.25, Finish: types.PaperFinishLuster})
 
-	cartHandler := handlers.NewCartHandlers(db, conf)
+	cartHandler := handlers.NewCartHandlers(db, conf, nil)
 	r := chi.NewRouter()
 	r.Get("/carts", cartHandler.GetCarts)
 	r.Get("/carts/{userId}", cartHandler.GetUserCart)
@@ -42,9 +49,10 @@ func TestHappyPath(t *testing.T) {
 		UserID: "1",
 		Prints: []types.Print{
 			{
-				PictureID: "1",
-				Width:     8,
-				Height:    10,
+				PictureID:   "1",
+				PaperTypeID: "1",
+				Width:       8,
+				Height:      10,
 			},
 		},
 	}
@@ -54,6 +62,10 @@ func TestHappyPath(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPut, "/carts/1", buf)
 	r.ServeHTTP(recorder, req)
 
+	// The cost should be calculated and set on the returned cart
+	cart.Prints[0].Cost = 45
+	cart.Prints[0].Price = &types.PriceBreakdown{PaperCost: 20, InkCost: 10, Profit: 15, UnitPrice: 45}
+
 	require.Equal(t, http.StatusOK, recorder.Code, "expected status code 200, got %d: %s", recorder.Code, recorder.Body)
 	var returnedCart types.Cart
 	err = json.NewDecoder(recorder.Body).Decode(&returnedCart)
@@ -98,9 +110,9 @@ func TestEmptyCart(t *testing.T) {
 	db, err := store.NewDiskDataStore(tmpfile)
 	require.NoError(t, err)
 
-	conf := atomic.Value{}
+	conf := &atomic.Value{}
 
-	cartHandler := handlers.NewCartHandlers(db, conf)
+	cartHandler := handlers.NewCartHandlers(db, conf, nil)
 	r := chi.NewRouter()
 	r.Get("/carts/{userId}", cartHandler.GetUserCart)
 
@@ -118,5 +130,67 @@ func TestEmptyCart(t *testing.T) {
 	require.Equal(t, types.Cart{UserID: "1"}, cart)
 }
 
+func TestCheckoutReprices(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	conf := &atomic.Value{}
+	conf.Store(types.Config{
+		MaxSize: 17.0,
+		Costs: types.SupplyCosts{
+			ShippingProfiles: []types.ShippingProfile{{ShippingMethod: types.ShippingMethodStandard, Cost: 5, Name: "Standard"}},
+		},
+	})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.25})
+	uploadedAt := time.Now().UTC()
+	putPicture(t, db, types.Picture{PictureID: "1", UserID: "u1", UploadedAt: &uploadedAt})
+
+	r := chi.NewRouter()
+	r.Put("/carts/{userId}", handlers.NewCartHandlers(db, conf, nil).PutCart)
+	r.Post("/orders/{userId}", handlers.NewOrderHandlers(db, nil, conf, &fakePayment{}, nil, nil).AddOrder)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, json.NewEncoder(buf).Encode(types.Cart{
+		UserID: "u1",
+		Prints: []types.Print{{PictureID: "1", PaperTypeID: "1", Width: 8, Height: 10, Quantity: 2}},
+	}))
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/carts/u1", buf))
+	require.Equal(t, http.StatusOK, recorder.Code, "expected status code 200, got %d: %s", recorder.Code, recorder.Body)
+
+	// Raise the price of the paper after it was added to the cart
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.5})
+
+	placeOrder := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"shippingProfile": {"shippingMethod": "standard"}}`)
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/orders/u1", body))
+		return recorder
+	}
+
+	recorder = placeOrder()
+	require.Equal(t, http.StatusConflict, recorder.Code, "expected status code 409, got %d: %s", recorder.Code, recorder.Body)
+	var priceChange handlers.PriceChangedResponse
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&priceChange))
+	require.Equal(t, 40.0, priceChange.OldTotal)
+	require.Equal(t, 80.0, priceChange.NewTotal)
+	require.Equal(t, []handlers.PrintPriceChange{{Index: 0, OldCost: 20, NewCost: 40}}, priceChange.Changes)
+
+	// Placing the order again accepts the new prices
+	recorder = placeOrder()
+	require.Equal(t, http.StatusCreated, recorder.Code, "expected status code 201, got %d: %s", recorder.Code, recorder.Body)
+	var order types.Order
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&order))
+	require.Equal(t, 80.0, order.PrintsSubtotal)
+	require.Equal(t, 85.0, order.OrderTotal)
+	require.Equal(t, "Lustre", order.Prints[0].Paper.Name)
+}
+
+func putPaper(t *testing.T, db store.DataStore, paper types.PaperType) {
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(paper))
+	require.NoError(t, db.Set("papers:"+paper.ID(), buf.Bytes()))
+}
+
 // TODO: Test failed verification of print size
 // TODO: Test add single print to cart
@@ -85,11 +85,18 @@ func addOne[T IDManager](db store.DataStore, name string, item T, validation Val
 		return empty, err
 	}
 	item.SetID(id)
+	return insertOne[T](db, name, item, additionalUpdate)
+}
+
+// insertOne stores an item that already has its ID set and adds it to the list of keys for the
+// given name. This is only needed when the ID has to be known before the item is stored
+func insertOne[T IDManager](db store.DataStore, name string, item T, additionalUpdate func(T) error) (T, error) {
+	var empty T
 	rawBuf := new(bytes.Buffer)
 	if err := gob.NewEncoder(rawBuf).Encode(item); err != nil {
 		return empty, err
 	}
-	db_key := fmt.Sprintf("%s:%s", name, id)
+	db_key := fmt.Sprintf("%s:%s", name, item.ID())
 	if err := db.Set(db_key, rawBuf.Bytes()); err != nil {
 		return empty, err
 	}
@@ -106,7 +113,7 @@ func addOne[T IDManager](db store.DataStore, name string, item T, validation Val
 	if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
 		return empty, err
 	} else if err != nil {
-		keys = make([]string, 1)
+		keys = make([]string, 0)
 	} else {
 		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&keys); err != nil {
 			return empty, err
@@ -16,13 +16,22 @@ import (
 
 type ConfigHandlers struct {
 	db            store.DataStore
-	currentConfig atomic.Value
+	currentConfig *atomic.Value
 }
 
-func NewConfigHandlers(db store.DataStore, config atomic.Value) *ConfigHandlers {
+func NewConfigHandlers(db store.DataStore, config *atomic.Value) *ConfigHandlers {
 	return &ConfigHandlers{db: db, currentConfig: config}
 }
 
+// loadConfig returns the current config, or an empty config if one was never stored
+func loadConfig(conf *atomic.Value) types.Config {
+	config, ok := conf.Load().(types.Config)
+	if !ok {
+		return types.Config{}
+	}
+	return config
+}
+
 // GetConfig gets the current configuration from the database
 func (c *ConfigHandlers) GetConfig(w http.ResponseWriter, r *http.Request) {
 	logger := httplog.LogEntry(r.Context())
@@ -59,7 +68,39 @@ func (c *ConfigHandlers) PutConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Validate config data
+	// TODO: Validate the rest of the config data
+	if err := validateShippingProfiles(config.Costs.ShippingProfiles); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid shipping profile: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, zone := range config.ShippingZones {
+		if err := validateShippingZone(zone); err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("invalid shipping zone: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := validatePrintQualitySettings(config.PrintQuality); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid print quality settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateRenderSettings(config.Rendering); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid rendering settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateUploadSettings(config.Uploads); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid upload settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateRetentionSettings(config.Retention); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid retention settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateQuotaSettings(config.Quotas); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid quotas: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	rawBuf := new(bytes.Buffer)
 	if err := gob.NewEncoder(rawBuf).Encode(config); err != nil {
 		writeHttpError(r.Context(), w, fmt.Errorf("error encoding config: %v", err), http.StatusInternalServerError)
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/thomastaylor312/printing-api/imagemeta"
+	"github.com/thomastaylor312/printing-api/render"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	derivativeQuality = 85
+	// The number of pictures that can be waiting for derivatives. Pictures that don't fit are picked
+	// up by a later sweep
+	derivativeQueueSize = 100
+)
+
+// derivativeSizes are the longest side of each derivative in pixels. They are largest first so each
+// one can be scaled from the one before instead of the full picture
+var derivativeSizes = []struct {
+	size    types.DerivativeSize
+	longest int
+}{
+	{types.DerivativeLarge, 2048},
+	{types.DerivativePreview, 1024},
+	{types.DerivativeSmall, 512},
+	{types.DerivativeThumbnail, 256},
+}
+
+// pictureDerivatives is what is stored for a picture's derivatives. UploadedAt is the upload they
+// were generated from
+type pictureDerivatives struct {
+	UploadedAt  time.Time
+	Derivatives []types.Derivative
+}
+
+func derivativesKey(pictureID string) string {
+	return fmt.Sprintf("picture_derivatives:%s", pictureID)
+}
+
+type derivativeJob struct {
+	userID     string
+	pictureID  string
+	uploadedAt time.Time
+}
+
+// DerivativeGenerator generates the web sized copies of uploaded pictures in the background. Pictures
+// are processed one at a time so a burst of uploads can't use up all the memory. The queue only
+// lives in memory, so pictures that were dropped from a full queue or lost in a restart are found by
+// sweeping for pictures without up to date derivatives. A nil DerivativeGenerator doesn't generate
+// anything
+type DerivativeGenerator struct {
+	db       store.DataStore
+	storage  store.ImageStore
+	logger   zerolog.Logger
+	interval time.Duration
+	jobs     chan derivativeJob
+
+	// The upload time of each picture waiting in the queue so sweeps don't queue them twice
+	queued sync.Map
+}
+
+// NewDerivativeGenerator creates a DerivativeGenerator that sweeps for missing derivatives when it
+// starts and then every interval
+func NewDerivativeGenerator(db store.DataStore, storage store.ImageStore, logger zerolog.Logger, interval time.Duration) *DerivativeGenerator {
+	return &DerivativeGenerator{
+		db:       db,
+		storage:  storage,
+		logger:   logger,
+		interval: interval,
+		jobs:     make(chan derivativeJob, derivativeQueueSize),
+	}
+}
+
+// Start processes queued pictures and sweeps for missing derivatives in the background until the
+// context is cancelled
+func (d *DerivativeGenerator) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			queued, err := d.Sweep()
+			if err != nil {
+				d.logger.Error().Err(err).Msg("Error sweeping for missing picture derivatives")
+			} else if queued > 0 {
+				d.logger.Info().Int("queued", queued).Msg("Queued pictures with missing derivatives")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case job := <-d.jobs:
+				d.queued.CompareAndDelete(job.pictureID, job.uploadedAt)
+				logger := d.logger.With().Str("userID", job.userID).Str("pictureID", job.pictureID).Logger()
+				if err := d.generate(job); err != nil {
+					logger.Error().Err(err).Msg("Error generating picture derivatives")
+				} else {
+					logger.Debug().Msg("Generated picture derivatives")
+				}
+			}
+		}
+	}()
+}
+
+// Queue queues an uploaded picture to have its derivatives generated. It returns false if the queue
+// is full, in which case the picture is queued by a later sweep
+func (d *DerivativeGenerator) Queue(picture types.Picture) bool {
+	if d == nil || picture.UploadedAt == nil {
+		return false
+	}
+	if queuedAt, ok := d.queued.Load(picture.PictureID); ok && queuedAt.(time.Time).Equal(*picture.UploadedAt) {
+		return true
+	}
+	// This is recorded first so the job can't be processed before it is
+	d.queued.Store(picture.PictureID, *picture.UploadedAt)
+	select {
+	case d.jobs <- derivativeJob{userID: picture.UserID, pictureID: picture.PictureID, uploadedAt: *picture.UploadedAt}:
+		return true
+	default:
+		d.queued.CompareAndDelete(picture.PictureID, *picture.UploadedAt)
+		return false
+	}
+}
+
+// Sweep queues every uploaded picture whose derivatives are missing or from an older upload and
+// returns how many were queued. It stops early if the queue fills up
+func (d *DerivativeGenerator) Sweep() (int, error) {
+	keys, err := getKeys(d.db, "pictures")
+	if err != nil {
+		return 0, fmt.Errorf("error getting pictures: %v", err)
+	}
+	queued := 0
+	for _, key := range keys {
+		picture, err := fetchOne[types.Picture](d.db, key)
+		if errors.Is(err, store.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return queued, fmt.Errorf("error getting picture: %v", err)
+		}
+		if picture.UploadedAt == nil || picture.DeletedAt != nil {
+			continue
+		}
+		stored, err := fetchOne[pictureDerivatives](d.db, derivativesKey(picture.PictureID))
+		if err == nil && stored.UploadedAt.Equal(*picture.UploadedAt) {
+			continue
+		} else if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+			return queued, fmt.Errorf("error getting derivatives: %v", err)
+		}
+		if !d.Queue(*picture) {
+			d.logger.Warn().Msg("Derivative queue is full, the remaining pictures will be queued by the next sweep")
+			return queued, nil
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+func (d *DerivativeGenerator) generate(job derivativeJob) error {
+	queued, err := fetchOne[types.Picture](d.db, fmt.Sprintf("pictures:%s", job.pictureID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting picture: %v", err)
+	}
+	// A newer upload is queued behind us, so skip straight to it
+	if queued.UploadedAt == nil || !queued.UploadedAt.Equal(job.uploadedAt) {
+		return nil
+	}
+	original, err := d.storage.Open(pictureFile(*queued))
+	if err != nil {
+		return fmt.Errorf("error opening picture: %v", err)
+	}
+	data, err := io.ReadAll(original)
+	original.Close()
+	if err != nil {
+		return fmt.Errorf("error reading picture: %v", err)
+	}
+	picture, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error decoding picture: %v", err)
+	}
+	picture = render.Orient(picture, imagemeta.Orientation(data))
+	// Browsers use the profile to show the colors correctly, and assume sRGB without one
+	profile := imagemeta.RGBICCProfile(data)
+
+	derivatives := make([]types.Derivative, 0, len(derivativeSizes))
+	for _, size := range derivativeSizes {
+		scaled := render.Fit(picture, size.longest)
+		buf := new(bytes.Buffer)
+		// The DPI doesn't matter for screens, 72 is the traditional default
+		if err := render.Encode(buf, scaled, types.PrintFileFormatJPEG, 72, derivativeQuality, profile); err != nil {
+			return fmt.Errorf("error encoding %s derivative: %v", size.size, err)
+		}
+		derivative := types.Derivative{
+			Size:        size.size,
+			FileID:      fmt.Sprintf("%s-%s.jpg", job.pictureID, size.size),
+			ContentType: imagemeta.ContentTypeJPEG,
+			Width:       scaled.Bounds().Dx(),
+			Height:      scaled.Bounds().Dy(),
+		}
+		if _, err := d.storage.Set(job.userID, derivative.FileID, uint(buf.Len()), io.NopCloser(buf)); err != nil {
+			return fmt.Errorf("error storing %s derivative: %v", size.size, err)
+		}
+		derivatives = append(derivatives, derivative)
+		picture = scaled
+	}
+
+	// If the picture was uploaded again while we were working, the newer upload is queued behind us
+	// and will replace these, so there is nothing to record
+	current, err := fetchOne[types.Picture](d.db, fmt.Sprintf("pictures:%s", job.pictureID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		// The picture was deleted while we were working
+		return deleteDerivativeFiles(d.storage, job.userID, derivatives)
+	} else if err != nil {
+		return fmt.Errorf("error getting picture: %v", err)
+	}
+	if current.UploadedAt == nil || !current.UploadedAt.Equal(job.uploadedAt) {
+		return nil
+	}
+	return storeOne(d.db, derivativesKey(job.pictureID), pictureDerivatives{UploadedAt: job.uploadedAt, Derivatives: derivatives})
+}
+
+// loadDerivatives sets the derivatives on the picture with their URLs. Pictures without any yet are
+// left without them
+func loadDerivatives(db store.DataStore, storage store.ImageStore, picture *types.Picture) error {
+	picture.Derivatives = nil
+	stored, err := fetchOne[pictureDerivatives](db, derivativesKey(picture.PictureID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting derivatives: %v", err)
+	}
+	// Derivatives from an older upload are about to be replaced, so don't show the old picture
+	if picture.UploadedAt == nil || !picture.UploadedAt.Equal(stored.UploadedAt) {
+		return nil
+	}
+	for _, derivative := range stored.Derivatives {
+		u, err := storage.Get(picture.UserID, derivative.FileID)
+		if err != nil {
+			return fmt.Errorf("error getting derivative URL: %v", err)
+		}
+		derivative.URL = u
+		picture.Derivatives = append(picture.Derivatives, derivative)
+	}
+	return nil
+}
+
+// deleteDerivativeFiles removes derivatives from storage, ignoring any that are already gone
+func deleteDerivativeFiles(storage store.ImageStore, container string, derivatives []types.Derivative) error {
+	for _, derivative := range derivatives {
+		if err := storage.Delete(container, derivative.FileID); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+			return err
+		}
+	}
+	return nil
+}
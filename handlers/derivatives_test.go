@@ -0,0 +1,131 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestDerivatives(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{})
+	putPicture(t, db, types.Picture{PictureID: "10", UserID: "u1", Name: "panorama"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	derivatives := handlers.NewDerivativeGenerator(db, storage, zerolog.Nop(), time.Hour)
+	derivatives.Start(ctx)
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, derivatives)
+	r := chi.NewRouter()
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	r.Get("/pictures/{userId}/{id}", pictureHandlers.GetPictureInfo)
+
+	upload := func(width int, height int) {
+		buf := new(bytes.Buffer)
+		require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height))))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("PUT", "/pictures/u1/10", buf))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+	// waitForDerivatives polls until the largest derivative has the given width
+	waitForDerivatives := func(width int) types.Picture {
+		var picture types.Picture
+		require.Eventually(t, func() bool {
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest("GET", "/pictures/u1/10", nil))
+			require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+			picture = types.Picture{}
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+			return len(picture.Derivatives) > 0 && picture.Derivatives[0].Width == width
+		}, 10*time.Second, 20*time.Millisecond)
+		return picture
+	}
+
+	upload(3000, 1000)
+	picture := waitForDerivatives(2048)
+	require.Len(t, picture.Derivatives, 4)
+	large, thumbnail := picture.Derivatives[0], picture.Derivatives[3]
+	require.Equal(t, types.DerivativeLarge, large.Size)
+	require.Equal(t, 682, large.Height)
+	require.Equal(t, types.DerivativeThumbnail, thumbnail.Size)
+	require.Equal(t, 256, thumbnail.Width)
+	require.Equal(t, 85, thumbnail.Height)
+	require.Equal(t, "image/jpeg", thumbnail.ContentType)
+	require.NotNil(t, thumbnail.URL)
+
+	// Uploading again replaces the derivatives, and small pictures aren't scaled up
+	upload(100, 200)
+	picture = waitForDerivatives(100)
+	for _, derivative := range picture.Derivatives {
+		require.Equal(t, 100, derivative.Width, derivative.Size)
+		require.Equal(t, 200, derivative.Height, derivative.Size)
+	}
+}
+
+func TestDerivativesSweep(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{})
+
+	// Upload without a generator, like a picture whose job was lost in a restart
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}", pictureHandlers.CreatePicture)
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	r.Get("/pictures/{userId}/{id}", pictureHandlers.GetPictureInfo)
+	var pictures []types.Picture
+	for _, name := range []string{"panorama", "not uploaded"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", "/pictures/u1", strings.NewReader(`{"userId": "u1", "name": "`+name+`"}`)))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var picture types.Picture
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+		pictures = append(pictures, picture)
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 300, 100))))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/pictures/u1/"+pictures[0].ID(), buf))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	derivatives := handlers.NewDerivativeGenerator(db, storage, zerolog.Nop(), time.Hour)
+	derivatives.Start(ctx)
+	require.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", "/pictures/u1/"+pictures[0].ID(), nil))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var picture types.Picture
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+		return len(picture.Derivatives) == 4
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// Pictures with up to date derivatives aren't queued again
+	queued, err := derivatives.Sweep()
+	require.NoError(t, err)
+	require.Equal(t, 0, queued)
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/imagemeta"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	// The image store container direct uploads are put in until they are validated
+	pendingUploadContainer = "pending-uploads"
+	// Long enough to upload a large TIFF on a slow connection
+	directUploadExpiry = time.Hour
+)
+
+// CreateUploadURL returns a URL the client can upload a picture to directly instead of sending it
+// through the API. Once the upload finishes the client calls CompleteUpload, and until then the
+// picture keeps its previous upload, if it had one
+func (p *PictureHandlers) CreateUploadURL(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	pictureID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("pictureID", pictureID).Logger()
+	uploader, ok := p.storage.(store.DirectUploader)
+	if !ok {
+		writeHttpError(r.Context(), w, fmt.Errorf("direct uploads are not supported, upload the picture to the API instead"), http.StatusNotImplemented)
+		return
+	}
+
+	var req types.DirectUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding upload request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.ContentType != imagemeta.ContentTypeJPEG && req.ContentType != imagemeta.ContentTypePNG && req.ContentType != imagemeta.ContentTypeTIFF {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture must be a JPEG, PNG or TIFF"), http.StatusUnsupportedMediaType)
+		return
+	}
+	if req.Size <= 0 {
+		writeHttpError(r.Context(), w, fmt.Errorf("size of picture must be provided"), http.StatusBadRequest)
+		return
+	}
+	if maxBytes := uploadMaxBytes(loadConfig(p.conf).Uploads); req.Size > maxBytes {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture is %d bytes, the maximum is %d bytes", req.Size, maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	picture, err := p.getPicture(pictureID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	if !p.enforceUploadQuota(w, r, picture, req.Size) {
+		return
+	}
+	u, err := uploader.UploadURL(pendingUploadContainer, picture.ID(), req.ContentType, uint(req.Size), directUploadExpiry)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error creating upload URL: %v", err), http.StatusInternalServerError)
+		return
+	}
+	upload := types.DirectUpload{
+		URL:       u,
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": req.ContentType},
+		ExpiresAt: time.Now().UTC().Add(directUploadExpiry),
+	}
+	picture.PendingUpload = &types.PendingUpload{ContentType: req.ContentType, Size: req.Size, ExpiresAt: upload.ExpiresAt}
+	if err := storeOne(p.db, fmt.Sprintf("pictures:%s", picture.ID()), picture); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating picture: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(upload); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// CompleteUpload validates a picture that was uploaded directly to storage and makes it the
+// picture's upload. Pictures that fail validation are deleted and the client has to start over, but
+// if the picture can't be stored the upload is kept so completing it can be retried
+func (p *PictureHandlers) CompleteUpload(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	pictureID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("pictureID", pictureID).Logger()
+	picture, err := p.getPicture(pictureID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	pending := picture.PendingUpload
+	if pending == nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture does not have an upload in progress"), http.StatusConflict)
+		return
+	}
+
+	reader, err := p.storage.Open(pendingUploadContainer, picture.ID())
+	if errors.Is(err, store.ErrImageNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture has not been uploaded to the upload URL"), http.StatusConflict)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error opening upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	upload, err := spoolPicture(reader, pending.Size+1)
+	reader.Close()
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error reading upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer upload.Close()
+
+	picture.PendingUpload = nil
+	var meta imagemeta.Metadata
+	var code int
+	if upload.size != pending.Size {
+		code, err = http.StatusBadRequest, fmt.Errorf("expected a %d byte picture but %d bytes were uploaded", pending.Size, upload.size)
+	} else {
+		meta, code, err = validatePicture(upload, upload.size, pending.ContentType, loadConfig(p.conf).Uploads)
+	}
+	if err != nil && code < http.StatusInternalServerError {
+		// The upload will never be valid, so it is removed and the client has to start over
+		if err := p.storage.Delete(pendingUploadContainer, picture.ID()); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+			logger.Warn().Err(err).Msg("Error deleting invalid upload")
+		}
+		if storeErr := storeOne(p.db, fmt.Sprintf("pictures:%s", picture.ID()), picture); storeErr != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("error updating picture: %v", storeErr), http.StatusInternalServerError)
+			return
+		}
+		writeHttpError(r.Context(), w, err, code)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, err, code)
+		return
+	}
+
+	// The upload is only removed once it is stored as the picture, so a failure can be retried
+	if !p.storePicture(w, r, picture, upload, meta) {
+		return
+	}
+	if err := p.storage.Delete(pendingUploadContainer, picture.ID()); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+		logger.Warn().Err(err).Msg("Error deleting completed upload")
+	}
+}
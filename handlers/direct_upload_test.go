@@ -0,0 +1,146 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// directUploadStore is a disk store that hands out fake upload URLs so the test can write the
+// upload itself
+type directUploadStore struct {
+	*store.DiskImageStore
+}
+
+func (d directUploadStore) UploadURL(container string, id string, contentType string, length uint, expiry time.Duration) (*url.URL, error) {
+	return &url.URL{Scheme: "https", Host: "uploads.example.com", Path: "/" + container + "/" + id}, nil
+}
+
+// failingStore fails to store uploaded pictures while fail is set
+type failingStore struct {
+	directUploadStore
+	fail *atomic.Bool
+}
+
+func (f failingStore) Set(container string, id string, expected_length uint, value io.ReadCloser) (*url.URL, error) {
+	if container == "blobs" && f.fail.Load() {
+		value.Close()
+		return nil, errors.New("storage is unavailable")
+	}
+	return f.directUploadStore.Set(container, id, expected_length, value)
+}
+
+func TestDirectUpload(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	diskStorage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	storage := directUploadStore{diskStorage}
+	conf := &atomic.Value{}
+	conf.Store(types.Config{MaxSize: 30})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.25})
+	putPicture(t, db, types.Picture{PictureID: "10", UserID: "u1", Name: "big"})
+
+	newRouter := func(storage store.ImageStore) http.Handler {
+		pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+		cartHandlers := handlers.NewCartHandlers(db, conf, nil)
+		r := chi.NewRouter()
+		r.Post("/pictures/{userId}/{id}/upload-url", pictureHandlers.CreateUploadURL)
+		r.Post("/pictures/{userId}/{id}/upload-complete", pictureHandlers.CompleteUpload)
+		r.Put("/carts/{userId}", cartHandlers.PutCart)
+		return r
+	}
+	failing := failingStore{directUploadStore: storage, fail: &atomic.Bool{}}
+	r := newRouter(failing)
+	post := func(r http.Handler, path string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			raw, err := json.Marshal(body)
+			require.NoError(t, err)
+			reader = bytes.NewReader(raw)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", path, reader))
+		return rr
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 640, 480))))
+	pngData := buf.Bytes()
+	request := types.DirectUploadRequest{ContentType: "image/png", Size: int64(len(pngData))}
+
+	rr := post(newRouter(diskStorage), "/pictures/u1/10/upload-url", request)
+	require.Equal(t, http.StatusNotImplemented, rr.Code, "stores without direct uploads should fail: %s", rr.Body.String())
+	rr = post(r, "/pictures/u1/10/upload-url", types.DirectUploadRequest{ContentType: "image/gif", Size: 10})
+	require.Equal(t, http.StatusUnsupportedMediaType, rr.Code, rr.Body.String())
+
+	rr = post(r, "/pictures/u1/10/upload-url", request)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var upload types.DirectUpload
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&upload))
+	require.Equal(t, "/pending-uploads/10", upload.URL.Path)
+	require.Equal(t, "image/png", upload.Headers["Content-Type"])
+
+	// The picture can't be printed until the upload is complete
+	cart, err := json.Marshal(types.Cart{UserID: "u1", Prints: []types.Print{{PictureID: "10", PaperTypeID: "1", Width: 4, Height: 3}}})
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/carts/u1", bytes.NewReader(cart)))
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	rr = post(r, "/pictures/u1/10/upload-complete", nil)
+	require.Equal(t, http.StatusConflict, rr.Code, "completing before uploading should fail: %s", rr.Body.String())
+
+	// Something that isn't the promised PNG is rejected and the client has to start again
+	_, err = storage.Set("pending-uploads", "10", 4, io.NopCloser(bytes.NewReader([]byte("GIF8"))))
+	require.NoError(t, err)
+	rr = post(r, "/pictures/u1/10/upload-complete", nil)
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+	_, err = storage.Open("pending-uploads", "10")
+	require.ErrorIs(t, err, store.ErrImageNotFound)
+	rr = post(r, "/pictures/u1/10/upload-complete", nil)
+	require.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+
+	rr = post(r, "/pictures/u1/10/upload-url", request)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	_, err = storage.Set("pending-uploads", "10", uint(len(pngData)), io.NopCloser(bytes.NewReader(pngData)))
+	require.NoError(t, err)
+
+	// If the picture can't be stored the upload is kept so completing it can be retried
+	failing.fail.Store(true)
+	rr = post(r, "/pictures/u1/10/upload-complete", nil)
+	require.Equal(t, http.StatusInternalServerError, rr.Code, rr.Body.String())
+	pending, err := storage.Open("pending-uploads", "10")
+	require.NoError(t, err)
+	pending.Close()
+	failing.fail.Store(false)
+
+	rr = post(r, "/pictures/u1/10/upload-complete", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var picture types.Picture
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+	require.Equal(t, 640, picture.Width)
+	require.Nil(t, picture.PendingUpload)
+	_, err = storage.Open("pending-uploads", "10")
+	require.ErrorIs(t, err, store.ErrImageNotFound, "the upload should be removed once it is stored")
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/carts/u1", bytes.NewReader(cart)))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
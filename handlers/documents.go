@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/documents"
+	"github.com/thomastaylor312/printing-api/imagemeta"
+	"github.com/thomastaylor312/printing-api/render"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+	_ "golang.org/x/image/tiff"
+)
+
+// The size in pixels of the longest side of thumbnails on packing slips. This is the size of the
+// thumbnail derivatives so they can be used as they are
+const packingSlipThumbnailSize = 256
+
+type DocumentHandlers struct {
+	db      store.DataStore
+	storage store.ImageStore
+	conf    *atomic.Value
+}
+
+func NewDocumentHandlers(db store.DataStore, storage store.ImageStore, conf *atomic.Value) *DocumentHandlers {
+	return &DocumentHandlers{db: db, storage: storage, conf: conf}
+}
+
+// GetPackingSlip renders the packing slip PDF for an order
+func (d *DocumentHandlers) GetPackingSlip(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	orderID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("orderID", orderID).Logger()
+	order, err := d.getOrder(userID, orderID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+
+	// The customer is only used for display, so we can still render without it
+	customer, err := fetchOne[types.User](d.db, "users:"+userID)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Unable to get customer for packing slip")
+		customer = nil
+	}
+
+	// Missing thumbnails shouldn't stop staff from being able to pack the order
+	thumbnails := make(map[string]documents.Thumbnail)
+	for _, print := range order.Prints {
+		if _, ok := thumbnails[print.PictureID]; ok {
+			continue
+		}
+		thumb, err := d.thumbnail(print)
+		if err != nil {
+			logger.Warn().Err(err).Str("pictureID", print.PictureID).Msg("Unable to create thumbnail for packing slip")
+			continue
+		}
+		thumbnails[print.PictureID] = thumb
+	}
+
+	writePDF(w, r, fmt.Sprintf("packing-slip-%s.pdf", order.ID()), documents.PackingSlip(*order, customer, thumbnails))
+}
+
+// GetShippingLabel renders a 4x6 shipping label PDF for an order
+func (d *DocumentHandlers) GetShippingLabel(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	orderID := chi.URLParam(r, "id")
+	order, err := d.getOrder(userID, orderID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+
+	conf := loadConfig(d.conf)
+	if conf.ReturnAddress == nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("a return address must be configured to create shipping labels"), http.StatusConflict)
+		return
+	}
+	label, err := documents.ShippingLabel(*order, *conf.ReturnAddress)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("unable to create shipping label: %v", err), http.StatusConflict)
+		return
+	}
+
+	writePDF(w, r, fmt.Sprintf("shipping-label-%s.pdf", order.ID()), label)
+}
+
+// thumbnail creates the thumbnail for the print's picture from its thumbnail derivative, or from
+// the original if the derivative isn't there or is for a different upload than the one ordered
+func (d *DocumentHandlers) thumbnail(print types.Print) (documents.Thumbnail, error) {
+	if img, ok := d.derivativeThumbnail(print); ok {
+		return documents.NewThumbnail(img, packingSlipThumbnailSize)
+	}
+
+	reader, err := openPrintPicture(d.db, d.storage, print)
+	if err != nil {
+		return documents.Thumbnail{}, err
+	}
+	picture, err := spoolPicture(reader, math.MaxInt64)
+	reader.Close()
+	if err != nil {
+		return documents.Thumbnail{}, fmt.Errorf("error reading picture: %v", err)
+	}
+	defer picture.Close()
+	meta, err := imagemeta.ReadAt(picture, picture.size)
+	if err != nil {
+		return documents.Thumbnail{}, fmt.Errorf("error decoding picture: %v", err)
+	}
+	decodeSlots <- struct{}{}
+	defer func() { <-decodeSlots }()
+	img, _, err := image.Decode(picture.reader())
+	if err != nil {
+		return documents.Thumbnail{}, fmt.Errorf("error decoding picture: %v", err)
+	}
+	return documents.NewThumbnail(render.Orient(img, meta.Orientation), packingSlipThumbnailSize)
+}
+
+// derivativeThumbnail decodes the thumbnail derivative for the print's picture, which is already
+// oriented. It returns false if there isn't one for the picture that was ordered
+func (d *DocumentHandlers) derivativeThumbnail(print types.Print) (image.Image, bool) {
+	picture, err := fetchOne[types.Picture](d.db, fmt.Sprintf("pictures:%s", print.PictureID))
+	if err != nil || (print.PictureHash != "" && picture.Hash != print.PictureHash) {
+		return nil, false
+	}
+	stored, err := fetchOne[pictureDerivatives](d.db, derivativesKey(picture.PictureID))
+	if err != nil || picture.UploadedAt == nil || !picture.UploadedAt.Equal(stored.UploadedAt) {
+		return nil, false
+	}
+	for _, derivative := range stored.Derivatives {
+		if derivative.Size != types.DerivativeThumbnail {
+			continue
+		}
+		reader, err := d.storage.Open(picture.UserID, derivative.FileID)
+		if err != nil {
+			return nil, false
+		}
+		defer reader.Close()
+		img, _, err := image.Decode(reader)
+		return img, err == nil
+	}
+	return nil, false
+}
+
+func (d *DocumentHandlers) getOrder(userID string, orderID string, w http.ResponseWriter, r *http.Request) (*types.Order, error) {
+	order, err := fetchOne[types.Order](d.db, fmt.Sprintf("orders:%s", orderID))
+	if errors.Is(err, store.ErrKeyNotFound) || (order != nil && order.UserID != userID) {
+		formattedErr := fmt.Errorf("order not found")
+		writeHttpError(r.Context(), w, formattedErr, http.StatusNotFound)
+		return nil, formattedErr
+	} else if err != nil {
+		formattedErr := fmt.Errorf("error getting order: %v", err)
+		writeHttpError(r.Context(), w, formattedErr, http.StatusInternalServerError)
+		return nil, formattedErr
+	}
+	return order, nil
+}
+
+func writePDF(w http.ResponseWriter, r *http.Request, filename string, data []byte) {
+	logger := httplog.LogEntry(r.Context())
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	if _, err := w.Write(data); err != nil {
+		logger.Error().Err(err).Msg("Error writing response")
+	}
+}
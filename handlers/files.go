@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/thomastaylor312/printing-api/store"
+)
+
+// FileHandlers serve the files in a DiskImageStore from the signed URLs it returns. The signature is
+// what authorizes the request, so these routes don't need any other authentication
+type FileHandlers struct {
+	storage *store.DiskImageStore
+}
+
+func NewFileHandlers(storage *store.DiskImageStore) *FileHandlers {
+	return &FileHandlers{storage: storage}
+}
+
+// ServeFile serves a file after checking its URL signature. Range and conditional requests are
+// supported, and the response can be cached until the URL expires
+func (f *FileHandlers) ServeFile(w http.ResponseWriter, r *http.Request) {
+	container, err := url.PathUnescape(chi.URLParam(r, "container"))
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid file path"), http.StatusBadRequest)
+		return
+	}
+	id, err := url.PathUnescape(chi.URLParam(r, "id"))
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid file path"), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	if err := f.storage.Verify(container, id, query); err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusForbidden)
+		return
+	}
+
+	reader, err := f.storage.Open(container, id)
+	if errors.Is(err, store.ErrImageNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("file not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error opening file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	// The disk store always opens files, which ServeContent needs to seek for ranges
+	file, ok := reader.(*os.File)
+	if !ok {
+		writeHttpError(r.Context(), w, fmt.Errorf("file can't be served"), http.StatusInternalServerError)
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error reading file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Verify has already checked the expiry parses
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	maxAge := int64(time.Until(time.Unix(expires, 0)).Seconds())
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The name is only used to guess the content type from the extension, and ServeContent sniffs
+	// the contents when there isn't one
+	http.ServeContent(w, r, path.Base(id), info.ModTime(), file)
+}
@@ -0,0 +1,67 @@
+package handlers_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+)
+
+func TestServeFile(t *testing.T) {
+	tmpdir := t.TempDir()
+	storage := store.NewDiskImageStoreWithURLs(filepath.Join(tmpdir, "storage"), store.DiskURLOptions{Secret: []byte("secret")})
+	content := []byte("0123456789")
+	_, err := storage.Set("u1", "10", uint(len(content)), io.NopCloser(bytes.NewReader(content)))
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Get("/files/{container}/{id}", handlers.NewFileHandlers(storage).ServeFile)
+	get := func(u string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", u, nil)
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	u, err := storage.Get("u1", "10")
+	require.NoError(t, err)
+	require.Equal(t, "/files/u1/10", u.Path)
+	require.NotContains(t, u.String(), tmpdir, "URL shouldn't expose where files are stored")
+
+	rr := get(u.String(), nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Equal(t, content, rr.Body.Bytes())
+	require.True(t, strings.HasPrefix(rr.Header().Get("Cache-Control"), "private, max-age="))
+	etag := rr.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	rr = get(u.String(), http.Header{"Range": []string{"bytes=2-4"}})
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	require.Equal(t, "234", rr.Body.String())
+	rr = get(u.String(), http.Header{"If-None-Match": []string{etag}})
+	require.Equal(t, http.StatusNotModified, rr.Code)
+
+	// The signature only works for the file it was made for
+	require.Equal(t, http.StatusForbidden, get(strings.Replace(u.String(), "/10?", "/11?", 1), nil).Code)
+	require.Equal(t, http.StatusForbidden, get("/files/u1/10", nil).Code)
+	expired, err := storage.SignedURL("u1", "10", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, get(expired.String(), nil).Code)
+
+	// URLs from another store with a different secret don't work
+	other, err := store.NewDiskImageStoreWithURLs(filepath.Join(tmpdir, "storage"), store.DiskURLOptions{Secret: []byte("other")}).Get("u1", "10")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, get(other.String(), nil).Code)
+}
@@ -51,6 +51,15 @@ func fetchOne[V any](db store.DataStore, key string) (*V, error) {
 	return &out, nil
 }
 
+// storeOne encodes the item and stores it at the given key, overwriting any existing value
+func storeOne[V any](db store.DataStore, key string, item V) error {
+	rawBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(rawBuf).Encode(item); err != nil {
+		return fmt.Errorf("error encoding: %v", err)
+	}
+	return db.Set(key, rawBuf.Bytes())
+}
+
 func getKeys(db store.DataStore, key string) ([]string, error) {
 	data, err := db.Get(key)
 	var keys []string
@@ -67,3 +76,17 @@ func getKeys(db store.DataStore, key string) ([]string, error) {
 
 	return keys, nil
 }
+
+// removeKey removes a key from a list of keys. Keys that aren't in the list are ignored
+func removeKey(db store.DataStore, listKey string, key string) error {
+	keys, err := getKeys(db, listKey)
+	if err != nil {
+		return err
+	}
+	for i, existing := range keys {
+		if existing == key {
+			return storeOne(db, listKey, append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/rs/zerolog"
+	"github.com/thomastaylor312/printing-api/notify"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const notificationTimeout = 30 * time.Second
+
+// notificationEvents are all the events customers are notified about, in the order they happen
+var notificationEvents = []types.NotificationEvent{
+	types.NotificationOrderCreated,
+	types.NotificationOrderPaid,
+	types.NotificationOrderShipped,
+	types.NotificationOrderDelivered,
+}
+
+// defaultTemplates are used for events that an admin hasn't set a template for
+var defaultTemplates = map[types.NotificationEvent]types.NotificationTemplate{
+	types.NotificationOrderCreated: {
+		Event:   types.NotificationOrderCreated,
+		Subject: "We received your order {{.Order.OrderID}}",
+		Body: `Hi {{.User.Username}},
+
+Thanks for your order! Your order number is {{.Order.OrderID}} and the total is ${{printf "%.2f" .Order.OrderTotal}}.
+{{if .Order.PaymentLink}}
+If you haven't paid yet, you can do so at {{.Order.PaymentLink}}
+{{end}}`,
+	},
+	types.NotificationOrderPaid: {
+		Event:   types.NotificationOrderPaid,
+		Subject: "Payment received for order {{.Order.OrderID}}",
+		Body: `Hi {{.User.Username}},
+
+We received your payment of ${{printf "%.2f" .Order.OrderTotal}} for order {{.Order.OrderID}}. We'll let you know when it ships.
+`,
+	},
+	types.NotificationOrderShipped: {
+		Event:   types.NotificationOrderShipped,
+		Subject: "Your order {{.Order.OrderID}} has shipped",
+		Body: `Hi {{.User.Username}},
+
+Your order {{.Order.OrderID}} is on its way. The tracking number is {{.Shipment.TrackingNumber}}.
+{{if .Shipment.TrackingURL}}
+You can track it at {{.Shipment.TrackingURL}}
+{{end}}`,
+	},
+	types.NotificationOrderDelivered: {
+		Event:   types.NotificationOrderDelivered,
+		Subject: "Your order {{.Order.OrderID}} was delivered",
+		Body: `Hi {{.User.Username}},
+
+Your order {{.Order.OrderID}} has been delivered. We hope you enjoy your prints!
+`,
+	},
+}
+
+// NotificationData is the data templates are rendered with. Shipment is only set for shipped
+// notifications
+type NotificationData struct {
+	Order    types.Order
+	User     types.User
+	Shipment *types.Shipment
+}
+
+// Notifier emails customers about changes to their orders. A nil Notifier doesn't send anything
+type Notifier struct {
+	db     store.DataStore
+	sender notify.Sender
+	logger zerolog.Logger
+}
+
+func NewNotifier(db store.DataStore, sender notify.Sender, logger zerolog.Logger) *Notifier {
+	return &Notifier{db: db, sender: sender, logger: logger}
+}
+
+// Notify sends the notification for the event in the background so slow mail servers don't hold up
+// requests. Failures are logged
+func (n *Notifier) Notify(event types.NotificationEvent, order types.Order, shipment *types.Shipment) {
+	if n == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		defer cancel()
+		logger := n.logger.With().Str("event", string(event)).Str("orderID", order.OrderID).Logger()
+		if err := n.Send(ctx, event, order, shipment); err != nil {
+			logger.Error().Err(err).Msg("Error sending notification")
+			return
+		}
+		logger.Debug().Msg("Sent notification")
+	}()
+}
+
+// Send renders the template for the event and sends it to the user who placed the order. Users
+// without an email address are skipped
+func (n *Notifier) Send(ctx context.Context, event types.NotificationEvent, order types.Order, shipment *types.Shipment) error {
+	user, err := fetchOne[types.User](n.db, fmt.Sprintf("users:%s", order.UserID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting user: %v", err)
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	tmpl, err := getNotificationTemplate(n.db, event)
+	if err != nil {
+		return err
+	}
+	subject, body, err := renderNotification(tmpl, NotificationData{Order: order, User: *user, Shipment: shipment})
+	if err != nil {
+		return err
+	}
+	return n.sender.Send(ctx, notify.Message{To: user.Email, Subject: subject, Body: body})
+}
+
+// getNotificationTemplate returns the template an admin set for the event or the default one
+func getNotificationTemplate(db store.DataStore, event types.NotificationEvent) (types.NotificationTemplate, error) {
+	tmpl, err := fetchOne[types.NotificationTemplate](db, fmt.Sprintf("notification_templates:%s", event))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return defaultTemplates[event], nil
+	} else if err != nil {
+		return types.NotificationTemplate{}, fmt.Errorf("error getting template: %v", err)
+	}
+	return *tmpl, nil
+}
+
+// renderNotification renders the subject and body of the template. Subjects are collapsed onto a
+// single line
+func renderNotification(tmpl types.NotificationTemplate, data NotificationData) (string, string, error) {
+	subject, err := executeTemplate("subject", tmpl.Subject, data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := executeTemplate("body", tmpl.Body, data)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.Join(strings.Fields(subject), " "), body, nil
+}
+
+func executeTemplate(name string, text string, data NotificationData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s template: %v", name, err)
+	}
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("error rendering %s template: %v", name, err)
+	}
+	return buf.String(), nil
+}
+
+// validateNotificationTemplate makes sure the template can be rendered by rendering it with example
+// data
+func validateNotificationTemplate(tmpl types.NotificationTemplate) error {
+	if strings.TrimSpace(tmpl.Subject) == "" {
+		return errors.New("subject is required")
+	}
+	if strings.TrimSpace(tmpl.Body) == "" {
+		return errors.New("body is required")
+	}
+	example := NotificationData{
+		Order: types.Order{OrderID: "1", UserID: "1", OrderTotal: 10, CreatedAt: time.Now()},
+		User:  types.User{UserId: "1", Username: "customer", Email: "customer@example.com"},
+		Shipment: &types.Shipment{
+			Carrier:        types.CarrierUSPS,
+			TrackingNumber: "9400100000000000000000",
+			ShippedAt:      time.Now(),
+		},
+	}
+	_, _, err := renderNotification(tmpl, example)
+	return err
+}
+
+type NotificationHandlers struct {
+	db store.DataStore
+}
+
+func NewNotificationHandlers(db store.DataStore) *NotificationHandlers {
+	return &NotificationHandlers{db: db}
+}
+
+// GetTemplates gets the current template for every event, including defaults
+func (n *NotificationHandlers) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	templates := make([]types.NotificationTemplate, 0, len(notificationEvents))
+	for _, event := range notificationEvents {
+		tmpl, err := getNotificationTemplate(n.db, event)
+		if err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+			return
+		}
+		templates = append(templates, tmpl)
+	}
+
+	if err := json.NewEncoder(w).Encode(templates); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// GetTemplate gets the current template for an event
+func (n *NotificationHandlers) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	event, ok := notificationEventParam(r)
+	if !ok {
+		writeHttpError(r.Context(), w, fmt.Errorf("unknown event %s", event), http.StatusNotFound)
+		return
+	}
+	tmpl, err := getNotificationTemplate(n.db, event)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(tmpl); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// PutTemplate replaces the template for an event. The template is rendered with example data
+// before it is saved so broken templates are caught here rather than when sending
+func (n *NotificationHandlers) PutTemplate(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	event, ok := notificationEventParam(r)
+	if !ok {
+		writeHttpError(r.Context(), w, fmt.Errorf("unknown event %s", event), http.StatusNotFound)
+		return
+	}
+	var tmpl types.NotificationTemplate
+	if err := json.NewDecoder(r.Body).Decode(&tmpl); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding template: %v", err), http.StatusBadRequest)
+		return
+	}
+	tmpl.Event = event
+	if err := validateNotificationTemplate(tmpl); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid template: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := storeOne(n.db, fmt.Sprintf("notification_templates:%s", event), tmpl); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error storing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(tmpl); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// DeleteTemplate resets the template for an event back to the default
+func (n *NotificationHandlers) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	event, ok := notificationEventParam(r)
+	if !ok {
+		writeHttpError(r.Context(), w, fmt.Errorf("unknown event %s", event), http.StatusNotFound)
+		return
+	}
+	if err := n.db.Delete(fmt.Sprintf("notification_templates:%s", event)); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("error deleting template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notificationEventParam returns the event from the URL and whether it is a known event
+func notificationEventParam(r *http.Request) (types.NotificationEvent, bool) {
+	event := types.NotificationEvent(chi.URLParam(r, "event"))
+	_, ok := defaultTemplates[event]
+	return event, ok
+}
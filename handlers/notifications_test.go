@@ -0,0 +1,106 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/notify"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+type fakeSender struct {
+	messages chan notify.Message
+}
+
+func (f *fakeSender) Send(ctx context.Context, msg notify.Message) error {
+	f.messages <- msg
+	return nil
+}
+
+func (f *fakeSender) next(t *testing.T) notify.Message {
+	select {
+	case msg := <-f.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification was sent")
+		return notify.Message{}
+	}
+}
+
+func TestShippedNotification(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(types.User{UserId: "u1", Username: "sam", Email: "sam@example.com"}))
+	require.NoError(t, db.Set("users:u1", buf.Bytes()))
+	putOrders(t, db, types.Order{OrderID: "1", UserID: "u1", IsPaid: true})
+
+	sender := &fakeSender{messages: make(chan notify.Message, 1)}
+	notifier := handlers.NewNotifier(db, sender, zerolog.Nop())
+	orderHandlers := handlers.NewOrderHandlers(db, nil, nil, &fakePayment{}, notifier, nil)
+	notificationHandlers := handlers.NewNotificationHandlers(db)
+
+	r := chi.NewRouter()
+	r.Post("/orders/{userId}/{id}/shipments", orderHandlers.AddShipment)
+	r.Post("/orders/{userId}/{id}/delivered", orderHandlers.MarkDelivered)
+	r.Put("/notifications/templates/{event}", notificationHandlers.PutTemplate)
+	r.Delete("/notifications/templates/{event}", notificationHandlers.DeleteTemplate)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/orders/u1/1/shipments", strings.NewReader(`{"trackingNumber":"1Z999AA10123456784"}`)))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	msg := sender.next(t)
+	require.Equal(t, "sam@example.com", msg.To)
+	require.Equal(t, "Your order 1 has shipped", msg.Subject)
+	require.Contains(t, msg.Body, "https://www.ups.com/track?tracknum=1Z999AA10123456784")
+
+	// Templates that can't be rendered are rejected when they are saved
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/notifications/templates/order.delivered", strings.NewReader(`{"subject":"{{.Order.Missing}}","body":"hi"}`)))
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/notifications/templates/order.unknown", strings.NewReader(`{"subject":"hi","body":"hi"}`)))
+	require.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/notifications/templates/order.delivered", strings.NewReader(`{"subject":"Delivered: {{.Order.OrderID}}","body":"Enjoy, {{.User.Username}}"}`)))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var tmpl types.NotificationTemplate
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&tmpl))
+	require.Equal(t, types.NotificationOrderDelivered, tmpl.Event)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/orders/u1/1/delivered", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	msg = sender.next(t)
+	require.Equal(t, "Delivered: 1", msg.Subject)
+	require.Equal(t, "Enjoy, sam", msg.Body)
+	require.True(t, getOrder(t, db, "1").IsDelivered)
+
+	// Marking it delivered again shouldn't send another email
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/orders/u1/1/delivered", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	select {
+	case msg := <-sender.messages:
+		t.Fatalf("unexpected notification %q", msg.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
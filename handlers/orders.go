@@ -2,13 +2,15 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
 	"net/http"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
@@ -17,14 +19,61 @@ import (
 	"github.com/thomastaylor312/printing-api/types"
 )
 
+// orderLock serializes changes to orders. Orders are changed by customers, admins and background
+// jobs, and a change stored from a stale copy would undo the others
+var orderLock sync.Mutex
+
+// changeOrder reads the order and applies the change to it under orderLock, storing it if the change
+// returns true. It returns the order as it is stored and whether it was changed
+func changeOrder(db store.DataStore, orderID string, change func(order *types.Order) bool) (*types.Order, bool, error) {
+	orderLock.Lock()
+	defer orderLock.Unlock()
+	key := fmt.Sprintf("orders:%s", orderID)
+	order, err := fetchOne[types.Order](db, key)
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting order: %w", err)
+	}
+	if !change(order) {
+		return order, false, nil
+	}
+	if err := storeOne(db, key, order); err != nil {
+		return nil, false, fmt.Errorf("error updating order: %v", err)
+	}
+	return order, true, nil
+}
+
+// markOrderPaid marks the order as paid and sets the shipping address if it doesn't have one yet.
+// It returns the order and whether this call is the one that marked it as paid, which is the only
+// caller that should create its production jobs and say it was paid
+func markOrderPaid(db store.DataStore, orderID string, address *types.Address) (*types.Order, bool, error) {
+	markedPaid := false
+	order, _, err := changeOrder(db, orderID, func(order *types.Order) bool {
+		changed := false
+		if !order.IsPaid {
+			order.IsPaid = true
+			markedPaid = true
+			changed = true
+		}
+		if order.ShippingDetails.Address == nil && address != nil {
+			order.ShippingDetails.Address = address
+			changed = true
+		}
+		return changed
+	})
+	return order, markedPaid, err
+}
+
 type OrderHandlers struct {
-	db      store.DataStore
-	conf    atomic.Value
-	payment payment.Payment
+	db       store.DataStore
+	storage  store.ImageStore
+	conf     *atomic.Value
+	payment  payment.Payment
+	notifier *Notifier
+	webhooks *WebhookDispatcher
 }
 
-func NewOrderHandlers(db store.DataStore, conf atomic.Value, payment payment.Payment) *OrderHandlers {
-	return &OrderHandlers{db: db, conf: conf, payment: payment}
+func NewOrderHandlers(db store.DataStore, storage store.ImageStore, conf *atomic.Value, payment payment.Payment, notifier *Notifier, webhooks *WebhookDispatcher) *OrderHandlers {
+	return &OrderHandlers{db: db, storage: storage, conf: conf, payment: payment, notifier: notifier, webhooks: webhooks}
 }
 
 // GetOrders gets all orders from the database
@@ -100,6 +149,25 @@ func (o *OrderHandlers) GetOrderForUser(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// PrintPriceChange is a print in the cart whose cost changed since it was added
+type PrintPriceChange struct {
+	Index   int     `json:"index"`
+	OldCost float64 `json:"oldCost"`
+	NewCost float64 `json:"newCost"`
+}
+
+// PriceChangedResponse is returned with a 409 when placing an order and the prices of the prints in
+// the cart have changed. The totals are for the prints only and don't include shipping. The cart is
+// updated with the new prices, so placing the order again accepts them
+type PriceChangedResponse struct {
+	Error    string             `json:"error"`
+	OldTotal float64            `json:"oldTotal"`
+	NewTotal float64            `json:"newTotal"`
+	Changes  []PrintPriceChange `json:"changes"`
+}
+
+// AddOrder creates an order from the user's cart. Prices are recalculated and if any have changed
+// a 409 with a PriceChangedResponse is returned instead of creating the order
 func (o *OrderHandlers) AddOrder(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "userId")
 	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
@@ -108,6 +176,7 @@ func (o *OrderHandlers) AddOrder(w http.ResponseWriter, r *http.Request) {
 	cart, err := fetchOne[types.Cart](o.db, fmt.Sprintf("carts:%s", userID))
 	if errors.Is(err, store.ErrKeyNotFound) || (cart != nil && len(cart.Prints) == 0) {
 		writeHttpError(r.Context(), w, fmt.Errorf("cart is empty, unable to place order"), http.StatusBadRequest)
+		return
 	} else if err != nil {
 		writeHttpError(r.Context(), w, fmt.Errorf("error getting cart: %v", err), http.StatusInternalServerError)
 		return
@@ -119,30 +188,102 @@ func (o *OrderHandlers) AddOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conf := o.conf.Load().(*types.Config)
-	shippingDetails, err = normalizeShippingDetails(shippingDetails, *conf)
+	conf := loadConfig(o.conf)
+
+	// Re-price every print against the current config and papers as they could have changed since
+	// the print was added to the cart
+	repriced := make([]types.Print, len(cart.Prints))
+	prints := make([]types.Print, len(cart.Prints))
+	changes := []PrintPriceChange{}
+	var oldSubtotal, subtotal float64
+	for i, print := range cart.Prints {
+		oldCost := print.Cost
+		oldSubtotal += print.TotalCost()
+		paper, err := normalizePrint(o.db, conf, &print)
+		if err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("print %d in cart is not valid: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if roundCents(oldCost) != roundCents(print.Cost) {
+			changes = append(changes, PrintPriceChange{Index: i, OldCost: roundCents(oldCost), NewCost: roundCents(print.Cost)})
+		}
+		repriced[i] = print
+		print.Paper = paper
+		// The order keeps the upload it was placed with, even if the picture is uploaded again or
+		// deleted
+		picture, err := fetchOne[types.Picture](o.db, fmt.Sprintf("pictures:%s", print.PictureID))
+		if errors.Is(err, store.ErrKeyNotFound) {
+			writeHttpError(r.Context(), w, fmt.Errorf("print %d in cart uses a picture that does not exist", i), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("error getting picture: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// Deleted pictures are only kept for the orders that already use them
+		if picture.UserID != userID || picture.DeletedAt != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("print %d in cart uses a picture that does not exist", i), http.StatusBadRequest)
+			return
+		}
+		if picture.UploadedAt == nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("print %d in cart uses a picture that has not been uploaded", i), http.StatusBadRequest)
+			return
+		}
+		print.PictureHash = picture.Hash
+		prints[i] = print
+		subtotal += print.TotalCost()
+	}
+	subtotal = roundCents(subtotal)
+
+	if len(changes) > 0 {
+		logger.Info().Int("changed", len(changes)).Msg("Cart prices changed since prints were added, updating cart")
+		// Save the new prices so the client can confirm them by placing the order again
+		cart.Prints = repriced
+		if err := storeOne(o.db, fmt.Sprintf("carts:%s", userID), cart); err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("error updating cart prices: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		if err := json.NewEncoder(w).Encode(PriceChangedResponse{
+			Error:    "prices have changed since prints were added to the cart",
+			OldTotal: roundCents(oldSubtotal),
+			NewTotal: subtotal,
+			Changes:  changes,
+		}); err != nil {
+			logger.Error().Err(err).Msg("Error writing response")
+		}
+		return
+	}
+
+	shippingDetails, err = normalizeShippingDetails(shippingDetails, conf, prints)
 	if err != nil {
 		writeHttpError(r.Context(), w, fmt.Errorf("shipping details are not valid: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	var subtotal float64
-	// Print prices were set and validated when they were added to the cart
-	for _, print := range cart.Prints {
-		subtotal += print.Cost
+	// Generate the ID up front so the payment provider can reference our order
+	id, err := o.db.GenerateId()
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error creating order: %v", err), http.StatusInternalServerError)
+		return
 	}
-	// Round the float to 2 decimal places
-	subtotal = math.Round(subtotal*100) / 100
 
 	order := &types.Order{
+		OrderID:         id,
 		UserID:          userID,
-		Prints:          cart.Prints,
+		Prints:          prints,
 		ShippingDetails: shippingDetails,
 		PrintsSubtotal:  subtotal,
-		OrderTotal:      subtotal + shippingDetails.ShippingProfile.Cost,
+		OrderTotal:      roundCents(subtotal + shippingDetails.Cost),
+		CreatedAt:       time.Now().UTC(),
+	}
+
+	if code, err := validateOrderFunc(userID)(order); err != nil {
+		writeHttpError(r.Context(), w, err, code)
+		return
 	}
 
 	// Create the order in the payment provider
-	externalOrderID, checkoutURL, err := o.payment.CreateOrder(*order)
+	externalOrderID, checkoutURL, err := o.payment.CreateOrder(r.Context(), *order)
 	if err != nil {
 		writeHttpError(r.Context(), w, fmt.Errorf("error creating order: %v", err), http.StatusInternalServerError)
 		return
@@ -151,7 +292,11 @@ func (o *OrderHandlers) AddOrder(w http.ResponseWriter, r *http.Request) {
 	order.ExternalOrderID = externalOrderID
 	order.PaymentLink = checkoutURL
 
-	order, err = addOne[*types.Order](o.db, "orders", order, validateOrderFunc(userID), func(order *types.Order) error {
+	order, err = insertOne[*types.Order](o.db, "orders", order, func(order *types.Order) error {
+		if err := referenceOrderPictures(o.db, order); err != nil {
+			return fmt.Errorf("error referencing pictures: %v", err)
+		}
+
 		// Add the order to the user's list of orders
 		userOrdersKey := fmt.Sprintf("orders:%s", order.UserID)
 		keys, err := getKeys(o.db, userOrdersKey)
@@ -185,6 +330,11 @@ func (o *OrderHandlers) AddOrder(w http.ResponseWriter, r *http.Request) {
 		writeHttpError(r.Context(), w, fmt.Errorf("error adding order to database: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if err := markPicturesUsed(o.db, order.CreatedAt, printPictureIDs(order.Prints)...); err != nil {
+		logger.Warn().Err(err).Msg("Error marking pictures as used")
+	}
+	o.notifier.Notify(types.NotificationOrderCreated, *order, nil)
+	o.webhooks.Publish(types.WebhookOrderCreated, order)
 
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(order); err != nil {
@@ -192,16 +342,58 @@ func (o *OrderHandlers) AddOrder(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// UpdateOrder replaces an order with the given one. The payment, shipping and retention state is
+// managed by its own endpoints and background jobs, so it is kept from the stored order
 func (o *OrderHandlers) UpdateOrder(w http.ResponseWriter, r *http.Request) {
-	update[*types.Order](o.db, "orders", w, r, nil, nil)
+	logger := httplog.LogEntry(r.Context())
+	id := chi.URLParam(r, "id")
+
+	var updated types.Order
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding: %v", err), http.StatusBadRequest)
+		return
+	}
+	if updated.ID() != id {
+		writeHttpError(r.Context(), w, errors.New("given item does not have an ID that matches"), http.StatusBadRequest)
+		return
+	}
+
+	order, _, err := changeOrder(o.db, id, func(order *types.Order) bool {
+		updated.CreatedAt = order.CreatedAt
+		updated.IsPaid = order.IsPaid
+		updated.IsExpired = order.IsExpired
+		updated.ReadyToShip = order.ReadyToShip
+		updated.HasShipped = order.HasShipped
+		updated.IsDelivered = order.IsDelivered
+		updated.DeliveredAt = order.DeliveredAt
+		updated.ShippingDetails.TrackingNumber = order.ShippingDetails.TrackingNumber
+		updated.ShippingDetails.Shipments = order.ShippingDetails.Shipments
+		updated.PicturesReleased = order.PicturesReleased
+		*order = updated
+		return true
+	})
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("order not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		logger.Error().Err(err).Msg("Error writing order response")
+	}
 }
 
 // ConfirmOrderPayed is a user-facing endpoint that is called when the user has payed for their
-// order. This should validate that the order was payed and update it accordingly.
+// order. This validates that the order was payed with the payment provider, marks it as paid and
+// pulls the shipping address from the payment provider if the customer entered it there
 func (o *OrderHandlers) ConfirmOrderPayed(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
 	orderId := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("orderID", orderId).Logger()
 	order, err := fetchOne[types.Order](o.db, fmt.Sprintf("orders:%s", orderId))
-	if errors.Is(err, store.ErrKeyNotFound) {
+	if errors.Is(err, store.ErrKeyNotFound) || (order != nil && order.UserID != userID) {
 		writeHttpError(r.Context(), w, fmt.Errorf("order not found"), http.StatusNotFound)
 		return
 	} else if err != nil {
@@ -209,7 +401,7 @@ func (o *OrderHandlers) ConfirmOrderPayed(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	paid, err := o.payment.ValidateOrderPaid(order.ExternalOrderID)
+	paid, err := o.payment.ValidateOrderPaid(r.Context(), order.ExternalOrderID)
 	if err != nil {
 		writeHttpError(r.Context(), w, fmt.Errorf("error validating order payment: %v", err), http.StatusInternalServerError)
 		return
@@ -218,13 +410,48 @@ func (o *OrderHandlers) ConfirmOrderPayed(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	update[*types.Order](o.db, "orders", w, r, nil, nil)
+	// Not having the address yet shouldn't stop the order from being marked as paid, the reconciler
+	// will try again later
+	if _, err := fillShippingAddress(r.Context(), o.payment, order); err != nil {
+		logger.Warn().Err(err).Msg("Error getting shipping address from payment provider")
+	}
+
+	order, markedPaid, err := markOrderPaid(o.db, orderId, order.ShippingDetails.Address)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	// Customers can confirm the same order more than once and the reconciler can find the payment at
+	// the same time, so only whoever marked it as paid notifies
+	if markedPaid {
+		if _, err := createProductionJobs(o.db, order); err != nil {
+			logger.Error().Err(err).Msg("Error creating production jobs for order")
+		}
+		o.notifier.Notify(types.NotificationOrderPaid, *order, nil)
+		o.webhooks.Publish(types.WebhookOrderPaid, order)
+	}
+
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
 }
 
 func (o *OrderHandlers) DeleteOrder(w http.ResponseWriter, r *http.Request) {
 	userId := chi.URLParam(r, "userId")
 	orderId := chi.URLParam(r, "id")
+	order, err := fetchOne[types.Order](o.db, fmt.Sprintf("orders:%s", orderId))
+	if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting order: %v", err), http.StatusInternalServerError)
+		return
+	}
 	delete[*types.Order](o.db, "orders", w, r, func() error {
+		// The pictures are deleted if this order was the last thing using them
+		if order != nil {
+			if err := releaseOrderPictures(o.db, o.storage, order); err != nil {
+				return fmt.Errorf("error releasing pictures: %v", err)
+			}
+		}
+
 		// Add the order to the user's list of orders
 		userOrdersKey := fmt.Sprintf("orders:%s", userId)
 		keys, err := getKeys(o.db, userOrdersKey)
@@ -263,22 +490,68 @@ func validateOrderFunc(currentUserID string) ValidationFunc[*types.Order] {
 	}
 }
 
-func normalizeShippingDetails(details types.ShippingDetails, conf types.Config) (types.ShippingDetails, error) {
-	if details.TrackingNumber != nil {
+// normalizeShippingDetails validates the shipping details and sets the shipping profile and cost
+// from the config and the prints being shipped
+func normalizeShippingDetails(details types.ShippingDetails, conf types.Config, prints []types.Print) (types.ShippingDetails, error) {
+	if details.TrackingNumber != nil || len(details.Shipments) > 0 {
 		return types.ShippingDetails{}, fmt.Errorf("tracking number cannot be set when creating an order")
 	}
+	if details.Address != nil {
+		address, err := normalizeAddress(*details.Address)
+		if err != nil {
+			return types.ShippingDetails{}, fmt.Errorf("invalid address: %v", err)
+		}
+		details.Address = &address
+	} else if len(conf.ShippingZones) > 0 {
+		// Without an address we can't tell which zone the order is shipping to
+		return types.ShippingDetails{}, fmt.Errorf("an address is required to calculate shipping")
+	}
+
+	zone := types.ShippingZone{ShippingProfiles: conf.Costs.ShippingProfiles}
+	if details.Address != nil {
+		var err error
+		zone, err = zoneForDestination(conf, details.Address.Country, details.Address.State, details.Address.PostalCode)
+		if err != nil {
+			return types.ShippingDetails{}, err
+		}
+	}
+
 	shippingMethod := details.ShippingProfile.ShippingMethod
 	var shippingProfile *types.ShippingProfile
-	for _, profile := range conf.Costs.ShippingProfiles {
+	for _, profile := range zone.ShippingProfiles {
 		if shippingMethod == profile.ShippingMethod {
 			shippingProfile = &profile
 			break
 		}
 	}
-	if shippingProfile == nil {
+	if shippingProfile == nil && zone.Name != "" {
+		return types.ShippingDetails{}, fmt.Errorf("shipping method %s is not available in %s", shippingMethod, zone.Name)
+	} else if shippingProfile == nil {
 		return types.ShippingDetails{}, fmt.Errorf("invalid shipping method: %s", shippingMethod)
 	}
 	details.ShippingProfile = *shippingProfile
+	details.Zone = zone.Name
+
+	quote := quoteShipping(*shippingProfile, prints)
+	if !quote.Available {
+		return types.ShippingDetails{}, fmt.Errorf("shipping method %s is not available: %s", shippingMethod, quote.Reason)
+	}
+	details.Cost = quote.Cost
+	details.CostBreakdown = quote.Breakdown
 
 	return details, nil
 }
+
+// fillShippingAddress sets the shipping address on the order from the payment provider if the
+// order doesn't have one yet. Returns whether the order was changed
+func fillShippingAddress(ctx context.Context, paymentClient payment.Payment, order *types.Order) (bool, error) {
+	if order.ShippingDetails.Address != nil {
+		return false, nil
+	}
+	address, err := paymentClient.GetShippingAddress(ctx, order.ExternalOrderID)
+	if err != nil || address == nil {
+		return false, err
+	}
+	order.ShippingDetails.Address = address
+	return true, nil
+}
@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
 	"github.com/thomastaylor312/printing-api/store"
 	"github.com/thomastaylor312/printing-api/types"
 )
@@ -15,8 +20,34 @@ func NewPaperHandlers(db store.DataStore) *PaperHandlers {
 	return &PaperHandlers{db: db}
 }
 
-// GetPapers gets all papers from the database
+// GetPapers gets all papers that are currently available from the database
 func (p *PaperHandlers) GetPapers(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	keys, err := getKeys(p.db, "papers")
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting papers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	papers, err := fetchByKeys[types.PaperType](p.db, keys)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting papers: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	available := make([]types.PaperType, 0, len(papers))
+	for _, paper := range papers {
+		if !paper.Archived {
+			available = append(available, paper)
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(available); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// GetAllPapers gets all papers from the database, including archived papers
+func (p *PaperHandlers) GetAllPapers(w http.ResponseWriter, r *http.Request) {
 	get[*types.PaperType](p.db, "papers", w, r)
 }
 
@@ -30,7 +61,63 @@ func (p *PaperHandlers) UpdatePaper(w http.ResponseWriter, r *http.Request) {
 	update[*types.PaperType](p.db, "papers", w, r, nil, nil)
 }
 
-// DeletePaper deletes a paper from the database
+// DeletePaper deletes a paper from the database. If any open orders still reference the paper, it
+// is archived instead so it can't be used for new prints but the orders can still be fulfilled
 func (p *PaperHandlers) DeletePaper(w http.ResponseWriter, r *http.Request) {
-	delete[*types.PaperType](p.db, "papers", w, r, nil)
+	logger := httplog.LogEntry(r.Context())
+	paperID := chi.URLParam(r, "id")
+	paperKey := fmt.Sprintf("papers:%s", paperID)
+
+	referenced, err := p.referencedByOpenOrder(paperID)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error checking orders for paper: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !referenced {
+		delete[*types.PaperType](p.db, "papers", w, r, nil)
+		return
+	}
+
+	paper, err := fetchOne[types.PaperType](p.db, paperKey)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("paper not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting paper: %v", err), http.StatusInternalServerError)
+		return
+	}
+	paper.Archived = true
+	if err := storeOne(p.db, paperKey, paper); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error archiving paper: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info().Str("paperID", paperID).Msg("Paper is referenced by open orders, archived instead of deleting")
+	if err := json.NewEncoder(w).Encode(paper); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// referencedByOpenOrder returns whether any order that hasn't been delivered or expired has a
+// print on the given paper
+func (p *PaperHandlers) referencedByOpenOrder(paperID string) (bool, error) {
+	keys, err := getKeys(p.db, "orders")
+	if err != nil {
+		return false, err
+	}
+	orders, err := fetchByKeys[types.Order](p.db, keys)
+	if err != nil {
+		return false, err
+	}
+	for _, order := range orders {
+		if order.IsDelivered || order.IsExpired {
+			continue
+		}
+		for _, print := range order.Prints {
+			if print.PaperTypeID == paperID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
 }
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	maxTags      = 50
+	maxTagLength = 64
+)
+
+// normalizeTag trims and lower cases a tag so tags match no matter how they were typed
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// normalizeTags normalizes the tags, dropping empty and duplicate tags, and checks there aren't too
+// many of them
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("pictures can have at most %d tags", maxTags)
+	}
+	return normalized, nil
+}
+
+// PutPictureTags replaces the tags on a picture. The body is a list of tags
+func (p *PictureHandlers) PutPictureTags(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	pictureID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("pictureID", pictureID).Logger()
+	var tags []string
+	if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding tags: %v", err), http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusBadRequest)
+		return
+	}
+
+	picture, err := p.getPicture(pictureID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	picture.Tags = tags
+	if err := storeOne(p.db, fmt.Sprintf("pictures:%s", pictureID), picture); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating picture: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(picture); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// pictureFilter narrows down a user's pictures. Empty fields don't filter anything
+type pictureFilter struct {
+	albumID string
+	// Pictures must have all of the tags
+	tags []string
+	// Pictures must have a name containing this, ignoring case
+	name string
+	// Pictures must have been uploaded at or after uploadedAfter and before uploadedBefore. Pictures
+	// that haven't been uploaded don't match either of them
+	uploadedAfter  *time.Time
+	uploadedBefore *time.Time
+}
+
+// parsePictureFilter reads a filter from the album, tag, name, uploadedAfter and uploadedBefore
+// query parameters. tag can be given more than once and the upload times are RFC 3339 times or
+// dates
+func parsePictureFilter(query url.Values) (pictureFilter, error) {
+	filter := pictureFilter{
+		albumID: query.Get("album"),
+		name:    strings.ToLower(strings.TrimSpace(query.Get("name"))),
+	}
+	for _, tag := range query["tag"] {
+		if tag = normalizeTag(tag); tag != "" {
+			filter.tags = append(filter.tags, tag)
+		}
+	}
+	for param, field := range map[string]**time.Time{
+		"uploadedAfter":  &filter.uploadedAfter,
+		"uploadedBefore": &filter.uploadedBefore,
+	} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			if parsed, err = time.Parse(time.DateOnly, raw); err != nil {
+				return pictureFilter{}, fmt.Errorf("%s must be an RFC 3339 time or a date like 2006-01-02", param)
+			}
+		}
+		*field = &parsed
+	}
+	return filter, nil
+}
+
+func (f pictureFilter) matches(picture types.Picture) bool {
+	if picture.DeletedAt != nil {
+		return false
+	}
+	if f.name != "" && !strings.Contains(strings.ToLower(picture.Name), f.name) {
+		return false
+	}
+	for _, tag := range f.tags {
+		found := false
+		for _, pictureTag := range picture.Tags {
+			if normalizeTag(pictureTag) == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.uploadedAfter != nil && (picture.UploadedAt == nil || picture.UploadedAt.Before(*f.uploadedAfter)) {
+		return false
+	}
+	if f.uploadedBefore != nil && (picture.UploadedAt == nil || !picture.UploadedAt.Before(*f.uploadedBefore)) {
+		return false
+	}
+	return true
+}
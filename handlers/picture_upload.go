@@ -7,20 +7,26 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/imagemeta"
 	"github.com/thomastaylor312/printing-api/store"
 	"github.com/thomastaylor312/printing-api/types"
 )
 
 type PictureHandlers struct {
-	db      store.DataStore
-	storage store.ImageStore
+	db          store.DataStore
+	storage     store.ImageStore
+	conf        *atomic.Value
+	webhooks    *WebhookDispatcher
+	derivatives *DerivativeGenerator
 }
 
-func NewPictureHandlers(db store.DataStore, storage store.ImageStore) *PictureHandlers {
-	return &PictureHandlers{db: db, storage: storage}
+func NewPictureHandlers(db store.DataStore, storage store.ImageStore, conf *atomic.Value, webhooks *WebhookDispatcher, derivatives *DerivativeGenerator) *PictureHandlers {
+	return &PictureHandlers{db: db, storage: storage, conf: conf, webhooks: webhooks, derivatives: derivatives}
 }
 
 // GetPictures gets all pictures from the database
@@ -28,29 +34,57 @@ func (p *PictureHandlers) GetPictures(w http.ResponseWriter, r *http.Request) {
 	get[*types.Picture](p.db, "pictures", w, r)
 }
 
-// GetPicturesByUser gets all pictures from the database for a specific user
+// GetPicturesByUser gets all pictures from the database for a specific user. The pictures can be
+// filtered by album, tag, name and upload time with query parameters, and pictures in an album are
+// returned in the album's order
 func (p *PictureHandlers) GetPicturesByUser(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "userId")
 	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
-	data, err := p.db.Get("pictures:" + userID)
+	filter, err := parsePictureFilter(r.URL.Query())
 	if err != nil {
-		writeHttpError(r.Context(), w, fmt.Errorf("error getting pictures: %v", err), http.StatusInternalServerError)
+		writeHttpError(r.Context(), w, err, http.StatusBadRequest)
 		return
 	}
-	// Decode data into a list of string keys
+
 	var keys []string
-	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&keys); err != nil {
-		writeHttpError(r.Context(), w, fmt.Errorf("error decoding pictures: %v", err), http.StatusInternalServerError)
+	if filter.albumID != "" {
+		album, err := getAlbum(p.db, filter.albumID, userID, w, r)
+		if err != nil {
+			// Our helper writes the error for us
+			return
+		}
+		for _, pictureID := range album.PictureIDs {
+			keys = append(keys, fmt.Sprintf("pictures:%s", pictureID))
+		}
+	} else if keys, err = getKeys(p.db, "pictures:"+userID); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting pictures: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	pictures, err := fetchByKeys[types.Picture](p.db, keys)
+	all, err := fetchByKeys[types.Picture](p.db, keys)
 	if err != nil {
 		writeHttpError(r.Context(), w, fmt.Errorf("error getting picture: %v", err), http.StatusInternalServerError)
 		return
 	}
+	pictures := make([]types.Picture, 0, len(all))
+	for _, picture := range all {
+		if filter.matches(picture) {
+			pictures = append(pictures, picture)
+		}
+	}
+	// Galleries show the thumbnails, so include them with the list
+	for i := range pictures {
+		if err := loadDerivatives(p.db, p.storage, &pictures[i]); err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+			return
+		}
+		if err := loadLastUsed(p.db, &pictures[i]); err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+			return
+		}
+	}
 
-	if err := json.NewEncoder(w).Encode(json.NewEncoder(w).Encode(pictures)); err != nil {
+	if err := json.NewEncoder(w).Encode(pictures); err != nil {
 		logger.Error().Err(err).Msg("Error encoding response")
 	}
 }
@@ -68,12 +102,21 @@ func (p *PictureHandlers) GetPictureInfo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	// Get the URL for the picture
-	url, err := p.storage.Get(userID, picture.ID())
+	url, err := p.storage.Get(pictureFile(picture))
 	if err != nil {
 		writeHttpError(r.Context(), w, fmt.Errorf("error getting picture URL: %v", err), http.StatusInternalServerError)
 		return
 	}
 	picture.URL = url
+	picture.MaxPrintSize = maxPrintSize(picture.Width, picture.Height, loadConfig(p.conf).PrintQuality)
+	if err := loadDerivatives(p.db, p.storage, &picture); err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := loadLastUsed(p.db, &picture); err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
 	if err := json.NewEncoder(w).Encode(picture); err != nil {
 		logger.Error().Err(err).Msg("Error encoding response")
 	}
@@ -85,6 +128,9 @@ func (p *PictureHandlers) CreatePicture(w http.ResponseWriter, r *http.Request)
 
 	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
 	logger.Debug().Msg("Creating picture")
+	if !p.enforcePictureQuota(w, r, userID) {
+		return
+	}
 	add[*types.Picture](p.db, "pictures", w, r, nil, func(picture *types.Picture) error {
 		// Add the order to the user's list of orders
 		userPicturesKey := fmt.Sprintf("pictures:%s", picture.UserID)
@@ -106,16 +152,22 @@ func (p *PictureHandlers) CreatePicture(w http.ResponseWriter, r *http.Request)
 	})
 }
 
-// UploadPicture uploads a picture to the database
+// UploadPicture uploads a picture to the database. The picture has to be a JPEG, PNG or TIFF that
+// matches the Content-Type header, and its metadata is read and stored with the picture
 func (p *PictureHandlers) UploadPicture(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "userId")
 	pictureID := chi.URLParam(r, "id")
 	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("pictureID", pictureID).Logger()
 	logger.Debug().Msg("Uploading picture")
-	if r.ContentLength == 0 {
+	settings := loadConfig(p.conf).Uploads
+	if r.ContentLength <= 0 {
 		writeHttpError(r.Context(), w, fmt.Errorf("Content-Length of picture must be provided"), http.StatusBadRequest)
 		return
 	}
+	if maxBytes := uploadMaxBytes(settings); r.ContentLength > maxBytes {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture is %d bytes, the maximum is %d bytes", r.ContentLength, maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
 
 	logger.Debug().Msg("Getting picture info")
 	picture, err := p.getPicture(pictureID, userID, w, r)
@@ -123,68 +175,185 @@ func (p *PictureHandlers) UploadPicture(w http.ResponseWriter, r *http.Request)
 		// Our helper writes the error for us
 		return
 	}
-	// TODO: Detect content type and make sure it matches the content type header
-	u, err := p.storage.Set(userID, picture.ID(), uint(r.ContentLength), r.Body)
+	if !p.enforceUploadQuota(w, r, picture, r.ContentLength) {
+		return
+	}
+	// The picture is spooled to a file and validated before any of it is stored. Reading one byte
+	// past the Content-Length catches bodies that are longer than they claim to be
+	upload, err := spoolPicture(r.Body, r.ContentLength+1)
 	if err != nil {
-		writeHttpError(r.Context(), w, fmt.Errorf("error uploading picture: %v", err), http.StatusInternalServerError)
+		writeHttpError(r.Context(), w, fmt.Errorf("error reading picture: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer upload.Close()
+	if upload.size != r.ContentLength {
+		writeHttpError(r.Context(), w, fmt.Errorf("Content-Length is %d bytes but the picture is %d bytes", r.ContentLength, upload.size), http.StatusBadRequest)
+		return
+	}
+	meta, code, err := validatePicture(upload, upload.size, r.Header.Get("Content-Type"), settings)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, code)
 		return
 	}
+	p.storePicture(w, r, picture, upload, meta)
+}
+
+// storePicture stores a validated picture and its metadata and responds with the updated picture.
+// The upload is stored by its hash, so uploading a file that is already stored only adds a reference
+// to it. It returns whether the upload was stored, so callers know when anything they kept to retry
+// with can be removed
+func (p *PictureHandlers) storePicture(w http.ResponseWriter, r *http.Request, picture types.Picture, upload *spooledPicture, meta imagemeta.Metadata) bool {
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", picture.UserID).Str("pictureID", picture.PictureID).Logger()
+	reference := fmt.Sprintf("pictures:%s", picture.ID())
+	hash, err := storeBlob(p.db, p.storage, upload, reference)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error uploading picture: %v", err), http.StatusInternalServerError)
+		return false
+	}
+
+	previous := picture
+	setPictureMetadata(&picture, meta, upload.size)
+	picture.Hash = hash
+	uploadedAt := time.Now().UTC()
+	picture.UploadedAt = &uploadedAt
+	if err := storeOne(p.db, fmt.Sprintf("pictures:%s", picture.ID()), picture); err != nil {
+		if previous.Hash != hash {
+			if err := releaseBlob(p.db, p.storage, hash, reference); err != nil {
+				logger.Warn().Err(err).Msg("Error releasing picture upload")
+			}
+		}
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating picture: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	// The previous upload is only removed once nothing else uses it
+	if previous.Hash != "" && previous.Hash != hash {
+		if err := releaseBlob(p.db, p.storage, previous.Hash, reference); err != nil {
+			logger.Warn().Err(err).Msg("Error releasing previous picture upload")
+		}
+	} else if previous.Hash == "" && previous.UploadedAt != nil {
+		if err := p.storage.Delete(pictureFile(previous)); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+			logger.Warn().Err(err).Msg("Error deleting previous picture upload")
+		}
+	}
+
+	if err := markPicturesUsed(p.db, uploadedAt, picture.PictureID); err != nil {
+		logger.Warn().Err(err).Msg("Error marking picture as used")
+	}
+	picture.LastUsedAt = &uploadedAt
+
+	u, err := p.storage.Get(blobContainer, hash)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting picture URL: %v", err), http.StatusInternalServerError)
+		return true
+	}
 	picture.URL = u
+	picture.MaxPrintSize = maxPrintSize(picture.Width, picture.Height, loadConfig(p.conf).PrintQuality)
+	// The old derivatives are replaced once the new ones are generated
+	if p.derivatives != nil && !p.derivatives.Queue(picture) {
+		logger.Warn().Msg("Derivative queue is full, the picture will be queued by the next sweep")
+	}
+	p.webhooks.Publish(types.WebhookPictureUploaded, picture)
 
 	if err := json.NewEncoder(w).Encode(picture); err != nil {
 		logger.Error().Err(err).Msg("Error encoding response")
 	}
+	return true
 }
 
-// DeletePicture deletes a picture from the database and the bucket
+// DeletePicture deletes a picture from the database and the bucket. Pictures in the user's cart
+// can't be deleted, and pictures that orders still need are hidden from the user and removed once
+// the orders no longer need them
 func (p *PictureHandlers) DeletePicture(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "userId")
 	pictureID := chi.URLParam(r, "id")
 	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("pictureID", pictureID).Logger()
 	logger.Debug().Msg("Deleting picture")
 	// Decode picture data, checking that the user actually owns this picture
-	_, err := p.getPicture(pictureID, userID, w, r)
+	picture, err := p.getPicture(pictureID, userID, w, r)
 	if err != nil {
 		// Our helper writes the error for us
 		return
 	}
 
-	// Delete the picture from the bucket
-	userId := chi.URLParam(r, "userId")
-	orderId := chi.URLParam(r, "id")
-	logger.Debug().Msg("Deleting picture from storage")
-	if err := p.storage.Delete(userId, orderId); err != nil {
-		writeHttpError(r.Context(), w, fmt.Errorf("error deleting picture: %v", err), http.StatusInternalServerError)
+	cart, err := fetchOne[types.Cart](p.db, fmt.Sprintf("carts:%s", userID))
+	if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting cart: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	// TODO: We'll probably want to do this first, so that if it fails we don't delete the picture
-	// Now delete from the database
-	delete[*types.Order](p.db, "pictures", w, r, func() error {
-		// Delete the picture from the list of all user pictures
-		userPicturesKey := fmt.Sprintf("pictures:%s", userId)
-		keys, err := getKeys(p.db, userPicturesKey)
-		if err != nil {
-			return fmt.Errorf("error getting keys: %v", err)
+	if cart != nil {
+		for _, print := range cart.Prints {
+			if print.PictureID == pictureID {
+				writeHttpError(r.Context(), w, fmt.Errorf("picture is in the cart and must be removed from it before it can be deleted"), http.StatusConflict)
+				return
+			}
 		}
+	}
 
-		db_key := fmt.Sprintf("pictures:%s", orderId)
-		for i, key := range keys {
-			if key == db_key {
-				keys = append(keys[:i], keys[i+1:]...)
-				break
-			}
+	keys, err := getKeys(p.db, fmt.Sprintf("orders:%s", userID))
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting orders: %v", err), http.StatusInternalServerError)
+		return
+	}
+	orders, err := fetchByKeys[types.Order](p.db, keys)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting orders: %v", err), http.StatusInternalServerError)
+		return
+	}
+	retention := orderedPictureRetention(loadConfig(p.conf).Retention)
+	if retaining := retainingOrders(orders, pictureID, time.Now().UTC(), retention); len(retaining) > 0 {
+		deletedAt := time.Now().UTC()
+		picture.DeletedAt = &deletedAt
+		if err := storeOne(p.db, fmt.Sprintf("pictures:%s", pictureID), picture); err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("error deleting picture: %v", err), http.StatusInternalServerError)
+			return
 		}
-		rawBuf := new(bytes.Buffer)
-		if err := gob.NewEncoder(rawBuf).Encode(keys); err != nil {
-			return fmt.Errorf("error adding keys: %v", err)
+		if err := removeKey(p.db, fmt.Sprintf("pictures:%s", userID), fmt.Sprintf("pictures:%s", pictureID)); err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("error removing picture from user: %v", err), http.StatusInternalServerError)
+			return
 		}
-		if err := p.db.Set(userPicturesKey, rawBuf.Bytes()); err != nil {
-			return fmt.Errorf("error adding keys: %v", err)
+		if err := removePictureFromAlbums(p.db, userID, pictureID); err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+			return
+		}
+		logger.Info().Strs("orderIDs", retaining).Msg("Picture is used by orders, hiding it until they no longer need it")
+		if err := json.NewEncoder(w).Encode(picture); err != nil {
+			logger.Error().Err(err).Msg("Error encoding response")
 		}
+		return
+	}
 
-		return nil
-	})
+	// Delete from the database first, so that if it fails the picture is still intact
+	derivatives, err := deletePictureRecords(p.db, picture)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	logger.Debug().Msg("Deleting picture from storage")
+	if err := deletePictureFiles(p.db, p.storage, picture, derivatives); err != nil {
+		// The picture is gone as far as anyone can tell, so don't fail the request over stray files
+		logger.Warn().Err(err).Msg("Error deleting picture files")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RegenerateDerivatives queues an uploaded picture to have its derivatives generated again
+func (p *PictureHandlers) RegenerateDerivatives(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	pictureID := chi.URLParam(r, "id")
+	picture, err := p.getPicture(pictureID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	if picture.UploadedAt == nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture has not been uploaded"), http.StatusConflict)
+		return
+	}
+	if !p.derivatives.Queue(picture) {
+		writeHttpError(r.Context(), w, fmt.Errorf("derivatives are not being generated right now, try again later"), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func (p *PictureHandlers) getPicture(pictureID string, userID string, w http.ResponseWriter, r *http.Request) (types.Picture, error) {
@@ -210,5 +379,11 @@ func (p *PictureHandlers) getPicture(pictureID string, userID string, w http.Res
 		writeHttpError(r.Context(), w, formattedErr, http.StatusNotFound)
 		return picture, formattedErr
 	}
+	// Deleted pictures are only kept for the orders that use them
+	if picture.DeletedAt != nil {
+		formattedErr := fmt.Errorf("picture not found")
+		writeHttpError(r.Context(), w, formattedErr, http.StatusNotFound)
+		return picture, formattedErr
+	}
 	return picture, nil
 }
@@ -0,0 +1,84 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func putPicture(t *testing.T, db store.DataStore, picture types.Picture) {
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(picture))
+	require.NoError(t, db.Set("pictures:"+picture.PictureID, buf.Bytes()))
+}
+
+func TestUploadValidation(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{Uploads: types.UploadSettings{MaxBytes: 50_000, MaxPixels: 1_000_000}})
+	putPicture(t, db, types.Picture{PictureID: "10", UserID: "u1", Name: "beach"})
+
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	r := chi.NewRouter()
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	upload := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/pictures/u1/10", bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 64, 48))))
+	pngData := buf.Bytes()
+
+	rr := upload("image/jpeg", pngData)
+	require.Equal(t, http.StatusBadRequest, rr.Code, "PNG sent as a JPEG should fail: %s", rr.Body.String())
+	rr = upload("image/png", pngData[:len(pngData)-20])
+	require.Equal(t, http.StatusBadRequest, rr.Code, "truncated PNG should fail: %s", rr.Body.String())
+	rr = upload("image/png", make([]byte, 60_000))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, rr.Body.String())
+
+	buf = new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 2000, 1000))))
+	rr = upload("image/png", buf.Bytes())
+	require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, "too many pixels should fail: %s", rr.Body.String())
+	_, err = os.Stat(filepath.Join(tmpdir, "storage", "u1", "10"))
+	require.ErrorIs(t, err, os.ErrNotExist, "rejected pictures shouldn't be stored")
+
+	buf = new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 64, 48)), nil))
+	rr = upload("image/jpg; charset=binary", buf.Bytes())
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	data, err := db.Get("pictures:10")
+	require.NoError(t, err)
+	var picture types.Picture
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(data)).Decode(&picture))
+	require.Equal(t, "image/jpeg", picture.ContentType)
+	require.Equal(t, int64(buf.Len()), picture.Size)
+	require.Equal(t, "gray", picture.ColorSpace)
+	require.Equal(t, 1, picture.Orientation)
+	require.Equal(t, 64, picture.Width)
+	require.Nil(t, picture.ICCProfile)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/thomastaylor312/printing-api/imagemeta"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	defaultUploadMaxBytes  = 100 << 20
+	defaultUploadMaxPixels = 200_000_000
+	// Decoding a picture at the pixel limit takes 800MB or more, so only this many uploads and print
+	// files are decoded at once no matter how small their files are
+	maxConcurrentDecodes = 2
+)
+
+// decodeSlots limits how many pictures are decoded at the same time
+var decodeSlots = make(chan struct{}, maxConcurrentDecodes)
+
+// Content types clients commonly send that aren't the registered ones
+var contentTypeAliases = map[string]string{
+	"image/jpg":   imagemeta.ContentTypeJPEG,
+	"image/pjpeg": imagemeta.ContentTypeJPEG,
+	"image/x-png": imagemeta.ContentTypePNG,
+	"image/tif":   imagemeta.ContentTypeTIFF,
+}
+
+func uploadMaxBytes(settings types.UploadSettings) int64 {
+	if settings.MaxBytes == 0 {
+		return defaultUploadMaxBytes
+	}
+	return settings.MaxBytes
+}
+
+func uploadMaxPixels(settings types.UploadSettings) int64 {
+	if settings.MaxPixels == 0 {
+		return defaultUploadMaxPixels
+	}
+	return settings.MaxPixels
+}
+
+// validatePicture checks that the picture is a complete JPEG, PNG or TIFF within the upload limits
+// and returns its metadata. If contentType is set it has to match what the picture actually is. The
+// returned status code is the one to respond with if the picture isn't valid
+func validatePicture(picture io.ReaderAt, size int64, contentType string, settings types.UploadSettings) (imagemeta.Metadata, int, error) {
+	header := make([]byte, 8)
+	if _, err := picture.ReadAt(header, 0); err != nil && !errors.Is(err, io.EOF) {
+		return imagemeta.Metadata{}, http.StatusInternalServerError, fmt.Errorf("error reading picture: %v", err)
+	}
+	sniffed := imagemeta.Sniff(header)
+	if sniffed == "" {
+		return imagemeta.Metadata{}, http.StatusUnsupportedMediaType, fmt.Errorf("picture must be a JPEG, PNG or TIFF")
+	}
+	// Generic binary types are what clients send when they don't know, so only check real types
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return imagemeta.Metadata{}, http.StatusBadRequest, fmt.Errorf("invalid Content-Type: %v", err)
+		}
+		if alias, ok := contentTypeAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		if mediaType != "application/octet-stream" && mediaType != sniffed {
+			return imagemeta.Metadata{}, http.StatusBadRequest, fmt.Errorf("Content-Type is %s but the picture is %s", mediaType, sniffed)
+		}
+	}
+
+	meta, err := imagemeta.ReadAt(picture, size)
+	if err != nil {
+		return imagemeta.Metadata{}, http.StatusBadRequest, err
+	}
+	// Check the size from the header before decoding so a small file can't make us allocate a huge
+	// image
+	if maxPixels := uploadMaxPixels(settings); int64(meta.Width)*int64(meta.Height) > maxPixels {
+		return imagemeta.Metadata{}, http.StatusRequestEntityTooLarge, fmt.Errorf("picture is %dx%d, the most pixels allowed is %d", meta.Width, meta.Height, maxPixels)
+	}
+	// Decoding the whole picture catches files that are truncated or corrupt after the header
+	decodeSlots <- struct{}{}
+	_, _, err = image.Decode(io.NewSectionReader(picture, 0, size))
+	<-decodeSlots
+	if err != nil {
+		return imagemeta.Metadata{}, http.StatusBadRequest, fmt.Errorf("picture is corrupt: %v", err)
+	}
+	return meta, 0, nil
+}
+
+// setPictureMetadata copies the metadata read from an uploaded picture onto it
+func setPictureMetadata(picture *types.Picture, meta imagemeta.Metadata, size int64) {
+	picture.Width = meta.Width
+	picture.Height = meta.Height
+	picture.ContentType = meta.ContentType
+	picture.Size = size
+	picture.ColorSpace = meta.ColorSpace
+	picture.Orientation = meta.Orientation
+	picture.ICCProfile = nil
+	if info, ok := imagemeta.ReadProfileInfo(meta.ICCProfile); ok {
+		picture.ICCProfile = &info
+	}
+}
+
+func validateUploadSettings(settings types.UploadSettings) error {
+	if settings.MaxBytes < 0 || settings.MaxPixels < 0 {
+		return fmt.Errorf("upload limits cannot be negative")
+	}
+	return nil
+}
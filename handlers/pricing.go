@@ -1,13 +1,37 @@
 package handlers
 
-import "sync/atomic"
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/thomastaylor312/printing-api/types"
+)
 
 type PricingHandlers struct {
-	conf atomic.Value
+	conf *atomic.Value
 }
 
-func NewPricingHandlers(conf atomic.Value) *PricingHandlers {
+func NewPricingHandlers(conf *atomic.Value) *PricingHandlers {
 	return &PricingHandlers{conf: conf}
 }
 
 // TODO: Create endpoints that calculate the price of a print job given a width and height and one that can return the current max size
+
+// pricePrint calculates the cost of a single copy of the print on the given paper
+func pricePrint(paper types.PaperType, costs types.SupplyCosts, print types.Print) types.PriceBreakdown {
+	area := print.Width * print.Height
+	paperCost := paper.CostPerSquareInch * area
+	inkCost := costs.InkPerSquareInch * area
+	profit := (paperCost + inkCost) * costs.DesiredProfitMargin
+	return types.PriceBreakdown{
+		PaperCost: paperCost,
+		InkCost:   inkCost,
+		Profit:    profit,
+		UnitPrice: paperCost + inkCost + profit,
+	}
+}
+
+// roundCents rounds the amount to 2 decimal places
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/imagemeta"
+	"github.com/thomastaylor312/printing-api/render"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	defaultPrintDPI = 300
+	// The image store container print-ready files are kept in
+	printFileContainer = "print-files"
+)
+
+// RenderPrintFile renders the print-ready file for a job from the original picture and stores it,
+// replacing any file that was rendered before
+func (p *ProductionHandlers) RenderPrintFile(w http.ResponseWriter, r *http.Request) {
+	job, ok := p.getJob(w, r)
+	if !ok {
+		return
+	}
+	logger := httplog.LogEntry(r.Context()).With().Str("jobID", job.JobID).Str("pictureID", job.Print.PictureID).Logger()
+	settings := loadConfig(p.conf).Rendering
+	dpi := settings.DPI
+	if dpi == 0 {
+		dpi = defaultPrintDPI
+	}
+	format := settings.Format
+	if format == "" {
+		format = types.PrintFileFormatTIFF
+	}
+
+	original, err := openPrintPicture(p.db, p.storage, job.Print)
+	if errors.Is(err, store.ErrImageNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("the picture for this job has not been uploaded"), http.StatusConflict)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error opening picture: %v", err), http.StatusInternalServerError)
+		return
+	}
+	picture, err := spoolPicture(original, math.MaxInt64)
+	original.Close()
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error reading picture: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer picture.Close()
+
+	file, bounds, code, err := renderPrint(picture, job.Print, settings, dpi, format)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, code)
+		return
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error reading print file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	printFile := &types.PrintFile{
+		Container: printFileContainer,
+		FileID:    job.JobID + render.Extension(format),
+		Format:    format,
+		DPI:       dpi,
+		Width:     bounds.Dx(),
+		Height:    bounds.Dy(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := p.storage.Set(printFile.Container, printFile.FileID, uint(info.Size()), io.NopCloser(io.NewSectionReader(file, 0, info.Size()))); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error storing print file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The job could have changed while we were rendering, so get it again before updating it
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	job, ok = p.getJob(w, r)
+	if !ok {
+		return
+	}
+	previous := job.PrintFile
+	job.PrintFile = printFile
+	job.UpdatedAt = printFile.CreatedAt
+	if err := storeOne(p.db, fmt.Sprintf("jobs:%s", job.JobID), job); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating job: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// A change in format leaves the old file behind under a different name
+	if previous != nil && previous.FileID != printFile.FileID {
+		if err := p.storage.Delete(previous.Container, previous.FileID); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+			logger.Warn().Err(err).Msg("Error removing previous print file")
+		}
+	}
+
+	logger.Info().Int("width", printFile.Width).Int("height", printFile.Height).Msg("Rendered print file")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// renderPrint renders the print from the picture and encodes it to a temporary file, returning the
+// file and the size of the render. The decoded picture and the render can each take a gigabyte, so
+// renders share the slots uploads are decoded in
+func renderPrint(picture *spooledPicture, print types.Print, settings types.RenderSettings, dpi uint, format types.PrintFileFormat) (*os.File, image.Rectangle, int, error) {
+	meta, err := imagemeta.ReadAt(picture, picture.size)
+	if err != nil {
+		return nil, image.Rectangle{}, http.StatusUnprocessableEntity, fmt.Errorf("error decoding picture: %v", err)
+	}
+
+	decodeSlots <- struct{}{}
+	defer func() { <-decodeSlots }()
+	decoded, _, err := image.Decode(picture.reader())
+	if err != nil {
+		return nil, image.Rectangle{}, http.StatusUnprocessableEntity, fmt.Errorf("error decoding picture: %v", err)
+	}
+	// Crops are relative to the picture as it is displayed, which is what its size is stored as
+	rendered, err := render.Print(render.Orient(decoded, meta.Orientation), print, dpi)
+	if err != nil {
+		return nil, image.Rectangle{}, http.StatusUnprocessableEntity, fmt.Errorf("unable to render print: %v", err)
+	}
+	// Keep the picture's own color space if it has one that still applies to the RGB render
+	profile := imagemeta.RGBProfile(meta.ICCProfile)
+	if profile == nil {
+		profile = settings.DefaultICCProfile
+	}
+
+	file, err := os.CreateTemp("", "print-file-*")
+	if err != nil {
+		return nil, image.Rectangle{}, http.StatusInternalServerError, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	if err := render.Encode(file, rendered, format, dpi, settings.JPEGQuality, profile); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, image.Rectangle{}, http.StatusInternalServerError, fmt.Errorf("error encoding print file: %v", err)
+	}
+	return file, rendered.Bounds(), 0, nil
+}
+
+// GetPrintFile downloads the print-ready file for a job
+func (p *ProductionHandlers) GetPrintFile(w http.ResponseWriter, r *http.Request) {
+	job, ok := p.getJob(w, r)
+	if !ok {
+		return
+	}
+	logger := httplog.LogEntry(r.Context()).With().Str("jobID", job.JobID).Logger()
+	if job.PrintFile == nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("print file has not been rendered"), http.StatusNotFound)
+		return
+	}
+	file, err := p.storage.Open(job.PrintFile.Container, job.PrintFile.FileID)
+	if errors.Is(err, store.ErrImageNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("print file has not been rendered"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error opening print file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", render.ContentType(job.PrintFile.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("order-%s-print-%d%s", job.OrderID, job.PrintIndex+1, render.Extension(job.PrintFile.Format))))
+	if _, err := io.Copy(w, file); err != nil {
+		logger.Error().Err(err).Msg("Error writing print file")
+	}
+}
+
+func validateRenderSettings(settings types.RenderSettings) error {
+	if settings.DPI != 0 && (settings.DPI < 72 || settings.DPI > 1200) {
+		return fmt.Errorf("DPI must be between 72 and 1200")
+	}
+	if settings.Format != "" && settings.Format != types.PrintFileFormatTIFF && settings.Format != types.PrintFileFormatJPEG {
+		return fmt.Errorf("unsupported format %s", settings.Format)
+	}
+	if settings.JPEGQuality < 0 || settings.JPEGQuality > 100 {
+		return fmt.Errorf("JPEG quality must be between 1 and 100, or 0 for the default")
+	}
+	return nil
+}
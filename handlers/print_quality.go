@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/thomastaylor312/printing-api/render"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	defaultWarnBelowDPI   = 150
+	defaultRejectBelowDPI = 72
+)
+
+// qualityThresholds returns the warning and rejection DPIs from the settings with defaults applied
+func qualityThresholds(settings types.PrintQualitySettings) (float64, float64) {
+	warn, reject := settings.WarnBelowDPI, settings.RejectBelowDPI
+	if warn == 0 {
+		warn = defaultWarnBelowDPI
+	}
+	if reject == 0 {
+		reject = defaultRejectBelowDPI
+	}
+	return warn, reject
+}
+
+// effectiveDPI returns the resolution a picture of the given size will be printed at once it is
+// cropped for the print. If the two axes differ the lower one is returned
+func effectiveDPI(print types.Print, width int, height int) (float64, error) {
+	// The DPI only affects rounding here, so use a typical print resolution
+	layout, err := render.PrintLayout(print, image.Rect(0, 0, width, height), defaultPrintDPI)
+	if err != nil {
+		return 0, err
+	}
+	imageWidth := print.Width - 2*print.BorderSize
+	imageHeight := print.Height - 2*print.BorderSize
+	return math.Min(float64(layout.Crop.Dx())/imageWidth, float64(layout.Crop.Dy())/imageHeight), nil
+}
+
+// checkPrintQuality sets the effective DPI and any warnings on the print, returning an error if the
+// resolution is too low to print. Prints are only checked once their picture has been uploaded
+func checkPrintQuality(db store.DataStore, config types.Config, print *types.Print) error {
+	print.EffectiveDPI = 0
+	print.Warnings = nil
+
+	picture, err := fetchOne[types.Picture](db, fmt.Sprintf("pictures:%s", print.PictureID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting picture: %v", err)
+	}
+	if picture.DeletedAt != nil {
+		return fmt.Errorf("picture %s has been deleted", picture.PictureID)
+	}
+	if picture.Width == 0 || picture.Height == 0 {
+		// Direct uploads can't be used until they have been completed and validated
+		if picture.PendingUpload != nil {
+			return fmt.Errorf("picture %s is still being uploaded", picture.PictureID)
+		}
+		return nil
+	}
+
+	dpi, err := effectiveDPI(*print, picture.Width, picture.Height)
+	if err != nil {
+		return fmt.Errorf("invalid crop: %v", err)
+	}
+	print.EffectiveDPI = math.Round(dpi)
+
+	warn, reject := qualityThresholds(config.PrintQuality)
+	if dpi < reject {
+		return fmt.Errorf("picture is only %.0f DPI at %gx%g, the minimum is %.0f DPI", dpi, print.Width, print.Height, reject)
+	} else if dpi < warn {
+		print.Warnings = append(print.Warnings, fmt.Sprintf("picture is only %.0f DPI at %gx%g and may look blurry, %.0f DPI or more is recommended", dpi, print.Width, print.Height, warn))
+	}
+	return nil
+}
+
+// maxPrintSize returns the largest print that can be made from a picture of the given size without
+// a low resolution warning. The size is rounded down to the nearest tenth of an inch
+func maxPrintSize(width int, height int, settings types.PrintQualitySettings) *types.PrintSize {
+	if width == 0 || height == 0 {
+		return nil
+	}
+	warn, _ := qualityThresholds(settings)
+	return &types.PrintSize{
+		Width:  math.Floor(float64(width)/warn*10) / 10,
+		Height: math.Floor(float64(height)/warn*10) / 10,
+	}
+}
+
+func validatePrintQualitySettings(settings types.PrintQualitySettings) error {
+	if settings.WarnBelowDPI < 0 || settings.RejectBelowDPI < 0 {
+		return errors.New("DPI thresholds cannot be negative")
+	}
+	warn, reject := qualityThresholds(settings)
+	if reject > warn {
+		return errors.New("the rejection DPI cannot be higher than the warning DPI")
+	}
+	return nil
+}
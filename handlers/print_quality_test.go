@@ -0,0 +1,89 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestPrintQuality(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+
+	conf := &atomic.Value{}
+	conf.Store(types.Config{MaxSize: 30, Costs: types.SupplyCosts{InkPerSquareInch: 0.1}})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.25})
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(types.Picture{PictureID: "10", UserID: "u1", Name: "screenshot"}))
+	require.NoError(t, db.Set("pictures:10", buf.Bytes()))
+
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	cartHandlers := handlers.NewCartHandlers(db, conf, nil)
+	r := chi.NewRouter()
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	r.Get("/pictures/{userId}/{id}", pictureHandlers.GetPictureInfo)
+	r.Put("/carts/{userId}", cartHandlers.PutCart)
+
+	// Anything that isn't an image is rejected
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/pictures/u1/10", strings.NewReader("not an image")))
+	require.Equal(t, http.StatusUnsupportedMediaType, rr.Code, rr.Body.String())
+
+	buf = new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 640, 480))))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("PUT", "/pictures/u1/10", bytes.NewReader(buf.Bytes())))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/pictures/u1/10", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var picture types.Picture
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+	require.Equal(t, 640, picture.Width)
+	require.Equal(t, 480, picture.Height)
+	require.Equal(t, &types.PrintSize{Width: 4.2, Height: 3.2}, picture.MaxPrintSize)
+
+	putPrint := func(width float64, height float64) *httptest.ResponseRecorder {
+		body, err := json.Marshal(types.Cart{UserID: "u1", Prints: []types.Print{{PictureID: "10", PaperTypeID: "1", Width: width, Height: height}}})
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("PUT", "/carts/u1", bytes.NewReader(body)))
+		return rr
+	}
+
+	// 640px across 20 inches is 32 DPI
+	rr = putPrint(20, 16)
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	// Cropped to 2:3 the picture is 320x480, which is 80 DPI at 4x6
+	rr = putPrint(4, 6)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var cart types.Cart
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&cart))
+	require.Equal(t, 80.0, cart.Prints[0].EffectiveDPI)
+	require.Len(t, cart.Prints[0].Warnings, 1)
+
+	rr = putPrint(2, 3)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	cart = types.Cart{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&cart))
+	require.Equal(t, 160.0, cart.Prints[0].EffectiveDPI)
+	require.Empty(t, cart.Prints[0].Warnings)
+}
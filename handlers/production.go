@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// jobTransitions are the statuses a job can move to from each status. Failed jobs go back in the
+// queue to be reprinted and jobs can be put back in the queue if printing is abandoned
+var jobTransitions = map[types.JobStatus][]types.JobStatus{
+	types.JobStatusQueued:   {types.JobStatusPrinting},
+	types.JobStatusPrinting: {types.JobStatusPrinted, types.JobStatusQueued},
+	types.JobStatusPrinted:  {types.JobStatusPacked, types.JobStatusQAFailed},
+	types.JobStatusQAFailed: {types.JobStatusQueued},
+	types.JobStatusPacked:   {},
+}
+
+// JobGroup is a set of jobs using the same paper at the same size
+type JobGroup struct {
+	PaperTypeID string                `json:"paperTypeId"`
+	PaperName   string                `json:"paperName"`
+	Width       float64               `json:"width"`
+	Height      float64               `json:"height"`
+	Prints      uint                  `json:"prints"`
+	Jobs        []types.ProductionJob `json:"jobs"`
+}
+
+// JobStatusRequest is the body for changing the status of a job
+type JobStatusRequest struct {
+	Status   types.JobStatus `json:"status"`
+	Operator string          `json:"operator"`
+	Note     string          `json:"note"`
+}
+
+// JobAssignmentRequest is the body for assigning a job. Empty values unassign the job
+type JobAssignmentRequest struct {
+	Printer  string `json:"printer"`
+	Operator string `json:"operator"`
+}
+
+type ProductionHandlers struct {
+	db      store.DataStore
+	storage store.ImageStore
+	conf    *atomic.Value
+	// lock makes sure two jobs for the same order being packed at once can't both miss that the
+	// order is ready to ship
+	lock sync.Mutex
+}
+
+func NewProductionHandlers(db store.DataStore, storage store.ImageStore, conf *atomic.Value) *ProductionHandlers {
+	return &ProductionHandlers{db: db, storage: storage, conf: conf}
+}
+
+// GetQueue gets all jobs that haven't been packed grouped by paper and size. The status query
+// parameter limits the queue to jobs with that status
+func (p *ProductionHandlers) GetQueue(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	status := types.JobStatus(r.URL.Query().Get("status"))
+	if _, ok := jobTransitions[status]; status != "" && !ok {
+		writeHttpError(r.Context(), w, fmt.Errorf("unknown status %s", status), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := getKeys(p.db, "jobs")
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting jobs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	jobs, err := fetchByKeys[types.ProductionJob](p.db, keys)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting jobs: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	filtered := make([]types.ProductionJob, 0, len(jobs))
+	for _, job := range jobs {
+		if (status == "" && job.Status != types.JobStatusPacked) || job.Status == status {
+			filtered = append(filtered, job)
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(groupJobs(filtered)); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// GetJob gets a single production job
+func (p *ProductionHandlers) GetJob(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	job, ok := p.getJob(w, r)
+	if !ok {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// GetOrderJobs gets the production jobs for an order
+func (p *ProductionHandlers) GetOrderJobs(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderId")
+	logger := httplog.LogEntry(r.Context()).With().Str("orderID", orderID).Logger()
+	jobs, err := orderJobs(p.db, orderID)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// CreateOrderJobs creates the production jobs for a paid order. Jobs are normally created when
+// the order is paid, so this is only needed for orders paid before production tracking existed.
+// Nothing is created if the order already has jobs
+func (p *ProductionHandlers) CreateOrderJobs(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "orderId")
+	logger := httplog.LogEntry(r.Context()).With().Str("orderID", orderID).Logger()
+	order, err := fetchOne[types.Order](p.db, fmt.Sprintf("orders:%s", orderID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("order not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting order: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !order.IsPaid {
+		writeHttpError(r.Context(), w, fmt.Errorf("order has not been paid"), http.StatusConflict)
+		return
+	}
+
+	jobs, err := createProductionJobs(p.db, order)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// AssignJob assigns a job to a printer and operator
+func (p *ProductionHandlers) AssignJob(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	var body JobAssignmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("body is not valid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	job, ok := p.getJob(w, r)
+	if !ok {
+		return
+	}
+	if job.Status == types.JobStatusPacked {
+		writeHttpError(r.Context(), w, fmt.Errorf("packed jobs cannot be reassigned"), http.StatusConflict)
+		return
+	}
+	job.Printer = strings.TrimSpace(body.Printer)
+	job.Operator = strings.TrimSpace(body.Operator)
+	job.UpdatedAt = time.Now().UTC()
+	if err := storeOne(p.db, fmt.Sprintf("jobs:%s", job.JobID), job); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating job: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// UpdateJobStatus moves a job to a new status. Once every job for an order is packed the order is
+// marked as ready to ship
+func (p *ProductionHandlers) UpdateJobStatus(w http.ResponseWriter, r *http.Request) {
+	var body JobStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("body is not valid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	job, ok := p.getJob(w, r)
+	if !ok {
+		return
+	}
+	logger := httplog.LogEntry(r.Context()).With().Str("jobID", job.JobID).Str("orderID", job.OrderID).Logger()
+	if !canTransition(job.Status, body.Status) {
+		writeHttpError(r.Context(), w, fmt.Errorf("job cannot move from %s to %s", job.Status, body.Status), http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	job.Status = body.Status
+	job.UpdatedAt = now
+	operator := strings.TrimSpace(body.Operator)
+	if operator == "" {
+		operator = job.Operator
+	}
+	job.History = append(job.History, types.JobStatusChange{Status: body.Status, At: now, Operator: operator, Note: body.Note})
+	if err := storeOne(p.db, fmt.Sprintf("jobs:%s", job.JobID), job); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating job: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if job.Status == types.JobStatusPacked {
+		if err := p.markReadyIfPacked(job.OrderID); err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	logger.Info().Str("status", string(job.Status)).Msg("Updated job status")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// markReadyIfPacked marks the order as ready to ship if all of its jobs have been packed
+func (p *ProductionHandlers) markReadyIfPacked(orderID string) error {
+	jobs, err := orderJobs(p.db, orderID)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Status != types.JobStatusPacked {
+			return nil
+		}
+	}
+
+	_, _, err = changeOrder(p.db, orderID, func(order *types.Order) bool {
+		if order.ReadyToShip {
+			return false
+		}
+		order.ReadyToShip = true
+		return true
+	})
+	return err
+}
+
+// getJob gets the job from the id URL param, writing the error if it can't
+func (p *ProductionHandlers) getJob(w http.ResponseWriter, r *http.Request) (*types.ProductionJob, bool) {
+	job, err := fetchOne[types.ProductionJob](p.db, fmt.Sprintf("jobs:%s", chi.URLParam(r, "id")))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("job not found"), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting job: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	return job, true
+}
+
+func canTransition(from types.JobStatus, to types.JobStatus) bool {
+	for _, status := range jobTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// createJobsLock makes sure that when an order is confirmed and reconciled at the same time, only
+// one of them sees that it has no jobs and creates them
+var createJobsLock sync.Mutex
+
+// createProductionJobs queues a job for every print in the order. Orders that already have jobs
+// are left alone so this is safe to call more than once, including at the same time
+func createProductionJobs(db store.DataStore, order *types.Order) ([]types.ProductionJob, error) {
+	createJobsLock.Lock()
+	defer createJobsLock.Unlock()
+	existing, err := orderJobs(db, order.OrderID)
+	if err != nil {
+		return nil, err
+	} else if len(existing) > 0 {
+		return existing, nil
+	}
+
+	now := time.Now().UTC()
+	jobs := make([]types.ProductionJob, 0, len(order.Prints))
+	jobKeys := make([]string, 0, len(order.Prints))
+	for i, print := range order.Prints {
+		job, err := addOne[*types.ProductionJob](db, "jobs", &types.ProductionJob{
+			OrderID:    order.OrderID,
+			UserID:     order.UserID,
+			PrintIndex: i,
+			Print:      print,
+			Status:     types.JobStatusQueued,
+			History:    []types.JobStatusChange{{Status: types.JobStatusQueued, At: now}},
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating job: %v", err)
+		}
+		jobs = append(jobs, *job)
+		jobKeys = append(jobKeys, fmt.Sprintf("jobs:%s", job.JobID))
+	}
+	if err := storeOne(db, orderJobsKey(order.OrderID), jobKeys); err != nil {
+		return nil, fmt.Errorf("error adding jobs to order: %v", err)
+	}
+	return jobs, nil
+}
+
+func orderJobs(db store.DataStore, orderID string) ([]types.ProductionJob, error) {
+	keys, err := getKeys(db, orderJobsKey(orderID))
+	if err != nil {
+		return nil, fmt.Errorf("error getting jobs: %v", err)
+	}
+	jobs, err := fetchByKeys[types.ProductionJob](db, keys)
+	if err != nil {
+		return nil, fmt.Errorf("error getting jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// orderJobsKey is the key for the list of jobs for an order
+func orderJobsKey(orderID string) string {
+	return fmt.Sprintf("order_jobs:%s", orderID)
+}
+
+// groupJobs groups jobs by paper and size. Groups are sorted by paper and then size and jobs within
+// a group are oldest first
+func groupJobs(jobs []types.ProductionJob) []JobGroup {
+	groups := []JobGroup{}
+	index := map[string]int{}
+	for _, job := range jobs {
+		width, height := job.Print.Width, job.Print.Height
+		// A 10x8 print is run on the same stock as an 8x10
+		if width > height {
+			width, height = height, width
+		}
+		key := fmt.Sprintf("%s:%gx%g", job.Print.PaperTypeID, width, height)
+		i, ok := index[key]
+		if !ok {
+			group := JobGroup{PaperTypeID: job.Print.PaperTypeID, Width: width, Height: height}
+			if job.Print.Paper != nil {
+				group.PaperName = job.Print.Paper.Name
+			}
+			groups = append(groups, group)
+			i = len(groups) - 1
+			index[key] = i
+		}
+		groups[i].Jobs = append(groups[i].Jobs, job)
+		groups[i].Prints += job.Print.Count()
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if a.PaperTypeID != b.PaperTypeID {
+			return a.PaperTypeID < b.PaperTypeID
+		}
+		if a.Width != b.Width {
+			return a.Width < b.Width
+		}
+		return a.Height < b.Height
+	})
+	for _, group := range groups {
+		sort.SliceStable(group.Jobs, func(i, j int) bool {
+			return group.Jobs[i].CreatedAt.Before(group.Jobs[j].CreatedAt)
+		})
+	}
+	return groups
+}
@@ -0,0 +1,137 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestProductionJobs(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	putOrders(t, db,
+		types.Order{OrderID: "o1", UserID: "u1", IsPaid: true, Prints: []types.Print{
+			{Width: 8, Height: 10, PaperTypeID: "p1", Quantity: 2},
+			{Width: 5, Height: 7, PaperTypeID: "p1"},
+		}},
+		types.Order{OrderID: "o2", UserID: "u2", IsPaid: true, Prints: []types.Print{
+			{Width: 10, Height: 8, PaperTypeID: "p1"},
+		}},
+		types.Order{OrderID: "o3", UserID: "u2"},
+	)
+
+	productionHandlers := handlers.NewProductionHandlers(db, nil, nil)
+	r := chi.NewRouter()
+	r.Get("/production/queue", productionHandlers.GetQueue)
+	r.Put("/production/jobs/{id}/status", productionHandlers.UpdateJobStatus)
+	r.Post("/production/orders/{orderId}/jobs", productionHandlers.CreateOrderJobs)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/production/orders/o3/jobs", nil))
+	require.Equal(t, http.StatusConflict, rr.Code, "unpaid orders shouldn't be queued")
+
+	var jobs []types.ProductionJob
+	for _, orderID := range []string{"o1", "o2"} {
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", "/production/orders/"+orderID+"/jobs", nil))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var created []types.ProductionJob
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+		jobs = append(jobs, created...)
+	}
+	require.Len(t, jobs, 3)
+
+	// Creating jobs again shouldn't duplicate them
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/production/orders/o1/jobs", nil))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/production/queue", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var groups []handlers.JobGroup
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&groups))
+	require.Len(t, groups, 2)
+	require.Equal(t, 5.0, groups[0].Width)
+	require.Len(t, groups[0].Jobs, 1)
+	// The 8x10 and 10x8 prints are grouped together
+	require.Equal(t, 8.0, groups[1].Width)
+	require.Equal(t, 10.0, groups[1].Height)
+	require.Len(t, groups[1].Jobs, 2)
+	require.Equal(t, uint(3), groups[1].Prints)
+
+	setStatus := func(jobID string, status types.JobStatus) int {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("PUT", fmt.Sprintf("/production/jobs/%s/status", jobID), strings.NewReader(fmt.Sprintf(`{"status":%q,"operator":"alex"}`, status))))
+		return rr.Code
+	}
+
+	require.Equal(t, http.StatusConflict, setStatus(jobs[0].JobID, types.JobStatusPacked), "queued jobs can't be packed")
+
+	for _, status := range []types.JobStatus{types.JobStatusPrinting, types.JobStatusPrinted, types.JobStatusQAFailed, types.JobStatusQueued, types.JobStatusPrinting, types.JobStatusPrinted, types.JobStatusPacked} {
+		require.Equal(t, http.StatusOK, setStatus(jobs[0].JobID, status), "moving to %s", status)
+	}
+	require.False(t, getOrder(t, db, "o1").ReadyToShip, "order shouldn't be ready until all jobs are packed")
+
+	for _, status := range []types.JobStatus{types.JobStatusPrinting, types.JobStatusPrinted, types.JobStatusPacked} {
+		require.Equal(t, http.StatusOK, setStatus(jobs[1].JobID, status), "moving to %s", status)
+	}
+	require.True(t, getOrder(t, db, "o1").ReadyToShip)
+	require.False(t, getOrder(t, db, "o2").ReadyToShip)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/production/queue", nil))
+	groups = nil
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&groups))
+	require.Len(t, groups, 1, "packed jobs should leave the queue")
+}
+
+func TestProductionJobsCreatedOnce(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	putOrders(t, db, types.Order{OrderID: "o1", UserID: "u1", IsPaid: true, Prints: []types.Print{
+		{Width: 8, Height: 10, PaperTypeID: "p1"},
+		{Width: 5, Height: 7, PaperTypeID: "p1"},
+	}})
+	productionHandlers := handlers.NewProductionHandlers(db, nil, nil)
+	r := chi.NewRouter()
+	r.Get("/production/queue", productionHandlers.GetQueue)
+	r.Post("/production/orders/{orderId}/jobs", productionHandlers.CreateOrderJobs)
+
+	// The order being confirmed and reconciled at the same time shouldn't leave extra jobs behind
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/production/orders/o1/jobs", nil))
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/production/queue", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var groups []handlers.JobGroup
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&groups))
+	jobs := 0
+	for _, group := range groups {
+		jobs += len(group.Jobs)
+	}
+	require.Equal(t, 2, jobs)
+}
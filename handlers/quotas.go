@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// The window the upload rate limit is counted over
+const uploadRateWindow = time.Hour
+
+// uploadRateLock serializes counting uploads so users can't get past the limit by uploading in
+// parallel
+var uploadRateLock sync.Mutex
+
+// uploadRate is the number of uploads a user has started in the current window
+type uploadRate struct {
+	WindowStart time.Time
+	Count       int
+}
+
+func quotaKey(userID string) string {
+	return fmt.Sprintf("quotas:%s", userID)
+}
+
+func uploadRateKey(userID string) string {
+	return fmt.Sprintf("upload_rates:%s", userID)
+}
+
+func validateQuotaSettings(settings types.QuotaSettings) error {
+	if settings.MaxPictures < 0 || settings.MaxBytes < 0 || settings.UploadsPerHour < 0 {
+		return fmt.Errorf("quotas cannot be negative")
+	}
+	return nil
+}
+
+// userQuota returns the user's quota override, or the default quota if they don't have one
+func (p *PictureHandlers) userQuota(userID string) (types.QuotaSettings, error) {
+	quota, err := fetchOne[types.QuotaSettings](p.db, quotaKey(userID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return loadConfig(p.conf).Quotas, nil
+	} else if err != nil {
+		return types.QuotaSettings{}, fmt.Errorf("error getting quota: %v", err)
+	}
+	return *quota, nil
+}
+
+// storageUsage returns the number of pictures the user has and how many bytes they add up to.
+// Deleted pictures that are only kept for orders don't count
+func storageUsage(db store.DataStore, userID string) (int, int64, error) {
+	keys, err := getKeys(db, fmt.Sprintf("pictures:%s", userID))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error getting pictures: %v", err)
+	}
+	pictures, err := fetchByKeys[types.Picture](db, keys)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error getting pictures: %v", err)
+	}
+	var bytes int64
+	for _, picture := range pictures {
+		bytes += picture.Size
+	}
+	return len(pictures), bytes, nil
+}
+
+// currentUploadRate returns the user's uploads in the current window
+func currentUploadRate(db store.DataStore, userID string, now time.Time) (uploadRate, error) {
+	rate, err := fetchOne[uploadRate](db, uploadRateKey(userID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return uploadRate{WindowStart: now}, nil
+	} else if err != nil {
+		return uploadRate{}, fmt.Errorf("error getting upload rate: %v", err)
+	}
+	if now.Sub(rate.WindowStart) >= uploadRateWindow {
+		return uploadRate{WindowStart: now}, nil
+	}
+	return *rate, nil
+}
+
+// enforcePictureQuota checks the user can create another picture. If they can't, it writes the
+// error and returns false
+func (p *PictureHandlers) enforcePictureQuota(w http.ResponseWriter, r *http.Request, userID string) bool {
+	quota, err := p.userQuota(userID)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return false
+	}
+	if quota.MaxPictures == 0 {
+		return true
+	}
+	count, _, err := storageUsage(p.db, userID)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return false
+	}
+	if count >= quota.MaxPictures {
+		writeHttpError(r.Context(), w, fmt.Errorf("you have %d pictures, which is the most you can have. Delete some pictures to add more", count), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// enforceUploadQuota checks that replacing the picture's upload with one of the given size keeps the
+// user within their storage quota, then counts the upload against their upload rate. If either is
+// exceeded, it writes the error and returns false
+func (p *PictureHandlers) enforceUploadQuota(w http.ResponseWriter, r *http.Request, picture types.Picture, size int64) bool {
+	quota, err := p.userQuota(picture.UserID)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return false
+	}
+	if quota.MaxBytes > 0 {
+		_, used, err := storageUsage(p.db, picture.UserID)
+		if err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+			return false
+		}
+		// The picture's current upload is replaced, so it doesn't count
+		if available := quota.MaxBytes - (used - picture.Size); size > available {
+			writeHttpError(r.Context(), w, fmt.Errorf("picture is %d bytes but you only have %d bytes of space left", size, max64(available, 0)), http.StatusRequestEntityTooLarge)
+			return false
+		}
+	}
+	if quota.UploadsPerHour == 0 {
+		return true
+	}
+
+	uploadRateLock.Lock()
+	defer uploadRateLock.Unlock()
+	now := time.Now().UTC()
+	rate, err := currentUploadRate(p.db, picture.UserID, now)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return false
+	}
+	if rate.Count >= quota.UploadsPerHour {
+		retryAfter := rate.WindowStart.Add(uploadRateWindow).Sub(now)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeHttpError(r.Context(), w, fmt.Errorf("you can only upload %d pictures an hour, try again in %s", quota.UploadsPerHour, retryAfter.Round(time.Minute)), http.StatusTooManyRequests)
+		return false
+	}
+	rate.Count++
+	if err := storeOne(p.db, uploadRateKey(picture.UserID), rate); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating upload rate: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// GetUsage returns how much the user has stored and how much of their quota is left
+func (p *PictureHandlers) GetUsage(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	quota, err := p.userQuota(userID)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	count, bytes, err := storageUsage(p.db, userID)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	usage := types.StorageUsage{UserID: userID, Pictures: count, Bytes: bytes, Quota: quota}
+	if quota.MaxPictures > 0 {
+		remaining := quota.MaxPictures - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.RemainingPictures = &remaining
+	}
+	if quota.MaxBytes > 0 {
+		remaining := max64(quota.MaxBytes-bytes, 0)
+		usage.RemainingBytes = &remaining
+	}
+	if quota.UploadsPerHour > 0 {
+		rate, err := currentUploadRate(p.db, userID, time.Now().UTC())
+		if err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+			return
+		}
+		remaining := quota.UploadsPerHour - rate.Count
+		if remaining < 0 {
+			remaining = 0
+		}
+		usage.RemainingUploads = &remaining
+	}
+
+	if err := json.NewEncoder(w).Encode(usage); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// GetUserQuota returns the user's quota override
+func (p *PictureHandlers) GetUserQuota(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	quota, err := fetchOne[types.QuotaSettings](p.db, quotaKey(userID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("user does not have a quota override"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting quota: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(quota); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// PutUserQuota overrides the default quota for the user. The override replaces the whole default
+// quota, so a limit that is left out means the user has no limit
+func (p *PictureHandlers) PutUserQuota(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	var quota types.QuotaSettings
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding quota: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateQuotaSettings(quota); err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusBadRequest)
+		return
+	}
+	if err := storeOne(p.db, quotaKey(userID), quota); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error storing quota: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(quota); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// DeleteUserQuota removes the user's quota override so they use the default quota again
+func (p *PictureHandlers) DeleteUserQuota(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	if err := p.db.Delete(quotaKey(userID)); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("error deleting quota: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestQuotas(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 64, 48)), nil))
+	small := buf.Bytes()
+	buf = new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 640, 480)), nil))
+	large := buf.Bytes()
+	require.Greater(t, len(large), len(small)+100)
+
+	conf := &atomic.Value{}
+	conf.Store(types.Config{Quotas: types.QuotaSettings{MaxPictures: 2, MaxBytes: int64(len(small) + 100), UploadsPerHour: 3}})
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}", pictureHandlers.CreatePicture)
+	r.Get("/pictures/{userId}/usage", pictureHandlers.GetUsage)
+	r.Put("/pictures/{userId}/quota", pictureHandlers.PutUserQuota)
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	do := func(method string, path string, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	pictures := make([]types.Picture, 2)
+	for i := range pictures {
+		rr := do(http.MethodPost, "/pictures/u1", "application/json", []byte(`{"userId": "u1", "name": "beach"}`))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures[i]))
+	}
+	rr := do(http.MethodPost, "/pictures/u1", "application/json", []byte(`{"userId": "u1", "name": "beach"}`))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, "the picture quota should be enforced: %s", rr.Body.String())
+
+	rr = do(http.MethodPut, "/pictures/u1/"+pictures[0].ID(), "image/jpeg", small)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(http.MethodPut, "/pictures/u1/"+pictures[1].ID(), "image/jpeg", large)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rr.Code, "the byte quota should be enforced: %s", rr.Body.String())
+
+	// Replacing an upload only counts the difference against the byte quota, but every upload
+	// counts against the rate
+	for i := 0; i < 2; i++ {
+		rr = do(http.MethodPut, "/pictures/u1/"+pictures[0].ID(), "image/jpeg", small)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = do(http.MethodPut, "/pictures/u1/"+pictures[0].ID(), "image/jpeg", small)
+	require.Equal(t, http.StatusTooManyRequests, rr.Code, rr.Body.String())
+	require.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	rr = do(http.MethodGet, "/pictures/u1/usage", "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var usage types.StorageUsage
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&usage))
+	require.Equal(t, 2, usage.Pictures)
+	require.Equal(t, int64(len(small)), usage.Bytes)
+	require.Equal(t, 0, *usage.RemainingPictures)
+	require.Equal(t, int64(100), *usage.RemainingBytes)
+	require.Equal(t, 0, *usage.RemainingUploads)
+
+	// Overrides replace the default quota
+	rr = do(http.MethodPut, "/pictures/u1/quota", "application/json", []byte(`{"maxPictures": 3}`))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(http.MethodPost, "/pictures/u1", "application/json", []byte(`{"userId": "u1", "name": "beach"}`))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	rr = do(http.MethodPut, "/pictures/u1/"+pictures[1].ID(), "image/jpeg", large)
+	require.Equal(t, http.StatusOK, rr.Code, "the override doesn't limit bytes or uploads: %s", rr.Body.String())
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/httplog"
+	"github.com/rs/zerolog"
+	"github.com/thomastaylor312/printing-api/payment"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+type MismatchKind string
+
+const (
+	// MismatchPaidExternally means the payment provider has the order as paid but we did not. These
+	// are fixed automatically by marking the order as paid
+	MismatchPaidExternally MismatchKind = "paidExternally"
+	// MismatchUnpaidExternally means we have the order as paid but the payment provider does not.
+	// These are not changed automatically and need to be looked at by an admin
+	MismatchUnpaidExternally MismatchKind = "unpaidExternally"
+)
+
+// ReconciliationMismatch is an order whose payment state differed between our store and the
+// payment provider
+type ReconciliationMismatch struct {
+	OrderID         string       `json:"orderId"`
+	UserID          string       `json:"userId"`
+	ExternalOrderID string       `json:"externalOrderId"`
+	Kind            MismatchKind `json:"kind"`
+	Resolved        bool         `json:"resolved"`
+}
+
+// ReconciliationReport is the result of a single reconciliation run
+type ReconciliationReport struct {
+	StartedAt  time.Time                `json:"startedAt"`
+	FinishedAt time.Time                `json:"finishedAt"`
+	Checked    int                      `json:"checked"`
+	Expired    []string                 `json:"expired"`
+	Mismatches []ReconciliationMismatch `json:"mismatches"`
+	Errors     []string                 `json:"errors"`
+}
+
+// Reconciler periodically checks outstanding orders against the payment provider so that missed
+// payment notifications don't leave orders stuck as unpaid
+type Reconciler struct {
+	db          store.DataStore
+	payment     payment.Payment
+	notifier    *Notifier
+	webhooks    *WebhookDispatcher
+	logger      zerolog.Logger
+	interval    time.Duration
+	expireAfter time.Duration
+
+	// runLock makes sure only one run happens at a time
+	runLock    sync.Mutex
+	reportLock sync.RWMutex
+	lastReport *ReconciliationReport
+}
+
+// NewReconciler creates a reconciler that runs every interval once started. Unpaid orders older
+// than expireAfter are marked as expired. An expireAfter of 0 disables expiration
+func NewReconciler(db store.DataStore, payment payment.Payment, notifier *Notifier, webhooks *WebhookDispatcher, logger zerolog.Logger, interval time.Duration, expireAfter time.Duration) *Reconciler {
+	return &Reconciler{db: db, payment: payment, notifier: notifier, webhooks: webhooks, logger: logger, interval: interval, expireAfter: expireAfter}
+}
+
+// Start runs the reconciler in the background until the context is cancelled
+func (rc *Reconciler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(rc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report := rc.Reconcile(ctx)
+				rc.logger.Info().Int("checked", report.Checked).Int("mismatches", len(report.Mismatches)).Int("expired", len(report.Expired)).Int("errors", len(report.Errors)).Msg("Finished order reconciliation")
+			}
+		}
+	}()
+}
+
+// Reconcile does a single reconciliation run and returns the report. Orders that are unpaid and
+// not expired are checked for payment and orders that are paid but haven't shipped are checked to
+// make sure the payment provider agrees. Orders are only expired once their payment is cancelled
+// with the payment provider
+func (rc *Reconciler) Reconcile(ctx context.Context) ReconciliationReport {
+	rc.runLock.Lock()
+	defer rc.runLock.Unlock()
+
+	report := ReconciliationReport{
+		StartedAt:  time.Now().UTC(),
+		Expired:    []string{},
+		Mismatches: []ReconciliationMismatch{},
+		Errors:     []string{},
+	}
+	rc.checkOrders(ctx, &report)
+	report.FinishedAt = time.Now().UTC()
+
+	rc.reportLock.Lock()
+	rc.lastReport = &report
+	rc.reportLock.Unlock()
+	return report
+}
+
+func (rc *Reconciler) checkOrders(ctx context.Context, report *ReconciliationReport) {
+	keys, err := getKeys(rc.db, "orders")
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("error getting orders: %v", err))
+		return
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			report.Errors = append(report.Errors, ctx.Err().Error())
+			return
+		}
+		order, err := fetchOne[types.Order](rc.db, key)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("error getting order %s: %v", key, err))
+			continue
+		}
+		if order.IsExpired || order.HasShipped || order.ExternalOrderID == "" {
+			continue
+		}
+
+		report.Checked++
+		paid, err := rc.payment.ValidateOrderPaid(ctx, order.ExternalOrderID)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("error checking payment for order %s: %v", order.ID(), err))
+			continue
+		}
+
+		mismatch := ReconciliationMismatch{
+			OrderID:         order.ID(),
+			UserID:          order.UserID,
+			ExternalOrderID: order.ExternalOrderID,
+		}
+		// Paid orders may not have an address yet if the customer entered it with the payment
+		// provider
+		addressChanged := false
+		if paid {
+			if addressChanged, err = fillShippingAddress(ctx, rc.payment, order); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("error getting shipping address for order %s: %v", order.ID(), err))
+			}
+		}
+
+		switch {
+		case paid && !order.IsPaid:
+			mismatch.Kind = MismatchPaidExternally
+			updated, markedPaid, err := markOrderPaid(rc.db, order.ID(), order.ShippingDetails.Address)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("error updating order %s: %v", order.ID(), err))
+			} else {
+				mismatch.Resolved = true
+				// The customer can confirm the payment while we are checking, in which case they
+				// have already done the rest
+				if markedPaid {
+					if _, err := createProductionJobs(rc.db, updated); err != nil {
+						report.Errors = append(report.Errors, fmt.Sprintf("error creating production jobs for order %s: %v", order.ID(), err))
+					}
+					rc.notifier.Notify(types.NotificationOrderPaid, *updated, nil)
+					rc.webhooks.Publish(types.WebhookOrderPaid, updated)
+				}
+			}
+			report.Mismatches = append(report.Mismatches, mismatch)
+		case addressChanged:
+			address := order.ShippingDetails.Address
+			if _, _, err := changeOrder(rc.db, order.ID(), func(order *types.Order) bool {
+				if order.ShippingDetails.Address != nil {
+					return false
+				}
+				order.ShippingDetails.Address = address
+				return true
+			}); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("error updating order %s: %v", order.ID(), err))
+			}
+		case !paid && order.IsPaid:
+			mismatch.Kind = MismatchUnpaidExternally
+			report.Mismatches = append(report.Mismatches, mismatch)
+		case !paid && rc.isStale(order):
+			// Cancel the payment link first so the customer can't pay for an order we have given up
+			// on. If they paid in the meantime this fails and the payment is picked up next run
+			if err := rc.payment.CancelOrder(ctx, order.ExternalOrderID); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("error cancelling payment for order %s: %v", order.ID(), err))
+				continue
+			}
+			_, expired, err := changeOrder(rc.db, order.ID(), func(order *types.Order) bool {
+				if order.IsPaid || order.IsExpired {
+					return false
+				}
+				order.IsExpired = true
+				return true
+			})
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("error expiring order %s: %v", order.ID(), err))
+				continue
+			}
+			if expired {
+				report.Expired = append(report.Expired, order.ID())
+			}
+		}
+	}
+}
+
+// isStale returns whether the order's payment link is old enough that it should be expired. Orders
+// without a creation time predate expiration and are never expired
+func (rc *Reconciler) isStale(order *types.Order) bool {
+	if rc.expireAfter == 0 || order.CreatedAt.IsZero() {
+		return false
+	}
+	return time.Since(order.CreatedAt) > rc.expireAfter
+}
+
+// GetReport returns the report from the last reconciliation run
+func (rc *Reconciler) GetReport(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	rc.reportLock.RLock()
+	report := rc.lastReport
+	rc.reportLock.RUnlock()
+	if report == nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("reconciliation has not run yet"), http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// RunReconciliation runs reconciliation immediately and returns the report
+func (rc *Reconciler) RunReconciliation(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	report := rc.Reconcile(r.Context())
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
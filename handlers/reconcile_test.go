@@ -0,0 +1,191 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/notify"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+type fakePayment struct {
+	paid     map[string]bool
+	canceled map[string]bool
+}
+
+func (f *fakePayment) CreateOrder(ctx context.Context, order types.Order) (string, *url.URL, error) {
+	return "external-" + order.ID(), &url.URL{Scheme: "https", Host: "example.com"}, nil
+}
+
+func (f *fakePayment) GetShippingAddress(ctx context.Context, externalOrderID string) (*types.Address, error) {
+	return nil, nil
+}
+
+func (f *fakePayment) ValidateOrderPaid(ctx context.Context, externalOrderID string) (bool, error) {
+	return f.paid[externalOrderID], nil
+}
+
+func (f *fakePayment) CancelOrder(ctx context.Context, externalOrderID string) error {
+	if f.paid[externalOrderID] {
+		return errors.New("order has been paid for")
+	}
+	if f.canceled == nil {
+		f.canceled = map[string]bool{}
+	}
+	f.canceled[externalOrderID] = true
+	return nil
+}
+
+// racingPayment is a payment provider where the customer pays just as the order is cancelled
+type racingPayment struct {
+	*fakePayment
+}
+
+func (r racingPayment) CancelOrder(ctx context.Context, externalOrderID string) error {
+	r.paid[externalOrderID] = true
+	return r.fakePayment.CancelOrder(ctx, externalOrderID)
+}
+
+// confirmingPayment is a payment provider where the customer confirms the payment while the
+// reconciler is checking it
+type confirmingPayment struct {
+	*fakePayment
+	confirm func()
+}
+
+func (c *confirmingPayment) ValidateOrderPaid(ctx context.Context, externalOrderID string) (bool, error) {
+	if confirm := c.confirm; confirm != nil {
+		c.confirm = nil
+		confirm()
+	}
+	return c.fakePayment.ValidateOrderPaid(ctx, externalOrderID)
+}
+
+func putOrders(t *testing.T, db store.DataStore, orders ...types.Order) {
+	keys := make([]string, 0, len(orders))
+	for _, order := range orders {
+		buf := new(bytes.Buffer)
+		require.NoError(t, gob.NewEncoder(buf).Encode(order))
+		require.NoError(t, db.Set("orders:"+order.ID(), buf.Bytes()))
+		keys = append(keys, "orders:"+order.ID())
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(keys))
+	require.NoError(t, db.Set("orders", buf.Bytes()))
+}
+
+func getOrder(t *testing.T, db store.DataStore, id string) types.Order {
+	data, err := db.Get("orders:" + id)
+	require.NoError(t, err)
+	var order types.Order
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(data)).Decode(&order))
+	return order
+}
+
+func TestReconcile(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	old := time.Now().Add(-48 * time.Hour)
+	putOrders(t, db,
+		// Paid in the payment provider but we missed it
+		types.Order{OrderID: "1", UserID: "1", ExternalOrderID: "a", CreatedAt: time.Now()},
+		// Paid in our store but not in the payment provider
+		types.Order{OrderID: "2", UserID: "1", ExternalOrderID: "b", CreatedAt: time.Now(), IsPaid: true},
+		// Never paid and the link is stale
+		types.Order{OrderID: "3", UserID: "2", ExternalOrderID: "c", CreatedAt: old},
+		// Unpaid but still recent
+		types.Order{OrderID: "4", UserID: "2", ExternalOrderID: "d", CreatedAt: time.Now()},
+	)
+
+	payments := &fakePayment{paid: map[string]bool{"a": true}}
+	reconciler := handlers.NewReconciler(db, payments, nil, nil, zerolog.Nop(), time.Hour, 24*time.Hour)
+	report := reconciler.Reconcile(context.Background())
+
+	require.Empty(t, report.Errors)
+	require.Equal(t, 4, report.Checked)
+	require.Equal(t, []string{"3"}, report.Expired)
+	require.Equal(t, []handlers.ReconciliationMismatch{
+		{OrderID: "1", UserID: "1", ExternalOrderID: "a", Kind: handlers.MismatchPaidExternally, Resolved: true},
+		{OrderID: "2", UserID: "1", ExternalOrderID: "b", Kind: handlers.MismatchUnpaidExternally},
+	}, report.Mismatches)
+
+	require.True(t, getOrder(t, db, "1").IsPaid)
+	require.True(t, getOrder(t, db, "2").IsPaid, "orders unpaid externally should not be changed automatically")
+	require.True(t, getOrder(t, db, "3").IsExpired)
+	require.True(t, payments.canceled["c"], "expired orders should not be payable")
+	require.False(t, getOrder(t, db, "4").IsExpired)
+
+	// Expired orders shouldn't be checked again
+	report = reconciler.Reconcile(context.Background())
+	require.Equal(t, 3, report.Checked)
+}
+
+func TestReconcilePaidAfterExpiry(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	putOrders(t, db, types.Order{OrderID: "1", UserID: "1", ExternalOrderID: "a", CreatedAt: time.Now().Add(-48 * time.Hour)})
+
+	payments := racingPayment{&fakePayment{paid: map[string]bool{}}}
+	reconciler := handlers.NewReconciler(db, payments, nil, nil, zerolog.Nop(), time.Hour, 24*time.Hour)
+	report := reconciler.Reconcile(context.Background())
+	require.Empty(t, report.Expired, "orders can't be expired if the payment can't be cancelled")
+	require.Len(t, report.Errors, 1)
+	require.False(t, getOrder(t, db, "1").IsExpired)
+
+	report = reconciler.Reconcile(context.Background())
+	require.Empty(t, report.Errors)
+	require.Equal(t, []handlers.ReconciliationMismatch{
+		{OrderID: "1", UserID: "1", ExternalOrderID: "a", Kind: handlers.MismatchPaidExternally, Resolved: true},
+	}, report.Mismatches)
+	order := getOrder(t, db, "1")
+	require.True(t, order.IsPaid)
+	require.False(t, order.IsExpired)
+}
+
+func TestReconcileWhileConfirming(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(types.User{UserId: "u1", Username: "sam", Email: "sam@example.com"}))
+	require.NoError(t, db.Set("users:u1", buf.Bytes()))
+	putOrders(t, db, types.Order{OrderID: "1", UserID: "u1", ExternalOrderID: "a", CreatedAt: time.Now()})
+
+	sender := &fakeSender{messages: make(chan notify.Message, 2)}
+	notifier := handlers.NewNotifier(db, sender, zerolog.Nop())
+	payments := &confirmingPayment{fakePayment: &fakePayment{paid: map[string]bool{"a": true}}}
+	r := chi.NewRouter()
+	r.Put("/orders/{userId}/{id}", handlers.NewOrderHandlers(db, nil, nil, payments, notifier, nil).ConfirmOrderPayed)
+	payments.confirm = func() {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("PUT", "/orders/u1/1", nil))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	reconciler := handlers.NewReconciler(db, payments, notifier, nil, zerolog.Nop(), time.Hour, 24*time.Hour)
+	report := reconciler.Reconcile(context.Background())
+	require.Empty(t, report.Errors)
+	require.True(t, getOrder(t, db, "1").IsPaid)
+
+	// The customer marked it as paid first, so the reconciler shouldn't tell them again
+	sender.next(t)
+	select {
+	case msg := <-sender.messages:
+		t.Fatalf("unexpected notification %q", msg.Subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,462 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/rs/zerolog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	// The image store container chunks of resumable uploads are kept in until the upload completes
+	uploadChunkContainer = "resumable-uploads"
+	// The tus protocol version the resumable uploads follow
+	tusVersion = "1.0.0"
+	// The tus status code for a checksum that doesn't match
+	statusChecksumMismatch = 460
+)
+
+// ResumableUploadHandlers implement resumable picture uploads following the core tus protocol. An
+// upload is created with the size of the picture, the chunks are sent with PATCH requests that say
+// which offset they start at, and a HEAD request returns the offset to resume from after a failure.
+// Once the last chunk arrives the picture is validated and stored like a regular upload. Uploads that
+// stop getting chunks are deleted after a while
+type ResumableUploadHandlers struct {
+	pictures    *PictureHandlers
+	logger      zerolog.Logger
+	interval    time.Duration
+	expireAfter time.Duration
+
+	// The IDs of uploads that are currently receiving a chunk. Only one chunk can be sent to an
+	// upload at a time
+	active sync.Map
+}
+
+// NewResumableUploadHandlers creates the handlers for resumable uploads. Once started, uploads that
+// haven't received a chunk for expireAfter are cleaned up every interval
+func NewResumableUploadHandlers(pictures *PictureHandlers, logger zerolog.Logger, interval time.Duration, expireAfter time.Duration) *ResumableUploadHandlers {
+	return &ResumableUploadHandlers{pictures: pictures, logger: logger, interval: interval, expireAfter: expireAfter}
+}
+
+// CreateUpload starts a resumable upload for a picture. The Upload-Length header is the size of the
+// picture, and an optional Upload-Checksum header of "sha256 <base64 digest>" is checked against the
+// whole picture once it has been received
+func (u *ResumableUploadHandlers) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	pictureID := chi.URLParam(r, "id")
+	if !checkTusVersion(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeHttpError(r.Context(), w, fmt.Errorf("Upload-Length must be the size of the picture"), http.StatusBadRequest)
+		return
+	}
+	if maxBytes := uploadMaxBytes(loadConfig(u.pictures.conf).Uploads); length > maxBytes {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture is %d bytes, the maximum is %d bytes", length, maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var checksum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		if checksum, err = parseUploadChecksum(header); err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	picture, err := u.pictures.getPicture(pictureID, userID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	if !u.pictures.enforceUploadQuota(w, r, picture, length) {
+		return
+	}
+
+	now := time.Now().UTC()
+	upload, err := addOne[*types.ResumableUpload](u.pictures.db, "uploads", &types.ResumableUpload{
+		UserID:    userID,
+		PictureID: pictureID,
+		Length:    length,
+		Checksum:  checksum,
+		Chunks:    []types.UploadChunk{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil, nil)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error creating upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", path.Join(r.URL.Path, upload.UploadID))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// GetUploadOffset returns how much of the upload has been received in the Upload-Offset header
+func (u *ResumableUploadHandlers) GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	upload, ok := u.getUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload receives the next chunk of an upload. The Upload-Offset header has to match the
+// current offset and the body has to be application/offset+octet-stream. An Upload-Checksum header
+// is checked against just this chunk. When the last chunk is received the picture is validated and
+// returned, otherwise the response is empty with the new offset. If storing the picture fails, an
+// empty PATCH at the end of the upload tries again
+func (u *ResumableUploadHandlers) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeHttpError(r.Context(), w, fmt.Errorf("Content-Type must be application/offset+octet-stream"), http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("Upload-Offset must be provided"), http.StatusBadRequest)
+		return
+	}
+	var chunkChecksum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		if chunkChecksum, err = parseUploadChecksum(header); err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	upload, ok := u.getUpload(w, r)
+	if !ok {
+		return
+	}
+	if !u.acquire(upload.UploadID) {
+		writeHttpError(r.Context(), w, fmt.Errorf("another chunk is being sent to this upload"), http.StatusLocked)
+		return
+	}
+	defer u.release(upload.UploadID)
+	// Get the upload again now that we hold it, since a chunk could have finished in between
+	if upload, ok = u.getUpload(w, r); !ok {
+		return
+	}
+
+	if offset != upload.Offset {
+		writeHttpError(r.Context(), w, fmt.Errorf("upload is at offset %d, not %d", upload.Offset, offset), http.StatusConflict)
+		return
+	}
+	// An empty chunk at the end of the upload retries completing it after a failure
+	if r.ContentLength == 0 && upload.Offset == upload.Length {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		u.completeUpload(w, r, upload)
+		return
+	}
+	if r.ContentLength <= 0 {
+		writeHttpError(r.Context(), w, fmt.Errorf("Content-Length of chunk must be provided"), http.StatusBadRequest)
+		return
+	}
+	if upload.Offset+r.ContentLength > upload.Length {
+		writeHttpError(r.Context(), w, fmt.Errorf("chunk goes past the end of the %d byte upload", upload.Length), http.StatusBadRequest)
+		return
+	}
+
+	chunk := types.UploadChunk{Offset: offset, Size: r.ContentLength, FileID: fmt.Sprintf("%s-%d", upload.UploadID, offset)}
+	digest := sha256.New()
+	// The store checks the body is exactly the chunk size and doesn't keep partial chunks, so a
+	// dropped connection leaves the upload at the last complete chunk
+	if _, err := u.pictures.storage.Set(uploadChunkContainer, chunk.FileID, uint(chunk.Size), io.NopCloser(io.TeeReader(r.Body, digest))); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error storing chunk: %v", err), http.StatusBadRequest)
+		return
+	}
+	if chunkChecksum != nil && !bytes.Equal(chunkChecksum, digest.Sum(nil)) {
+		u.pictures.storage.Delete(uploadChunkContainer, chunk.FileID)
+		writeHttpError(r.Context(), w, fmt.Errorf("chunk does not match its checksum"), statusChecksumMismatch)
+		return
+	}
+
+	upload.Chunks = append(upload.Chunks, chunk)
+	upload.Offset += chunk.Size
+	upload.UpdatedAt = time.Now().UTC()
+	if err := storeOne(u.pictures.db, fmt.Sprintf("uploads:%s", upload.UploadID), upload); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Offset < upload.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	u.completeUpload(w, r, upload)
+}
+
+// DeleteUpload cancels an upload and removes the chunks that have been received
+func (u *ResumableUploadHandlers) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	upload, ok := u.getUpload(w, r)
+	if !ok {
+		return
+	}
+	if !u.acquire(upload.UploadID) {
+		writeHttpError(r.Context(), w, fmt.Errorf("a chunk is being sent to this upload"), http.StatusLocked)
+		return
+	}
+	defer u.release(upload.UploadID)
+	if err := u.removeUpload(upload); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error deleting upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload puts the chunks back together, checks the picture and stores it. The upload is
+// only removed once the picture is stored, so if anything fails the chunks are kept and completing
+// the upload can be retried with an empty PATCH at the end of the upload
+func (u *ResumableUploadHandlers) completeUpload(w http.ResponseWriter, r *http.Request, upload *types.ResumableUpload) {
+	logger := httplog.LogEntry(r.Context()).With().Str("uploadID", upload.UploadID).Logger()
+	// The picture could have been deleted while it was uploading
+	picture, err := u.pictures.getPicture(upload.PictureID, upload.UserID, w, r)
+	if err != nil {
+		// Our helper writes the error for us
+		return
+	}
+	chunks := &chunkReader{storage: u.pictures.storage, chunks: upload.Chunks}
+	spooled, err := spoolPicture(chunks, upload.Length+1)
+	chunks.Close()
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error reading upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer spooled.Close()
+	if spooled.size != upload.Length {
+		writeHttpError(r.Context(), w, fmt.Errorf("expected a %d byte upload but the chunks are %d bytes", upload.Length, spooled.size), http.StatusInternalServerError)
+		return
+	}
+	if upload.Checksum != nil && !bytes.Equal(upload.Checksum, spooled.sum) {
+		writeHttpError(r.Context(), w, fmt.Errorf("picture does not match the checksum given when the upload was created"), statusChecksumMismatch)
+		return
+	}
+
+	meta, code, err := validatePicture(spooled, spooled.size, "", loadConfig(u.pictures.conf).Uploads)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, code)
+		return
+	}
+	if !u.pictures.storePicture(w, r, picture, spooled, meta) {
+		return
+	}
+	if err := u.removeUpload(upload); err != nil {
+		logger.Warn().Err(err).Msg("Error removing completed upload")
+	}
+}
+
+// chunkReader reads the chunks of an upload in order, only opening one at a time
+type chunkReader struct {
+	storage store.ImageStore
+	chunks  []types.UploadChunk
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := c.storage.Open(uploadChunkContainer, c.chunks[0].FileID)
+			if err != nil {
+				return 0, fmt.Errorf("error opening chunk at offset %d: %v", c.chunks[0].Offset, err)
+			}
+			c.current = reader
+			c.chunks = c.chunks[1:]
+		}
+		n, err := c.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	return c.current.Close()
+}
+
+// removeUpload deletes the chunks of an upload and then the upload itself
+func (u *ResumableUploadHandlers) removeUpload(upload *types.ResumableUpload) error {
+	for _, chunk := range upload.Chunks {
+		if err := u.pictures.storage.Delete(uploadChunkContainer, chunk.FileID); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+			return fmt.Errorf("error deleting chunk: %v", err)
+		}
+	}
+	keys, err := getKeys(u.pictures.db, "uploads")
+	if err != nil {
+		return fmt.Errorf("error getting uploads: %v", err)
+	}
+	key := fmt.Sprintf("uploads:%s", upload.UploadID)
+	for i := range keys {
+		if keys[i] == key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if err := storeOne(u.pictures.db, "uploads", keys); err != nil {
+		return fmt.Errorf("error updating uploads: %v", err)
+	}
+	if err := u.pictures.db.Delete(key); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		return fmt.Errorf("error deleting upload: %v", err)
+	}
+	return nil
+}
+
+// getUpload gets the upload from the URL, checking it is for the picture in the URL
+func (u *ResumableUploadHandlers) getUpload(w http.ResponseWriter, r *http.Request) (*types.ResumableUpload, bool) {
+	upload, err := fetchOne[types.ResumableUpload](u.pictures.db, fmt.Sprintf("uploads:%s", chi.URLParam(r, "uploadId")))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("upload not found"), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting upload: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	if upload.UserID != chi.URLParam(r, "userId") || upload.PictureID != chi.URLParam(r, "id") {
+		writeHttpError(r.Context(), w, fmt.Errorf("upload not found"), http.StatusNotFound)
+		return nil, false
+	}
+	return upload, true
+}
+
+func (u *ResumableUploadHandlers) acquire(uploadID string) bool {
+	_, busy := u.active.LoadOrStore(uploadID, true)
+	return !busy
+}
+
+func (u *ResumableUploadHandlers) release(uploadID string) {
+	u.active.Delete(uploadID)
+}
+
+// Start cleans up abandoned uploads in the background until the context is cancelled
+func (u *ResumableUploadHandlers) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				removed, err := u.Cleanup(time.Now())
+				if err != nil {
+					u.logger.Error().Err(err).Msg("Error cleaning up abandoned uploads")
+				} else if removed > 0 {
+					u.logger.Info().Int("removed", removed).Msg("Cleaned up abandoned uploads")
+				}
+			}
+		}
+	}()
+}
+
+// Cleanup removes resumable uploads that haven't received a chunk within the expiry and direct
+// uploads whose URL has expired without being completed. It returns how many were removed
+func (u *ResumableUploadHandlers) Cleanup(now time.Time) (int, error) {
+	removed := 0
+	keys, err := getKeys(u.pictures.db, "uploads")
+	if err != nil {
+		return removed, fmt.Errorf("error getting uploads: %v", err)
+	}
+	uploads, err := fetchByKeys[types.ResumableUpload](u.pictures.db, keys)
+	if err != nil {
+		return removed, fmt.Errorf("error getting uploads: %v", err)
+	}
+	for i := range uploads {
+		if now.Sub(uploads[i].UpdatedAt) < u.expireAfter || !u.acquire(uploads[i].UploadID) {
+			continue
+		}
+		err := u.removeUpload(&uploads[i])
+		u.release(uploads[i].UploadID)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	keys, err = getKeys(u.pictures.db, "pictures")
+	if err != nil {
+		return removed, fmt.Errorf("error getting pictures: %v", err)
+	}
+	for _, key := range keys {
+		picture, err := fetchOne[types.Picture](u.pictures.db, key)
+		if errors.Is(err, store.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return removed, fmt.Errorf("error getting picture: %v", err)
+		}
+		// Give uploads that started just before the URL expired time to finish
+		if picture.PendingUpload == nil || now.Sub(picture.PendingUpload.ExpiresAt) < u.expireAfter {
+			continue
+		}
+		if err := u.pictures.storage.Delete(pendingUploadContainer, picture.PictureID); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+			return removed, fmt.Errorf("error deleting direct upload: %v", err)
+		}
+		picture.PendingUpload = nil
+		if err := storeOne(u.pictures.db, key, picture); err != nil {
+			return removed, fmt.Errorf("error updating picture: %v", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// checkTusVersion responds with the tus version we follow and checks the request uses the same one.
+// Every tus request has to say which version it uses
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeHttpError(r.Context(), w, fmt.Errorf("Tus-Resumable must be %s", tusVersion), http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseUploadChecksum parses an Upload-Checksum header. Only SHA-256 is supported
+func parseUploadChecksum(header string) ([]byte, error) {
+	algorithm, encoded, ok := strings.Cut(header, " ")
+	if !ok || algorithm != "sha256" {
+		return nil, fmt.Errorf("Upload-Checksum must be \"sha256 <base64 digest>\"")
+	}
+	checksum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, fmt.Errorf("Upload-Checksum is not a valid SHA-256 digest")
+	}
+	return checksum, nil
+}
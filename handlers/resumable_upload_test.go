@@ -0,0 +1,149 @@
+package handlers_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestResumableUpload(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := failingStore{directUploadStore: directUploadStore{store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))}, fail: &atomic.Bool{}}
+	conf := &atomic.Value{}
+	conf.Store(types.Config{})
+	putPicture(t, db, types.Picture{PictureID: "10", UserID: "u1", Name: "big"})
+
+	uploads := handlers.NewResumableUploadHandlers(handlers.NewPictureHandlers(db, storage, conf, nil, nil), zerolog.Nop(), time.Hour, 24*time.Hour)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}/{id}/uploads", uploads.CreateUpload)
+	r.Head("/pictures/{userId}/{id}/uploads/{uploadId}", uploads.GetUploadOffset)
+	r.Patch("/pictures/{userId}/{id}/uploads/{uploadId}", uploads.PatchUpload)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 640, 480))))
+	data := buf.Bytes()
+	checksum := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	create := func() string {
+		req := httptest.NewRequest("POST", "/pictures/u1/10/uploads", nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+		req.Header.Set("Upload-Checksum", checksum(data))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		return rr.Header().Get("Location")
+	}
+	patch := func(location string, offset int, chunk []byte, chunkChecksum string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", location, bytes.NewReader(chunk))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		if chunkChecksum != "" {
+			req.Header.Set("Upload-Checksum", chunkChecksum)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	head := func(location string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", location, nil)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	location := create()
+	half := len(data) / 2
+
+	// Requests have to use the same tus version and send chunks as application/offset+octet-stream
+	req := httptest.NewRequest("PATCH", location, bytes.NewReader(data[:half]))
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusPreconditionFailed, rr.Code, rr.Body.String())
+	require.Equal(t, "1.0.0", rr.Header().Get("Tus-Version"))
+	req = httptest.NewRequest("PATCH", location, bytes.NewReader(data[:half]))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusUnsupportedMediaType, rr.Code, rr.Body.String())
+
+	rr = patch(location, 0, data[:half], checksum(data[:half]))
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	require.Equal(t, strconv.Itoa(half), rr.Header().Get("Upload-Offset"))
+
+	rr = patch(location, 0, data[half:], "")
+	require.Equal(t, http.StatusConflict, rr.Code, "wrong offset should fail: %s", rr.Body.String())
+	rr = patch(location, half, data[half:], checksum(data[:half]))
+	require.Equal(t, 460, rr.Code, "chunk that doesn't match its checksum should fail: %s", rr.Body.String())
+
+	// After a failure the client asks where to resume from
+	rr = head(location)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, strconv.Itoa(half), rr.Header().Get("Upload-Offset"))
+	require.Equal(t, strconv.Itoa(len(data)), rr.Header().Get("Upload-Length"))
+
+	// If the picture can't be stored the chunks are kept and completing can be retried
+	storage.fail.Store(true)
+	rr = patch(location, half, data[half:], "")
+	require.Equal(t, http.StatusInternalServerError, rr.Code, rr.Body.String())
+	rr = head(location)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, strconv.Itoa(len(data)), rr.Header().Get("Upload-Offset"))
+	storage.fail.Store(false)
+
+	rr = patch(location, len(data), nil, "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var picture types.Picture
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&picture))
+	require.Equal(t, 640, picture.Width)
+	require.Equal(t, int64(len(data)), picture.Size)
+	require.Equal(t, http.StatusNotFound, head(location).Code, "completed uploads should be removed")
+	chunks, err := os.ReadDir(filepath.Join(tmpdir, "storage", "resumable-uploads"))
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+
+	// Abandoned uploads are cleaned up once they expire
+	location = create()
+	rr = patch(location, 0, data[:half], "")
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	removed, err := uploads.Cleanup(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+	removed, err = uploads.Cleanup(time.Now().Add(25 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Equal(t, http.StatusNotFound, head(location).Code)
+	chunks, err = os.ReadDir(filepath.Join(tmpdir, "storage", "resumable-uploads"))
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+}
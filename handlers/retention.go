@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/httplog"
+	"github.com/rs/zerolog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	defaultOrderedPictureDays = 30
+	// Files are written before the records that reference them, so files younger than this are
+	// never treated as orphans
+	orphanFileGracePeriod = 24 * time.Hour
+)
+
+func orderedPictureRetention(settings types.RetentionSettings) time.Duration {
+	days := settings.OrderedPictureDays
+	if days == 0 {
+		days = defaultOrderedPictureDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func validateRetentionSettings(settings types.RetentionSettings) error {
+	if settings.OrderedPictureDays < 0 || settings.UnusedPictureDays < 0 {
+		return fmt.Errorf("retention cannot be negative")
+	}
+	return nil
+}
+
+func lastUsedKey(pictureID string) string {
+	return fmt.Sprintf("picture_last_used:%s", pictureID)
+}
+
+// markPicturesUsed records that the pictures were used. This is stored separately from the pictures
+// so it can't overwrite changes being made to them at the same time
+func markPicturesUsed(db store.DataStore, now time.Time, pictureIDs ...string) error {
+	for _, pictureID := range pictureIDs {
+		if pictureID == "" {
+			continue
+		}
+		if err := storeOne(db, lastUsedKey(pictureID), now); err != nil {
+			return fmt.Errorf("error marking picture %s as used: %v", pictureID, err)
+		}
+	}
+	return nil
+}
+
+func printPictureIDs(prints []types.Print) []string {
+	ids := make([]string, 0, len(prints))
+	for _, print := range prints {
+		ids = append(ids, print.PictureID)
+	}
+	return ids
+}
+
+// loadLastUsed sets when the picture was last used. Pictures that haven't been used since this was
+// tracked are left without it
+func loadLastUsed(db store.DataStore, picture *types.Picture) error {
+	lastUsed, err := fetchOne[time.Time](db, lastUsedKey(picture.PictureID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		picture.LastUsedAt = nil
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting last use: %v", err)
+	}
+	picture.LastUsedAt = lastUsed
+	return nil
+}
+
+// orderFulfilledAt returns when the order was delivered, or false if it hasn't been
+func orderFulfilledAt(order types.Order) (time.Time, bool) {
+	if !order.IsDelivered {
+		return time.Time{}, false
+	}
+	if order.DeliveredAt != nil {
+		return *order.DeliveredAt, true
+	}
+	// Orders delivered before the delivery time was recorded use when they last shipped
+	latest := order.CreatedAt
+	for _, shipment := range order.ShippingDetails.Shipments {
+		if shipment.ShippedAt.After(latest) {
+			latest = shipment.ShippedAt
+		}
+	}
+	return latest, true
+}
+
+// orderRetainsPictures returns whether the order still needs its pictures. Orders need them until
+// they have been delivered for the retention period, in case something has to be reprinted.
+// Expired orders are never printed so they don't need them at all
+func orderRetainsPictures(order types.Order, now time.Time, retention time.Duration) bool {
+	if order.IsExpired {
+		return false
+	}
+	fulfilledAt, ok := orderFulfilledAt(order)
+	return !ok || now.Before(fulfilledAt.Add(retention))
+}
+
+// retainingOrders returns the IDs of the orders that still need the picture
+func retainingOrders(orders []types.Order, pictureID string, now time.Time, retention time.Duration) []string {
+	ids := []string{}
+	for _, order := range orders {
+		if !orderRetainsPictures(order, now, retention) {
+			continue
+		}
+		for _, print := range order.Prints {
+			if print.PictureID == pictureID {
+				ids = append(ids, order.OrderID)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// deletePictureRecords deletes the picture and its derivatives from the database, returning the
+// derivatives so their files can be deleted. The records are deleted before any files so a failure
+// can only leave files without records, never records without files
+func deletePictureRecords(db store.DataStore, picture types.Picture) (*pictureDerivatives, error) {
+	key := fmt.Sprintf("pictures:%s", picture.ID())
+	derivatives, err := fetchOne[pictureDerivatives](db, derivativesKey(picture.ID()))
+	if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		return nil, fmt.Errorf("error getting derivatives: %v", err)
+	}
+	if err := removeKey(db, fmt.Sprintf("pictures:%s", picture.UserID), key); err != nil {
+		return nil, fmt.Errorf("error removing picture from user: %v", err)
+	}
+	if err := removePictureFromAlbums(db, picture.UserID, picture.ID()); err != nil {
+		return nil, err
+	}
+	if err := removeKey(db, "pictures", key); err != nil {
+		return nil, fmt.Errorf("error removing picture from pictures: %v", err)
+	}
+	if err := db.Delete(key); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		return nil, fmt.Errorf("error deleting picture: %v", err)
+	}
+	if err := db.Delete(derivativesKey(picture.ID())); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		return nil, fmt.Errorf("error deleting derivatives: %v", err)
+	}
+	if err := db.Delete(lastUsedKey(picture.ID())); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		return nil, fmt.Errorf("error deleting last use: %v", err)
+	}
+	return derivatives, nil
+}
+
+// deletePictureFiles deletes the files for a picture whose records have been deleted. Uploads
+// stored by hash are only deleted once no other picture or order uses them
+func deletePictureFiles(db store.DataStore, storage store.ImageStore, picture types.Picture, derivatives *pictureDerivatives) error {
+	var err error
+	if picture.Hash != "" {
+		err = releaseBlob(db, storage, picture.Hash, fmt.Sprintf("pictures:%s", picture.ID()))
+	} else {
+		err = storage.Delete(picture.UserID, picture.PictureID)
+	}
+	if err != nil && !errors.Is(err, store.ErrImageNotFound) {
+		return fmt.Errorf("error deleting picture: %v", err)
+	}
+	if derivatives != nil {
+		if err := deleteDerivativeFiles(storage, picture.UserID, derivatives.Derivatives); err != nil {
+			return fmt.Errorf("error deleting derivatives: %v", err)
+		}
+	}
+	return nil
+}
+
+// OrphanFile is a file in the image store that nothing in the database references
+type OrphanFile struct {
+	Container  string    `json:"container"`
+	ID         string    `json:"id"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// RetentionReport is what a single cleanup did, or would do for a dry run
+type RetentionReport struct {
+	StartedAt time.Time `json:"startedAt"`
+	DryRun    bool      `json:"dryRun"`
+	// Orders that no longer need their pictures, so their references to them were released
+	ReleasedOrders []string `json:"releasedOrders"`
+	// Deleted pictures that were removed because no order needs them anymore
+	PurgedPictures []string `json:"purgedPictures"`
+	// Pictures that were deleted because they haven't been used within the retention period
+	UnusedPictures []string `json:"unusedPictures"`
+	// Files that were deleted because nothing references them. These are only found for image
+	// stores that can list their files
+	OrphanFiles []OrphanFile `json:"orphanFiles"`
+}
+
+// PictureRetention periodically cleans up pictures. It releases the pictures of orders that are
+// past the retention period, removes deleted pictures once no order needs them, deletes pictures
+// that haven't been used within the retention period and deletes files that nothing references
+type PictureRetention struct {
+	db       store.DataStore
+	storage  store.ImageStore
+	conf     *atomic.Value
+	logger   zerolog.Logger
+	interval time.Duration
+
+	// runLock makes sure only one sweep happens at a time
+	runLock sync.Mutex
+}
+
+// NewPictureRetention creates a PictureRetention that sweeps every interval once started
+func NewPictureRetention(db store.DataStore, storage store.ImageStore, conf *atomic.Value, logger zerolog.Logger, interval time.Duration) *PictureRetention {
+	return &PictureRetention{db: db, storage: storage, conf: conf, logger: logger, interval: interval}
+}
+
+// Start sweeps in the background until the context is cancelled
+func (pr *PictureRetention) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(pr.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := pr.Sweep(time.Now().UTC(), false)
+				if err != nil {
+					pr.logger.Error().Err(err).Msg("Error cleaning up pictures")
+				}
+				pr.logger.Info().Int("releasedOrders", len(report.ReleasedOrders)).Int("purgedPictures", len(report.PurgedPictures)).Int("unusedPictures", len(report.UnusedPictures)).Int("orphanFiles", len(report.OrphanFiles)).Msg("Finished picture cleanup")
+			}
+		}
+	}()
+}
+
+// Sweep does a single cleanup and returns what it did. A dry run returns what would be cleaned up
+// without changing anything
+func (pr *PictureRetention) Sweep(now time.Time, dryRun bool) (RetentionReport, error) {
+	pr.runLock.Lock()
+	defer pr.runLock.Unlock()
+	report := RetentionReport{
+		StartedAt:      now,
+		DryRun:         dryRun,
+		ReleasedOrders: []string{},
+		PurgedPictures: []string{},
+		UnusedPictures: []string{},
+		OrphanFiles:    []OrphanFile{},
+	}
+	settings := loadConfig(pr.conf).Retention
+	retention := orderedPictureRetention(settings)
+
+	keys, err := getKeys(pr.db, "orders")
+	if err != nil {
+		return report, fmt.Errorf("error getting orders: %v", err)
+	}
+	orders, err := fetchByKeys[types.Order](pr.db, keys)
+	if err != nil {
+		return report, fmt.Errorf("error getting orders: %v", err)
+	}
+	for i := range orders {
+		order := &orders[i]
+		if order.PicturesReleased || orderRetainsPictures(*order, now, retention) {
+			continue
+		}
+		report.ReleasedOrders = append(report.ReleasedOrders, order.ID())
+		if dryRun {
+			continue
+		}
+		if err := releaseOrderPictures(pr.db, pr.storage, order); err != nil {
+			return report, fmt.Errorf("error releasing pictures for order %s: %v", order.ID(), err)
+		}
+		// The order may have changed since we read it, so only the marker is changed
+		if _, _, err := changeOrder(pr.db, order.ID(), func(order *types.Order) bool {
+			order.PicturesReleased = true
+			return true
+		}); err != nil {
+			return report, fmt.Errorf("error updating order %s: %v", order.ID(), err)
+		}
+		order.PicturesReleased = true
+	}
+
+	keys, err = getKeys(pr.db, "pictures")
+	if err != nil {
+		return report, fmt.Errorf("error getting pictures: %v", err)
+	}
+	pictures, err := fetchByKeys[types.Picture](pr.db, keys)
+	if err != nil {
+		return report, fmt.Errorf("error getting pictures: %v", err)
+	}
+	carts := map[string]*types.Cart{}
+	remaining := make([]types.Picture, 0, len(pictures))
+	for _, picture := range pictures {
+		if len(retainingOrders(orders, picture.PictureID, now, retention)) > 0 {
+			remaining = append(remaining, picture)
+			continue
+		}
+		if picture.DeletedAt != nil {
+			report.PurgedPictures = append(report.PurgedPictures, picture.ID())
+		} else {
+			unused, err := pr.isUnused(picture, carts, now, settings.UnusedPictureDays, dryRun)
+			if err != nil {
+				return report, err
+			}
+			if !unused {
+				remaining = append(remaining, picture)
+				continue
+			}
+			report.UnusedPictures = append(report.UnusedPictures, picture.ID())
+		}
+		if dryRun {
+			continue
+		}
+		derivatives, err := deletePictureRecords(pr.db, picture)
+		if err != nil {
+			return report, fmt.Errorf("error deleting picture %s: %v", picture.ID(), err)
+		}
+		if err := deletePictureFiles(pr.db, pr.storage, picture, derivatives); err != nil {
+			pr.logger.Warn().Err(err).Str("pictureID", picture.ID()).Msg("Error deleting picture files")
+		}
+	}
+
+	if err := pr.sweepOrphanFiles(remaining, now, dryRun, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// isUnused returns whether the picture hasn't been used within the retention period and isn't in
+// the user's cart. Pictures that have never been used start counting from the first sweep that sees
+// them
+func (pr *PictureRetention) isUnused(picture types.Picture, carts map[string]*types.Cart, now time.Time, unusedDays int, dryRun bool) (bool, error) {
+	if err := loadLastUsed(pr.db, &picture); err != nil {
+		return false, err
+	}
+	if picture.LastUsedAt == nil {
+		if dryRun {
+			return false, nil
+		}
+		return false, markPicturesUsed(pr.db, now, picture.PictureID)
+	}
+	// Uploads that are in progress count as a use
+	if unusedDays == 0 || picture.PendingUpload != nil || now.Before(picture.LastUsedAt.Add(time.Duration(unusedDays)*24*time.Hour)) {
+		return false, nil
+	}
+
+	cart, ok := carts[picture.UserID]
+	if !ok {
+		var err error
+		cart, err = fetchOne[types.Cart](pr.db, fmt.Sprintf("carts:%s", picture.UserID))
+		if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+			return false, fmt.Errorf("error getting cart: %v", err)
+		}
+		carts[picture.UserID] = cart
+	}
+	if cart != nil {
+		for _, print := range cart.Prints {
+			if print.PictureID == picture.PictureID {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// sweepOrphanFiles deletes files in the image store that none of the remaining pictures, production
+// jobs, uploads or blobs reference
+func (pr *PictureRetention) sweepOrphanFiles(pictures []types.Picture, now time.Time, dryRun bool, report *RetentionReport) error {
+	lister, ok := pr.storage.(store.ImageLister)
+	if !ok {
+		return nil
+	}
+	files, err := lister.List()
+	if err != nil {
+		return fmt.Errorf("error listing files: %v", err)
+	}
+
+	known := map[string]bool{}
+	fileKey := func(container string, id string) string {
+		return container + "/" + id
+	}
+	for _, picture := range pictures {
+		known[fileKey(pictureFile(picture))] = true
+		if picture.PendingUpload != nil {
+			known[fileKey(pendingUploadContainer, picture.PictureID)] = true
+		}
+		derivatives, err := fetchOne[pictureDerivatives](pr.db, derivativesKey(picture.PictureID))
+		if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+			return fmt.Errorf("error getting derivatives: %v", err)
+		} else if err == nil {
+			for _, derivative := range derivatives.Derivatives {
+				known[fileKey(picture.UserID, derivative.FileID)] = true
+			}
+		}
+	}
+	keys, err := getKeys(pr.db, "jobs")
+	if err != nil {
+		return fmt.Errorf("error getting jobs: %v", err)
+	}
+	jobs, err := fetchByKeys[types.ProductionJob](pr.db, keys)
+	if err != nil {
+		return fmt.Errorf("error getting jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if job.PrintFile != nil {
+			known[fileKey(job.PrintFile.Container, job.PrintFile.FileID)] = true
+		}
+	}
+	keys, err = getKeys(pr.db, "uploads")
+	if err != nil {
+		return fmt.Errorf("error getting uploads: %v", err)
+	}
+	uploads, err := fetchByKeys[types.ResumableUpload](pr.db, keys)
+	if err != nil {
+		return fmt.Errorf("error getting uploads: %v", err)
+	}
+	for _, upload := range uploads {
+		for _, chunk := range upload.Chunks {
+			known[fileKey(uploadChunkContainer, chunk.FileID)] = true
+		}
+	}
+
+	for _, file := range files {
+		if known[fileKey(file.Container, file.ID)] || now.Sub(file.ModifiedAt) < orphanFileGracePeriod {
+			continue
+		}
+		// Blobs have a record each instead of being in a list
+		if file.Container == blobContainer {
+			_, err := pr.db.Get(blobKey(file.ID))
+			if err == nil {
+				continue
+			} else if !errors.Is(err, store.ErrKeyNotFound) {
+				return fmt.Errorf("error getting blob: %v", err)
+			}
+		}
+		report.OrphanFiles = append(report.OrphanFiles, OrphanFile{Container: file.Container, ID: file.ID, Size: file.Size, ModifiedAt: file.ModifiedAt})
+		if dryRun {
+			continue
+		}
+		if err := pr.storage.Delete(file.Container, file.ID); err != nil && !errors.Is(err, store.ErrImageNotFound) {
+			return fmt.Errorf("error deleting file %s/%s: %v", file.Container, file.ID, err)
+		}
+	}
+	return nil
+}
+
+// GetCleanupReport returns what a cleanup would do right now without changing anything
+func (pr *PictureRetention) GetCleanupReport(w http.ResponseWriter, r *http.Request) {
+	pr.writeSweep(w, r, true)
+}
+
+// RunCleanup runs a cleanup immediately and returns what it did
+func (pr *PictureRetention) RunCleanup(w http.ResponseWriter, r *http.Request) {
+	pr.writeSweep(w, r, false)
+}
+
+func (pr *PictureRetention) writeSweep(w http.ResponseWriter, r *http.Request, dryRun bool) {
+	logger := httplog.LogEntry(r.Context())
+	report, err := pr.Sweep(time.Now().UTC(), dryRun)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error cleaning up pictures: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
@@ -0,0 +1,196 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestPictureRetention(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{
+		MaxSize:      17.0,
+		PrintQuality: types.PrintQualitySettings{WarnBelowDPI: 1, RejectBelowDPI: 1},
+		Costs: types.SupplyCosts{
+			ShippingProfiles: []types.ShippingProfile{{ShippingMethod: types.ShippingMethodStandard, Cost: 5, Name: "Standard"}},
+		},
+		Retention: types.RetentionSettings{OrderedPictureDays: 14},
+	})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", CostPerSquareInch: 0.25})
+
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}", pictureHandlers.CreatePicture)
+	r.Get("/pictures/{userId}/{id}", pictureHandlers.GetPictureInfo)
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	r.Delete("/pictures/{userId}/{id}", pictureHandlers.DeletePicture)
+	orderHandlers := handlers.NewOrderHandlers(db, storage, conf, &fakePayment{}, nil, nil)
+	r.Post("/orders/{userId}", orderHandlers.AddOrder)
+	r.Put("/orders/{id}", orderHandlers.UpdateOrder)
+	do := func(method string, path string, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	pictures := make([]types.Picture, 2)
+	for i := range pictures {
+		rr := do(http.MethodPost, "/pictures/u1", "application/json", []byte(`{"userId": "u1", "name": "beach"}`))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures[i]))
+		buf := new(bytes.Buffer)
+		require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 64+i, 48)), nil))
+		rr = do(http.MethodPut, "/pictures/u1/"+pictures[i].ID(), "image/jpeg", buf.Bytes())
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures[i]))
+	}
+	ordered, inCart := pictures[0], pictures[1]
+	blobPath := filepath.Join(tmpdir, "storage", "blobs", ordered.Hash)
+
+	putCart(t, db, types.Cart{
+		UserID: "u1",
+		Prints: []types.Print{{PictureID: ordered.ID(), PaperTypeID: "1", Width: 8, Height: 10, Cost: 20, Quantity: 1}},
+	})
+	rr := do(http.MethodPost, "/orders/u1", "application/json", []byte(`{"shippingProfile": {"shippingMethod": "standard"}}`))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var order types.Order
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&order))
+	putCart(t, db, types.Cart{
+		UserID: "u1",
+		Prints: []types.Print{{PictureID: inCart.ID(), PaperTypeID: "1", Width: 8, Height: 10, Cost: 20, Quantity: 1}},
+	})
+
+	rr = do(http.MethodDelete, "/pictures/u1/"+inCart.ID(), "", nil)
+	require.Equal(t, http.StatusConflict, rr.Code, "pictures in the cart shouldn't be deleted: %s", rr.Body.String())
+
+	// Pictures that orders need are hidden instead of deleted
+	rr = do(http.MethodDelete, "/pictures/u1/"+ordered.ID(), "", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = do(http.MethodGet, "/pictures/u1/"+ordered.ID(), "", nil)
+	require.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+	_, err = db.Get("pictures:" + ordered.ID())
+	require.NoError(t, err, "the picture should be kept for the order")
+	require.FileExists(t, blobPath)
+
+	retention := handlers.NewPictureRetention(db, storage, conf, zerolog.Nop(), time.Hour)
+	report, err := retention.Sweep(time.Now().UTC(), false)
+	require.NoError(t, err)
+	require.Empty(t, report.ReleasedOrders, "the order hasn't been delivered")
+	require.Empty(t, report.PurgedPictures)
+
+	deliveredAt := time.Now().UTC().Add(-10 * 24 * time.Hour)
+	order = getOrder(t, db, order.ID())
+	order.HasShipped, order.IsDelivered, order.DeliveredAt = true, true, &deliveredAt
+	putOrders(t, db, order)
+	report, err = retention.Sweep(time.Now().UTC(), false)
+	require.NoError(t, err)
+	require.Empty(t, report.PurgedPictures, "the order was delivered within the retention period")
+
+	report, err = retention.Sweep(time.Now().UTC().Add(5*24*time.Hour), false)
+	require.NoError(t, err)
+	require.Equal(t, []string{order.ID()}, report.ReleasedOrders)
+	require.Equal(t, []string{ordered.ID()}, report.PurgedPictures)
+	_, err = db.Get("pictures:" + ordered.ID())
+	require.ErrorIs(t, err, store.ErrKeyNotFound)
+	require.NoFileExists(t, blobPath)
+
+	// Admins editing the order can't undo its payment, delivery or release
+	update, err := json.Marshal(types.Order{OrderID: order.ID(), UserID: "u1", Prints: order.Prints})
+	require.NoError(t, err)
+	rr = do(http.MethodPut, "/orders/"+order.ID(), "application/json", update)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	order = getOrder(t, db, order.ID())
+	require.True(t, order.PicturesReleased)
+	require.True(t, order.IsDelivered)
+	require.Equal(t, deliveredAt.Unix(), order.DeliveredAt.Unix())
+	report, err = retention.Sweep(time.Now().UTC().Add(5*24*time.Hour), false)
+	require.NoError(t, err)
+	require.Empty(t, report.ReleasedOrders, "the order's pictures were already released")
+}
+
+func TestPictureCleanup(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := store.NewDiskDataStore(filepath.Join(tmpdir, "test.db"))
+	require.NoError(t, err)
+	storage := store.NewDiskImageStore(filepath.Join(tmpdir, "storage"))
+	conf := &atomic.Value{}
+	conf.Store(types.Config{Retention: types.RetentionSettings{UnusedPictureDays: 30}})
+
+	pictureHandlers := handlers.NewPictureHandlers(db, storage, conf, nil, nil)
+	r := chi.NewRouter()
+	r.Post("/pictures/{userId}", pictureHandlers.CreatePicture)
+	r.Put("/pictures/{userId}/{id}", pictureHandlers.UploadPicture)
+	pictures := make([]types.Picture, 2)
+	for i := range pictures {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/pictures/u1", bytes.NewBufferString(`{"userId": "u1", "name": "beach"}`))
+		r.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures[i]))
+		buf := new(bytes.Buffer)
+		require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 64+i, 48)), nil))
+		rr = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPut, "/pictures/u1/"+pictures[i].ID(), buf)
+		req.Header.Set("Content-Type", "image/jpeg")
+		r.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&pictures[i]))
+		require.NotNil(t, pictures[i].LastUsedAt, "uploading should count as a use")
+	}
+	unused, inCart := pictures[0], pictures[1]
+	putCart(t, db, types.Cart{UserID: "u1", Prints: []types.Print{{PictureID: inCart.ID(), PaperTypeID: "1"}}})
+
+	// A file left behind by something that failed partway through
+	_, err = storage.Set("u1", "stray", 5, io.NopCloser(bytes.NewBufferString("stray")))
+	require.NoError(t, err)
+	strayPath := filepath.Join(tmpdir, "storage", "u1", "stray")
+	unusedPath := filepath.Join(tmpdir, "storage", "blobs", unused.Hash)
+
+	retention := handlers.NewPictureRetention(db, storage, conf, zerolog.Nop(), time.Hour)
+	report, err := retention.Sweep(time.Now().UTC().Add(10*24*time.Hour), true)
+	require.NoError(t, err)
+	require.Empty(t, report.UnusedPictures, "the pictures were used recently")
+	require.Len(t, report.OrphanFiles, 1)
+	require.Equal(t, "stray", report.OrphanFiles[0].ID)
+
+	later := time.Now().UTC().Add(40 * 24 * time.Hour)
+	report, err = retention.Sweep(later, true)
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Equal(t, []string{unused.ID()}, report.UnusedPictures, "pictures in the cart aren't unused")
+	require.Len(t, report.OrphanFiles, 1)
+	require.FileExists(t, strayPath, "dry runs shouldn't delete anything")
+	require.FileExists(t, unusedPath)
+
+	report, err = retention.Sweep(later, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{unused.ID()}, report.UnusedPictures)
+	require.NoFileExists(t, strayPath)
+	require.NoFileExists(t, unusedPath)
+	require.FileExists(t, filepath.Join(tmpdir, "storage", "blobs", inCart.Hash))
+	_, err = db.Get("pictures:" + unused.ID())
+	require.ErrorIs(t, err, store.ErrKeyNotFound)
+}
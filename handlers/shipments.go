@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// carrierFormat is a tracking number format that identifies a carrier
+type carrierFormat struct {
+	carrier types.Carrier
+	format  *regexp.Regexp
+}
+
+// carrierFormats are checked in order, so more specific formats need to come first
+var carrierFormats = []carrierFormat{
+	{carrier: types.CarrierUPS, format: regexp.MustCompile(`^1Z[0-9A-Z]{16}$`)},
+	{carrier: types.CarrierUSPS, format: regexp.MustCompile(`^(9[1-5]\d{20}|9[1-5]\d{24}|[A-Z]{2}\d{9}US)$`)},
+	{carrier: types.CarrierDHL, format: regexp.MustCompile(`^(JD\d{18}|\d{10})$`)},
+	{carrier: types.CarrierFedEx, format: regexp.MustCompile(`^(\d{12}|\d{15}|\d{20})$`)},
+}
+
+// trackingURLs are the tracking page URLs for each carrier, with %s for the tracking number
+var trackingURLs = map[types.Carrier]string{
+	types.CarrierUSPS:  "https://tools.usps.com/go/TrackConfirmAction?tLabels=%s",
+	types.CarrierUPS:   "https://www.ups.com/track?tracknum=%s",
+	types.CarrierFedEx: "https://www.fedex.com/fedextrack/?trknbr=%s",
+	types.CarrierDHL:   "https://www.dhl.com/en/express/tracking.html?AWB=%s",
+}
+
+// ShipmentRequest is the body for adding a shipment to an order. Carrier is detected from the
+// tracking number if it isn't given and ShippedAt defaults to now
+type ShipmentRequest struct {
+	Carrier        types.Carrier `json:"carrier"`
+	TrackingNumber string        `json:"trackingNumber"`
+	ShippedAt      *time.Time    `json:"shippedAt"`
+}
+
+// AddShipment records a shipment for an order and marks the order as shipped. Orders can have
+// multiple shipments if they are split across packages
+func (o *OrderHandlers) AddShipment(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	orderID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("orderID", orderID).Logger()
+
+	var body ShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("body is not valid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	shipment, err := newShipment(body)
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusBadRequest)
+		return
+	}
+
+	orderKey := fmt.Sprintf("orders:%s", orderID)
+	order, err := fetchOne[types.Order](o.db, orderKey)
+	if errors.Is(err, store.ErrKeyNotFound) || (order != nil && order.UserID != userID) {
+		writeHttpError(r.Context(), w, fmt.Errorf("order not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting order: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	order, shipped, err := changeOrder(o.db, orderID, func(order *types.Order) bool {
+		if !order.IsPaid {
+			return false
+		}
+		order.ShippingDetails.Shipments = append(order.ShippingDetails.Shipments, shipment)
+		if order.ShippingDetails.TrackingNumber == nil {
+			order.ShippingDetails.TrackingNumber = &shipment.TrackingNumber
+		}
+		order.HasShipped = true
+		return true
+	})
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	} else if !shipped {
+		writeHttpError(r.Context(), w, fmt.Errorf("order has not been paid and cannot be shipped"), http.StatusConflict)
+		return
+	}
+
+	logger.Info().Str("carrier", string(shipment.Carrier)).Msg("Added shipment to order")
+	o.notifier.Notify(types.NotificationOrderShipped, *order, &shipment)
+	o.webhooks.Publish(types.WebhookOrderShipped, order)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// newShipment validates the request and fills in the carrier, tracking URL and shipped time
+func newShipment(req ShipmentRequest) (types.Shipment, error) {
+	trackingNumber := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(req.TrackingNumber), " ", ""))
+	if trackingNumber == "" {
+		return types.Shipment{}, errors.New("tracking number is required")
+	}
+
+	carrier := req.Carrier
+	if carrier == "" {
+		carrier = detectCarrier(trackingNumber)
+	} else if _, ok := trackingURLs[carrier]; !ok && carrier != types.CarrierOther {
+		return types.Shipment{}, fmt.Errorf("unknown carrier %s", carrier)
+	}
+
+	shipment := types.Shipment{
+		Carrier:        carrier,
+		TrackingNumber: trackingNumber,
+		ShippedAt:      time.Now().UTC(),
+	}
+	if req.ShippedAt != nil {
+		shipment.ShippedAt = req.ShippedAt.UTC()
+	}
+	if format, ok := trackingURLs[carrier]; ok {
+		shipment.TrackingURL = fmt.Sprintf(format, url.QueryEscape(trackingNumber))
+	}
+	return shipment, nil
+}
+
+// detectCarrier returns the carrier for the tracking number's format, or CarrierOther if it isn't
+// recognized
+func detectCarrier(trackingNumber string) types.Carrier {
+	for _, format := range carrierFormats {
+		if format.format.MatchString(trackingNumber) {
+			return format.carrier
+		}
+	}
+	return types.CarrierOther
+}
+
+// MarkDelivered marks a shipped order as delivered
+func (o *OrderHandlers) MarkDelivered(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	orderID := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Str("orderID", orderID).Logger()
+
+	orderKey := fmt.Sprintf("orders:%s", orderID)
+	order, err := fetchOne[types.Order](o.db, orderKey)
+	if errors.Is(err, store.ErrKeyNotFound) || (order != nil && order.UserID != userID) {
+		writeHttpError(r.Context(), w, fmt.Errorf("order not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting order: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !order.HasShipped {
+		writeHttpError(r.Context(), w, fmt.Errorf("order has not shipped and cannot be delivered"), http.StatusConflict)
+		return
+	}
+
+	order, delivered, err := changeOrder(o.db, orderID, func(order *types.Order) bool {
+		if order.IsDelivered {
+			return false
+		}
+		deliveredAt := time.Now().UTC()
+		order.IsDelivered = true
+		order.DeliveredAt = &deliveredAt
+		return true
+	})
+	if err != nil {
+		writeHttpError(r.Context(), w, err, http.StatusInternalServerError)
+		return
+	}
+	// Only the first request to mark it delivered says so
+	if delivered {
+		o.notifier.Notify(types.NotificationOrderDelivered, *order, nil)
+		o.webhooks.Publish(types.WebhookOrderDelivered, order)
+	}
+
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// squareMetersPerSquareInch is used to convert print area to the area paper weight is given in
+const squareMetersPerSquareInch = 0.00064516
+
+// ShippingQuote is the cost of shipping a set of prints with a single shipping profile
+type ShippingQuote struct {
+	ShippingMethod types.ShippingMethod      `json:"shippingMethod"`
+	Zone           string                    `json:"zone,omitempty"`
+	Name           string                    `json:"name"`
+	Kind           types.ShippingProfileKind `json:"kind"`
+	// Whether the method can be used for the prints. If not, the reason is set and the cost is
+	// meaningless
+	Available bool                     `json:"available"`
+	Reason    string                   `json:"reason,omitempty"`
+	Cost      float64                  `json:"cost"`
+	Breakdown []types.ShippingCostLine `json:"breakdown"`
+}
+
+type ShippingHandlers struct {
+	db   store.DataStore
+	conf *atomic.Value
+}
+
+func NewShippingHandlers(db store.DataStore, conf *atomic.Value) *ShippingHandlers {
+	return &ShippingHandlers{db: db, conf: conf}
+}
+
+// GetShippingQuotes returns a quote for every shipping method available for the contents of the
+// user's cart. The destination can be given with the country, state and postalCode query
+// parameters, otherwise the default shipping profiles are quoted
+func (s *ShippingHandlers) GetShippingQuotes(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+
+	cart, err := fetchOne[types.Cart](s.db, fmt.Sprintf("carts:%s", userID))
+	if errors.Is(err, store.ErrKeyNotFound) || (cart != nil && len(cart.Prints) == 0) {
+		writeHttpError(r.Context(), w, fmt.Errorf("cart is empty, unable to quote shipping"), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting cart: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	conf := loadConfig(s.conf)
+	for i := range cart.Prints {
+		paper, err := normalizePrint(s.db, conf, &cart.Prints[i])
+		if err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("print %d in cart is not valid: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		cart.Prints[i].Paper = paper
+	}
+
+	zone := types.ShippingZone{ShippingProfiles: conf.Costs.ShippingProfiles}
+	if country := r.URL.Query().Get("country"); country != "" {
+		zone, err = zoneForDestination(conf, country, r.URL.Query().Get("state"), r.URL.Query().Get("postalCode"))
+		if err != nil {
+			writeHttpError(r.Context(), w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	quotes := make([]ShippingQuote, len(zone.ShippingProfiles))
+	for i, profile := range zone.ShippingProfiles {
+		quotes[i] = quoteShipping(profile, cart.Prints)
+		quotes[i].Zone = zone.Name
+	}
+
+	if err := json.NewEncoder(w).Encode(quotes); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// quoteShipping calculates the cost of shipping the prints with the given profile. The prints must
+// have their paper set for weight based profiles
+func quoteShipping(profile types.ShippingProfile, prints []types.Print) ShippingQuote {
+	quote := ShippingQuote{
+		ShippingMethod: profile.ShippingMethod,
+		Name:           profile.Name,
+		Kind:           profile.Kind,
+		Available:      true,
+		Breakdown:      []types.ShippingCostLine{},
+	}
+	if quote.Kind == "" {
+		quote.Kind = types.ShippingProfileKindFlat
+	}
+
+	var count uint
+	var subtotal float64
+	for _, print := range prints {
+		count += print.Count()
+		subtotal += print.TotalCost()
+	}
+
+	addLine := func(description string, amount float64) {
+		quote.Breakdown = append(quote.Breakdown, types.ShippingCostLine{Description: description, Amount: roundCents(amount)})
+		quote.Cost += roundCents(amount)
+	}
+
+	switch quote.Kind {
+	case types.ShippingProfileKindFlat:
+		addLine(profile.Name, profile.Cost)
+	case types.ShippingProfileKindPerItem:
+		addLine("Base cost", profile.Cost)
+		addLine(fmt.Sprintf("%d prints at %.2f each", count, profile.CostPerItem), profile.CostPerItem*float64(count))
+	case types.ShippingProfileKindWeightTiered:
+		var grams float64
+		for _, print := range prints {
+			grams += printWeightGrams(print)
+		}
+		tier := -1
+		for i, t := range profile.WeightTiers {
+			if grams <= t.MaxGrams {
+				tier = i
+				break
+			}
+		}
+		if tier == -1 {
+			quote.Available = false
+			quote.Reason = fmt.Sprintf("prints weigh %.0fg which is more than %s allows", grams, profile.Name)
+			return quote
+		}
+		addLine(fmt.Sprintf("%.0fg (up to %.0fg)", grams, profile.WeightTiers[tier].MaxGrams), profile.WeightTiers[tier].Cost)
+	case types.ShippingProfileKindFreeOverThreshold:
+		if roundCents(subtotal) >= profile.FreeOver {
+			addLine(fmt.Sprintf("Free shipping on orders of %.2f or more", profile.FreeOver), 0)
+		} else {
+			addLine(profile.Name, profile.Cost)
+		}
+	default:
+		quote.Available = false
+		quote.Reason = fmt.Sprintf("unknown shipping profile kind %s", profile.Kind)
+	}
+
+	quote.Cost = roundCents(quote.Cost)
+	return quote
+}
+
+// zoneForDestination returns the first zone that matches the destination. Without any zones, every
+// destination gets a zone with no name and the default shipping profiles. Once zones are configured
+// we only ship to the destinations in them, so an error is returned if none match
+func zoneForDestination(conf types.Config, country string, state string, postalCode string) (types.ShippingZone, error) {
+	if len(conf.ShippingZones) == 0 {
+		return types.ShippingZone{ShippingProfiles: conf.Costs.ShippingProfiles}, nil
+	}
+	country = strings.ToUpper(strings.TrimSpace(country))
+	state = strings.ToUpper(strings.TrimSpace(state))
+	postalCode = normalizePostalCode(postalCode)
+	for _, zone := range conf.ShippingZones {
+		if zoneMatches(zone, country, state, postalCode) {
+			return zone, nil
+		}
+	}
+	destination := country
+	if state != "" {
+		destination = fmt.Sprintf("%s, %s", state, country)
+	}
+	if postalCode != "" {
+		destination = fmt.Sprintf("%s %s", destination, postalCode)
+	}
+	return types.ShippingZone{}, fmt.Errorf("we don't ship to %s", destination)
+}
+
+func zoneMatches(zone types.ShippingZone, country string, state string, postalCode string) bool {
+	if !containsFold(zone.Countries, country) {
+		return false
+	}
+	if len(zone.States) > 0 && !containsFold(zone.States, state) {
+		return false
+	}
+	if len(zone.PostalCodeRanges) > 0 {
+		for _, postalRange := range zone.PostalCodeRanges {
+			if postalCode >= normalizePostalCode(postalRange.From) && postalCode <= normalizePostalCode(postalRange.To) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// normalizePostalCode upper cases the postal code and removes spaces so codes can be compared
+func normalizePostalCode(postalCode string) string {
+	return strings.ToUpper(strings.ReplaceAll(postalCode, " ", ""))
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// printWeightGrams returns the weight of all copies of the print. Prints without a paper or papers
+// without a weight are counted as weightless
+func printWeightGrams(print types.Print) float64 {
+	if print.Paper == nil {
+		return 0
+	}
+	return print.Width * print.Height * squareMetersPerSquareInch * print.Paper.GramsPerSquareMeter * float64(print.Count())
+}
+
+// validateShippingProfile checks that the profile has everything needed for its kind
+func validateShippingProfile(profile types.ShippingProfile) error {
+	if profile.ShippingMethod == "" {
+		return errors.New("shipping method is required")
+	}
+	if profile.Cost < 0 || profile.CostPerItem < 0 || profile.FreeOver < 0 {
+		return fmt.Errorf("costs for %s cannot be negative", profile.ShippingMethod)
+	}
+	switch profile.Kind {
+	case "", types.ShippingProfileKindFlat, types.ShippingProfileKindPerItem, types.ShippingProfileKindFreeOverThreshold:
+	case types.ShippingProfileKindWeightTiered:
+		if len(profile.WeightTiers) == 0 {
+			return fmt.Errorf("weight tiered profile for %s must have at least one tier", profile.ShippingMethod)
+		}
+		if !sort.SliceIsSorted(profile.WeightTiers, func(i, j int) bool {
+			return profile.WeightTiers[i].MaxGrams < profile.WeightTiers[j].MaxGrams
+		}) {
+			return fmt.Errorf("weight tiers for %s must be sorted from lightest to heaviest", profile.ShippingMethod)
+		}
+	default:
+		return fmt.Errorf("unknown shipping profile kind %s", profile.Kind)
+	}
+	return nil
+}
+
+// validateShippingProfiles validates each profile and checks that no two profiles have the same
+// shipping method. Orders pick their profile by shipping method, so a duplicate would be quoted at
+// one price and charged at another
+func validateShippingProfiles(profiles []types.ShippingProfile) error {
+	seen := make(map[types.ShippingMethod]bool, len(profiles))
+	for _, profile := range profiles {
+		if err := validateShippingProfile(profile); err != nil {
+			return err
+		}
+		if seen[profile.ShippingMethod] {
+			return fmt.Errorf("shipping method %s has more than one profile", profile.ShippingMethod)
+		}
+		seen[profile.ShippingMethod] = true
+	}
+	return nil
+}
+
+// validateShippingZone checks that the zone can match destinations and has valid profiles
+func validateShippingZone(zone types.ShippingZone) error {
+	if zone.Name == "" {
+		return errors.New("zone name is required")
+	}
+	if len(zone.Countries) == 0 {
+		return fmt.Errorf("zone %s must have at least one country", zone.Name)
+	}
+	for _, postalRange := range zone.PostalCodeRanges {
+		if normalizePostalCode(postalRange.From) > normalizePostalCode(postalRange.To) {
+			return fmt.Errorf("postal code range %s to %s in zone %s is backwards", postalRange.From, postalRange.To, zone.Name)
+		}
+	}
+	if err := validateShippingProfiles(zone.ShippingProfiles); err != nil {
+		return fmt.Errorf("invalid shipping profile in zone %s: %v", zone.Name, err)
+	}
+	return nil
+}
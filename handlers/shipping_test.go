@@ -0,0 +1,194 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestShippingQuotes(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	conf := &atomic.Value{}
+	conf.Store(types.Config{
+		MaxSize: 20,
+		Costs: types.SupplyCosts{
+			InkPerSquareInch: 0.25,
+			ShippingProfiles: []types.ShippingProfile{
+				{ShippingMethod: types.ShippingMethodStandard, Name: "Standard", Cost: 5},
+				{ShippingMethod: "per-print", Kind: types.ShippingProfileKindPerItem, Name: "Per print", Cost: 2, CostPerItem: 1.5},
+				{ShippingMethod: types.ShippingMethodExpress, Kind: types.ShippingProfileKindWeightTiered, Name: "Express", WeightTiers: []types.WeightTier{
+					{MaxGrams: 10, Cost: 4},
+					{MaxGrams: 100, Cost: 9},
+				}},
+				{ShippingMethod: types.ShippingMethodOvernight, Kind: types.ShippingProfileKindWeightTiered, Name: "Overnight", WeightTiers: []types.WeightTier{
+					{MaxGrams: 10, Cost: 20},
+				}},
+				{ShippingMethod: "economy", Kind: types.ShippingProfileKindFreeOverThreshold, Name: "Free over 50", Cost: 6, FreeOver: 50},
+			},
+		},
+	})
+	// 8x10 prints on this paper weigh about 12.9g each
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre", GramsPerSquareMeter: 250})
+	putCart(t, db, types.Cart{
+		UserID: "u1",
+		Prints: []types.Print{{PictureID: "1", PaperTypeID: "1", Width: 8, Height: 10, Quantity: 3}},
+	})
+
+	r := chi.NewRouter()
+	r.Get("/carts/{userId}/shipping", handlers.NewShippingHandlers(db, conf).GetShippingQuotes)
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/carts/u1/shipping", nil))
+	require.Equal(t, http.StatusOK, recorder.Code, "expected status code 200, got %d: %s", recorder.Code, recorder.Body)
+
+	var quotes []handlers.ShippingQuote
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&quotes))
+	require.Len(t, quotes, 5)
+
+	require.Equal(t, types.ShippingProfileKindFlat, quotes[0].Kind)
+	require.Equal(t, 5.0, quotes[0].Cost)
+
+	require.Equal(t, 6.5, quotes[1].Cost)
+	require.Len(t, quotes[1].Breakdown, 2)
+
+	require.True(t, quotes[2].Available)
+	require.Equal(t, 9.0, quotes[2].Cost)
+
+	require.False(t, quotes[3].Available, "prints are too heavy for overnight")
+	require.NotEmpty(t, quotes[3].Reason)
+
+	// 3 prints at 80 sq in of ink each is 60 which is over the free shipping threshold
+	require.Equal(t, 0.0, quotes[4].Cost)
+}
+
+func putCart(t *testing.T, db store.DataStore, cart types.Cart) {
+	buf := new(bytes.Buffer)
+	require.NoError(t, gob.NewEncoder(buf).Encode(cart))
+	require.NoError(t, db.Set("carts:"+cart.UserID, buf.Bytes()))
+}
+
+func TestShippingZones(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	conf := &atomic.Value{}
+	conf.Store(types.Config{
+		MaxSize: 20,
+		Costs: types.SupplyCosts{
+			ShippingProfiles: []types.ShippingProfile{
+				{ShippingMethod: types.ShippingMethodStandard, Name: "Standard", Cost: 5},
+				{ShippingMethod: types.ShippingMethodExpress, Name: "Express", Cost: 15},
+			},
+		},
+		ShippingZones: []types.ShippingZone{
+			{
+				Name:             "Alaska and Hawaii",
+				Countries:        []string{"US"},
+				States:           []string{"AK", "HI"},
+				ShippingProfiles: []types.ShippingProfile{{ShippingMethod: types.ShippingMethodStandard, Name: "Standard", Cost: 12}},
+			},
+			{
+				Name:             "Bay Area",
+				Countries:        []string{"US"},
+				PostalCodeRanges: []types.PostalCodeRange{{From: "94000", To: "95199"}},
+				ShippingProfiles: []types.ShippingProfile{
+					{ShippingMethod: types.ShippingMethodStandard, Name: "Local", Cost: 2},
+					{ShippingMethod: types.ShippingMethodExpress, Name: "Courier", Cost: 8},
+				},
+			},
+		},
+	})
+	putPaper(t, db, types.PaperType{PaperID: "1", Name: "Lustre"})
+	uploadedAt := time.Now().UTC()
+	putPicture(t, db, types.Picture{PictureID: "1", UserID: "u1", UploadedAt: &uploadedAt})
+	putCart(t, db, types.Cart{
+		UserID: "u1",
+		Prints: []types.Print{{PictureID: "1", PaperTypeID: "1", Width: 8, Height: 10}},
+	})
+
+	r := chi.NewRouter()
+	r.Get("/carts/{userId}/shipping", handlers.NewShippingHandlers(db, conf).GetShippingQuotes)
+	r.Post("/orders/{userId}", handlers.NewOrderHandlers(db, nil, conf, &fakePayment{}, nil, nil).AddOrder)
+
+	getQuotes := func(query string) []handlers.ShippingQuote {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/carts/u1/shipping?"+query, nil))
+		require.Equal(t, http.StatusOK, recorder.Code, "expected status code 200, got %d: %s", recorder.Code, recorder.Body)
+		var quotes []handlers.ShippingQuote
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(&quotes))
+		return quotes
+	}
+
+	quotes := getQuotes("country=US&state=hi&postalCode=96801")
+	require.Len(t, quotes, 1)
+	require.Equal(t, "Alaska and Hawaii", quotes[0].Zone)
+	require.Equal(t, 12.0, quotes[0].Cost)
+
+	quotes = getQuotes("country=US&state=CA&postalCode=94105")
+	require.Len(t, quotes, 2)
+	require.Equal(t, "Bay Area", quotes[0].Zone)
+	require.Equal(t, 8.0, quotes[1].Cost)
+
+	// Destinations outside of every zone can't be shipped to
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/carts/u1/shipping?country=US&state=NY&postalCode=10001", nil))
+	require.Equal(t, http.StatusBadRequest, recorder.Code, "expected status code 400, got %d: %s", recorder.Code, recorder.Body)
+	require.Contains(t, recorder.Body.String(), "we don't ship to NY, US 10001")
+	recorder = httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"shippingProfile": {"shippingMethod": "standard"}, "address": {"name": "A Customer", "line1": "1 Main St", "city": "Ottawa", "state": "ON", "postalCode": "K1A 0A6", "country": "CA"}}`)
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/orders/u1", body))
+	require.Equal(t, http.StatusBadRequest, recorder.Code, "expected status code 400, got %d: %s", recorder.Code, recorder.Body)
+	require.Contains(t, recorder.Body.String(), "we don't ship to ON, CA K1A0A6")
+
+	// Express isn't available in Hawaii so the order should be rejected
+	recorder = httptest.NewRecorder()
+	body = bytes.NewBufferString(`{"shippingProfile": {"shippingMethod": "express"}, "address": {"name": "A Customer", "line1": "1 Main St", "city": "Honolulu", "state": "HI", "postalCode": "96801", "country": "US"}}`)
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/orders/u1", body))
+	require.Equal(t, http.StatusBadRequest, recorder.Code, "expected status code 400, got %d: %s", recorder.Code, recorder.Body)
+	require.Contains(t, recorder.Body.String(), "not available in Alaska and Hawaii")
+}
+
+func TestDuplicateShippingMethods(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	conf := &atomic.Value{}
+	conf.Store(types.Config{})
+	r := chi.NewRouter()
+	r.Put("/config", handlers.NewConfigHandlers(db, conf).PutConfig)
+	putConfig := func(config types.Config) *httptest.ResponseRecorder {
+		buf := new(bytes.Buffer)
+		require.NoError(t, json.NewEncoder(buf).Encode(config))
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/config", buf))
+		return recorder
+	}
+
+	profiles := []types.ShippingProfile{
+		{ShippingMethod: types.ShippingMethodStandard, Name: "Standard", Cost: 5},
+		{ShippingMethod: types.ShippingMethodStandard, Kind: types.ShippingProfileKindFreeOverThreshold, Name: "Free over 50", Cost: 6, FreeOver: 50},
+	}
+	recorder := putConfig(types.Config{Costs: types.SupplyCosts{ShippingProfiles: profiles}})
+	require.Equal(t, http.StatusBadRequest, recorder.Code, "expected status code 400, got %d: %s", recorder.Code, recorder.Body)
+	recorder = putConfig(types.Config{ShippingZones: []types.ShippingZone{{Name: "US", Countries: []string{"US"}, ShippingProfiles: profiles}}})
+	require.Equal(t, http.StatusBadRequest, recorder.Code, "expected status code 400, got %d: %s", recorder.Code, recorder.Body)
+
+	// The same method can have different profiles in different zones
+	recorder = putConfig(types.Config{
+		Costs:         types.SupplyCosts{ShippingProfiles: profiles[:1]},
+		ShippingZones: []types.ShippingZone{{Name: "US", Countries: []string{"US"}, ShippingProfiles: profiles[1:]}},
+	})
+	require.Equal(t, http.StatusOK, recorder.Code, "expected status code 200, got %d: %s", recorder.Code, recorder.Body)
+}
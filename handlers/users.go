@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
 	"github.com/thomastaylor312/printing-api/store"
 	"github.com/thomastaylor312/printing-api/types"
 )
@@ -36,3 +41,63 @@ func (u *UserHandlers) UpdateUser(w http.ResponseWriter, r *http.Request) {
 func (u *UserHandlers) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	delete[*types.User](u.db, "users", w, r, nil)
 }
+
+// GetUserAddresses gets the saved shipping addresses for a user
+func (u *UserHandlers) GetUserAddresses(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	user, err := fetchOne[types.User](u.db, "users:"+userID)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("user not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	addresses := user.Addresses
+	if addresses == nil {
+		addresses = []types.Address{}
+	}
+	if err := json.NewEncoder(w).Encode(addresses); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// PutUserAddresses replaces the saved shipping addresses for a user. Every address is validated
+// before any are saved
+func (u *UserHandlers) PutUserAddresses(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userId")
+	logger := httplog.LogEntry(r.Context()).With().Str("userID", userID).Logger()
+	var addresses []types.Address
+	if err := json.NewDecoder(r.Body).Decode(&addresses); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("body is not valid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	for i, address := range addresses {
+		normalized, err := normalizeAddress(address)
+		if err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("address %d is not valid: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		addresses[i] = normalized
+	}
+
+	user, err := fetchOne[types.User](u.db, "users:"+userID)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("user not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	user.Addresses = addresses
+	if err := storeOne(u.db, "users:"+userID, user); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating user: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(addresses); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
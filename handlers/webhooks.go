@@ -0,0 +1,595 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httplog"
+	"github.com/rs/zerolog"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// The number of deliveries kept in the log for each subscription. Older deliveries are removed
+	// as new ones are added
+	maxWebhookDeliveries = 100
+	// The number of deliveries sent at once. A worker waits between a delivery's attempts, so slow
+	// receivers delay the others instead of piling up goroutines
+	webhookWorkers = 4
+	// The number of deliveries that can be waiting for a worker. Deliveries that don't fit stay
+	// pending and are queued by a later sweep
+	webhookQueueSize     = 100
+	webhookSweepInterval = time.Minute
+)
+
+// webhookEvents are all the events that can be subscribed to
+var webhookEvents = map[types.WebhookEvent]bool{
+	types.WebhookOrderCreated:    true,
+	types.WebhookOrderPaid:       true,
+	types.WebhookOrderShipped:    true,
+	types.WebhookOrderDelivered:  true,
+	types.WebhookCartUpdated:     true,
+	types.WebhookPictureUploaded: true,
+}
+
+// WebhookPayload is the body sent to subscriptions
+type WebhookPayload struct {
+	Event     types.WebhookEvent `json:"event"`
+	CreatedAt time.Time          `json:"createdAt"`
+	Data      any                `json:"data"`
+}
+
+// WebhookSignature returns the signature sent in the X-Webhook-Signature header. It is the hex
+// encoded HMAC-SHA256 of the timestamp header, a period and the body, keyed with the subscription
+// secret. Receivers should compute the same value and reject requests where it doesn't match
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher sends events to webhook subscriptions and records every delivery. A nil
+// WebhookDispatcher doesn't send anything
+type WebhookDispatcher struct {
+	db          store.DataStore
+	client      *http.Client
+	logger      zerolog.Logger
+	maxAttempts int
+	backoff     time.Duration
+
+	jobs chan webhookJob
+
+	// logLock protects the delivery logs, which are updated from multiple goroutines
+	logLock sync.Mutex
+	// The keys of the deliveries that are queued or being sent so sweeps don't queue them twice
+	queued sync.Map
+}
+
+type webhookJob struct {
+	sub types.WebhookSubscription
+	key string
+}
+
+// NewWebhookDispatcher creates a dispatcher that tries each delivery up to maxAttempts times,
+// doubling the wait between attempts starting from backoff
+func NewWebhookDispatcher(db store.DataStore, logger zerolog.Logger, maxAttempts int, backoff time.Duration) *WebhookDispatcher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &WebhookDispatcher{
+		db:          db,
+		client:      &http.Client{Timeout: webhookTimeout},
+		logger:      logger,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		jobs:        make(chan webhookJob, webhookQueueSize),
+	}
+}
+
+// Start sends queued deliveries in the background until the context is cancelled. Nothing is sent
+// until it is started. Pending deliveries that aren't queued, because the queue was full or they
+// were still being sent when the process last stopped, are swept up when it starts and then
+// periodically. They are sent again from the first attempt like a redelivery. Deliveries for
+// subscriptions that have since been disabled are marked as failed so they can be redelivered later
+func (d *WebhookDispatcher) Start(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(webhookSweepInterval)
+		defer ticker.Stop()
+		for {
+			resumed, err := d.resumePending()
+			if err != nil {
+				d.logger.Error().Err(err).Msg("Error resuming pending webhook deliveries")
+			}
+			if resumed > 0 {
+				d.logger.Info().Int("resumed", resumed).Msg("Resumed pending webhook deliveries")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-d.jobs:
+					d.send(ctx, job)
+					d.queued.Delete(job.key)
+				}
+			}
+		}()
+	}
+}
+
+// queue queues the delivery to be sent. It returns false if the queue is full, in which case the
+// delivery is left pending for a later sweep
+func (d *WebhookDispatcher) queue(sub types.WebhookSubscription, delivery *types.WebhookDelivery) bool {
+	key := fmt.Sprintf("%s:%s", deliveriesKey(sub.WebhookID), delivery.DeliveryID)
+	// This is recorded first so the job can't be finished before it is
+	if _, loaded := d.queued.LoadOrStore(key, struct{}{}); loaded {
+		return true
+	}
+	select {
+	case d.jobs <- webhookJob{sub: sub, key: key}:
+		return true
+	default:
+		d.queued.Delete(key)
+		return false
+	}
+}
+
+// send sends a queued delivery. It is read again first, since a sweep can queue a delivery that was
+// finished after the sweep read it
+func (d *WebhookDispatcher) send(ctx context.Context, job webhookJob) {
+	delivery, err := fetchOne[types.WebhookDelivery](d.db, job.key)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return
+	} else if err != nil {
+		d.logger.Error().Err(err).Str("webhookID", job.sub.WebhookID).Msg("Error getting webhook delivery")
+		return
+	}
+	if delivery.Status != types.WebhookDeliveryPending {
+		return
+	}
+	d.deliver(ctx, job.sub, delivery)
+}
+
+// resumePending queues the pending deliveries that aren't already queued and returns how many were
+// queued. It stops early if the queue fills up
+func (d *WebhookDispatcher) resumePending() (int, error) {
+	keys, err := getKeys(d.db, "webhooks")
+	if err != nil {
+		return 0, fmt.Errorf("error getting webhook subscriptions: %v", err)
+	}
+	subscriptions, err := fetchByKeys[types.WebhookSubscription](d.db, keys)
+	if err != nil {
+		return 0, fmt.Errorf("error getting webhook subscriptions: %v", err)
+	}
+	resumed := 0
+	for _, sub := range subscriptions {
+		deliveryKeys, err := getKeys(d.db, deliveriesKey(sub.WebhookID))
+		if err != nil {
+			return resumed, fmt.Errorf("error getting deliveries: %v", err)
+		}
+		deliveries, err := fetchByKeys[types.WebhookDelivery](d.db, deliveryKeys)
+		if err != nil {
+			return resumed, fmt.Errorf("error getting deliveries: %v", err)
+		}
+		for i := range deliveries {
+			delivery := &deliveries[i]
+			if delivery.Status != types.WebhookDeliveryPending {
+				continue
+			}
+			key := fmt.Sprintf("%s:%s", deliveriesKey(sub.WebhookID), delivery.DeliveryID)
+			if _, ok := d.queued.Load(key); ok {
+				continue
+			}
+			if sub.Disabled {
+				delivery.Status = types.WebhookDeliveryFailed
+				if err := d.saveDelivery(delivery); err != nil {
+					return resumed, fmt.Errorf("error updating delivery: %v", err)
+				}
+				continue
+			}
+			if !d.queue(sub, delivery) {
+				return resumed, nil
+			}
+			resumed++
+		}
+	}
+	return resumed, nil
+}
+
+// Publish records a delivery of the event for every subscription to it and queues them to be sent
+// in the background. The data is encoded immediately so later changes to it aren't sent
+func (d *WebhookDispatcher) Publish(event types.WebhookEvent, data any) {
+	if d == nil {
+		return
+	}
+	logger := d.logger.With().Str("event", string(event)).Logger()
+	payload, err := json.Marshal(WebhookPayload{Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		logger.Error().Err(err).Msg("Error encoding webhook payload")
+		return
+	}
+	keys, err := getKeys(d.db, "webhooks")
+	if err != nil {
+		logger.Error().Err(err).Msg("Error getting webhook subscriptions")
+		return
+	}
+	subscriptions, err := fetchByKeys[types.WebhookSubscription](d.db, keys)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error getting webhook subscriptions")
+		return
+	}
+	for _, sub := range subscriptions {
+		if sub.Disabled || !subscribedTo(sub, event) {
+			continue
+		}
+		delivery, err := d.createDelivery(sub.WebhookID, event, payload)
+		if err != nil {
+			logger.Error().Err(err).Str("webhookID", sub.WebhookID).Msg("Error creating webhook delivery")
+			continue
+		}
+		if !d.queue(sub, delivery) {
+			logger.Warn().Str("webhookID", sub.WebhookID).Msg("Webhook queue is full, the delivery will be sent by a later sweep")
+		}
+	}
+}
+
+// createDelivery stores a new pending delivery in the subscription's log, removing the oldest
+// deliveries if the log is full
+func (d *WebhookDispatcher) createDelivery(webhookID string, event types.WebhookEvent, payload []byte) (*types.WebhookDelivery, error) {
+	d.logLock.Lock()
+	defer d.logLock.Unlock()
+
+	delivery := &types.WebhookDelivery{
+		WebhookID: webhookID,
+		Event:     event,
+		Payload:   payload,
+		Status:    types.WebhookDeliveryPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	name := deliveriesKey(webhookID)
+	delivery, err := addOne[*types.WebhookDelivery](d.db, name, delivery, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := getKeys(d.db, name)
+	if err != nil || len(keys) <= maxWebhookDeliveries {
+		// Failing to trim the log isn't a reason to not send the event
+		return delivery, nil
+	}
+	expired := keys[:len(keys)-maxWebhookDeliveries]
+	if err := storeOne(d.db, name, keys[len(keys)-maxWebhookDeliveries:]); err != nil {
+		return delivery, nil
+	}
+	for _, key := range expired {
+		if err := d.db.Delete(key); err != nil {
+			d.logger.Warn().Err(err).Str("key", key).Msg("Error removing old webhook delivery")
+		}
+	}
+	return delivery, nil
+}
+
+// deliver sends the delivery until it succeeds or runs out of attempts, recording each attempt
+func (d *WebhookDispatcher) deliver(ctx context.Context, sub types.WebhookSubscription, delivery *types.WebhookDelivery) {
+	logger := d.logger.With().Str("webhookID", sub.WebhookID).Str("deliveryID", delivery.DeliveryID).Logger()
+	wait := d.backoff
+	for attempt := 0; attempt < d.maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			wait *= 2
+		}
+
+		result := d.attempt(ctx, sub, delivery)
+		delivery.Attempts = append(delivery.Attempts, result)
+		if result.Error == "" {
+			delivery.Status = types.WebhookDeliverySucceeded
+		} else if attempt == d.maxAttempts-1 {
+			delivery.Status = types.WebhookDeliveryFailed
+		}
+		if err := d.saveDelivery(delivery); err != nil {
+			logger.Error().Err(err).Msg("Error updating webhook delivery")
+		}
+		if delivery.Status == types.WebhookDeliverySucceeded {
+			return
+		}
+		logger.Warn().Int("attempt", attempt+1).Str("error", result.Error).Msg("Webhook delivery failed")
+	}
+}
+
+// attempt makes a single request for the delivery. Any response other than a 2xx is a failure
+func (d *WebhookDispatcher) attempt(ctx context.Context, sub types.WebhookSubscription, delivery *types.WebhookDelivery) types.WebhookAttempt {
+	start := time.Now()
+	result := types.WebhookAttempt{At: start.UTC()}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		result.Error = fmt.Sprintf("error creating request: %v", err)
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", string(delivery.Event))
+	req.Header.Set("X-Webhook-Delivery", delivery.DeliveryID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", WebhookSignature(sub.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	// Drain a bit of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		result.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+	}
+	return result
+}
+
+func (d *WebhookDispatcher) saveDelivery(delivery *types.WebhookDelivery) error {
+	d.logLock.Lock()
+	defer d.logLock.Unlock()
+	// The delivery could have been removed from the log while it was being sent
+	key := fmt.Sprintf("%s:%s", deliveriesKey(delivery.WebhookID), delivery.DeliveryID)
+	if _, err := d.db.Get(key); errors.Is(err, store.ErrKeyNotFound) {
+		return nil
+	}
+	return storeOne(d.db, key, delivery)
+}
+
+// deliveriesKey is the name the deliveries for a subscription are stored under
+func deliveriesKey(webhookID string) string {
+	return fmt.Sprintf("webhook_deliveries:%s", webhookID)
+}
+
+func subscribedTo(sub types.WebhookSubscription, event types.WebhookEvent) bool {
+	for _, e := range sub.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebhookSubscription(sub types.WebhookSubscription) error {
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(sub.Events) == 0 {
+		return errors.New("at least one event is required")
+	}
+	for _, event := range sub.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("unknown event %s", event)
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+type WebhookHandlers struct {
+	db         store.DataStore
+	dispatcher *WebhookDispatcher
+}
+
+func NewWebhookHandlers(db store.DataStore, dispatcher *WebhookDispatcher) *WebhookHandlers {
+	return &WebhookHandlers{db: db, dispatcher: dispatcher}
+}
+
+// GetWebhooks gets all webhook subscriptions
+func (wh *WebhookHandlers) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	get[*types.WebhookSubscription](wh.db, "webhooks", w, r)
+}
+
+// AddWebhook creates a webhook subscription. A secret is generated if one isn't given
+func (wh *WebhookHandlers) AddWebhook(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	var sub types.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookSubscription(sub); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+	if sub.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			writeHttpError(r.Context(), w, fmt.Errorf("error generating secret: %v", err), http.StatusInternalServerError)
+			return
+		}
+		sub.Secret = secret
+	}
+	sub.CreatedAt = time.Now().UTC()
+
+	created, err := addOne[*types.WebhookSubscription](wh.db, "webhooks", &sub, nil, nil)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error adding webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		logger.Error().Err(err).Msg("Error writing response")
+	}
+}
+
+// UpdateWebhook replaces a webhook subscription. The secret is kept if one isn't given
+func (wh *WebhookHandlers) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	logger := httplog.LogEntry(r.Context())
+	id := chi.URLParam(r, "id")
+	var sub types.WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error decoding webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+	if sub.WebhookID != id {
+		writeHttpError(r.Context(), w, errors.New("given item does not have an ID that matches"), http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookSubscription(sub); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("invalid webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	key := fmt.Sprintf("webhooks:%s", id)
+	existing, err := fetchOne[types.WebhookSubscription](wh.db, key)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("webhook not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if sub.Secret == "" {
+		sub.Secret = existing.Secret
+	}
+	sub.CreatedAt = existing.CreatedAt
+
+	if err := storeOne(wh.db, key, sub); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(sub); err != nil {
+		logger.Error().Err(err).Msg("Error writing response")
+	}
+}
+
+// DeleteWebhook deletes a webhook subscription and its delivery log
+func (wh *WebhookHandlers) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	delete[*types.WebhookSubscription](wh.db, "webhooks", w, r, func() error {
+		keys, err := getKeys(wh.db, deliveriesKey(id))
+		if err != nil {
+			return fmt.Errorf("error getting deliveries: %v", err)
+		}
+		for _, key := range keys {
+			if err := wh.db.Delete(key); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+				return fmt.Errorf("error deleting delivery: %v", err)
+			}
+		}
+		if err := wh.db.Delete(deliveriesKey(id)); err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+			return fmt.Errorf("error deleting deliveries: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetDeliveries gets the delivery log for a webhook subscription, newest first
+func (wh *WebhookHandlers) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	logger := httplog.LogEntry(r.Context()).With().Str("webhookID", id).Logger()
+	if _, err := wh.db.Get(fmt.Sprintf("webhooks:%s", id)); errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("webhook not found"), http.StatusNotFound)
+		return
+	}
+
+	keys, err := getKeys(wh.db, deliveriesKey(id))
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	deliveries, err := fetchByKeys[types.WebhookDelivery](wh.db, keys)
+	if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
+
+// Redeliver sends a delivery again with the same payload, retrying like a new delivery. The new
+// attempts are added to the existing delivery
+func (wh *WebhookHandlers) Redeliver(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	deliveryID := chi.URLParam(r, "deliveryId")
+	logger := httplog.LogEntry(r.Context()).With().Str("webhookID", id).Str("deliveryID", deliveryID).Logger()
+
+	sub, err := fetchOne[types.WebhookSubscription](wh.db, fmt.Sprintf("webhooks:%s", id))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("webhook not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	delivery, err := fetchOne[types.WebhookDelivery](wh.db, fmt.Sprintf("%s:%s", deliveriesKey(id), deliveryID))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		writeHttpError(r.Context(), w, fmt.Errorf("delivery not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error getting delivery: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if delivery.Status == types.WebhookDeliveryPending {
+		writeHttpError(r.Context(), w, fmt.Errorf("delivery is still being sent"), http.StatusConflict)
+		return
+	}
+
+	delivery.Status = types.WebhookDeliveryPending
+	if err := wh.dispatcher.saveDelivery(delivery); err != nil {
+		writeHttpError(r.Context(), w, fmt.Errorf("error updating delivery: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// A full queue leaves it pending for a later sweep to send
+	wh.dispatcher.queue(*sub, delivery)
+
+	logger.Info().Msg("Redelivering webhook")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(delivery); err != nil {
+		logger.Error().Err(err).Msg("Error encoding response")
+	}
+}
@@ -0,0 +1,159 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/store"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	// The receiver fails the first request so the delivery has to be retried
+	var requests atomic.Int32
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		expected := handlers.WebhookSignature("shh", r.Header.Get("X-Webhook-Timestamp"), body)
+		if r.Header.Get("X-Webhook-Signature") != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- r.Header.Get("X-Webhook-Event")
+	}))
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dispatcher := handlers.NewWebhookDispatcher(db, zerolog.Nop(), 3, 10*time.Millisecond)
+	dispatcher.Start(ctx)
+	webhookHandlers := handlers.NewWebhookHandlers(db, dispatcher)
+	r := chi.NewRouter()
+	r.Post("/webhooks", webhookHandlers.AddWebhook)
+	r.Get("/webhooks/{id}/deliveries", webhookHandlers.GetDeliveries)
+	r.Post("/webhooks/{id}/deliveries/{deliveryId}/redeliver", webhookHandlers.Redeliver)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/webhooks", strings.NewReader(`{"url":"ftp://example.com","events":["order.paid"]}`)))
+	require.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/webhooks", strings.NewReader(fmt.Sprintf(`{"url":%q,"secret":"shh","events":["order.paid"]}`, receiver.URL))))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var sub types.WebhookSubscription
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&sub))
+
+	// Events that weren't subscribed to aren't sent
+	dispatcher.Publish(types.WebhookCartUpdated, types.Cart{UserID: "u1"})
+	dispatcher.Publish(types.WebhookOrderPaid, types.Order{OrderID: "1", UserID: "u1", IsPaid: true})
+
+	select {
+	case event := <-received:
+		require.Equal(t, string(types.WebhookOrderPaid), event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was never delivered")
+	}
+
+	deliveries := getDeliveries(t, r, sub.WebhookID, func(d []types.WebhookDelivery) bool {
+		return len(d) == 1 && d[0].Status == types.WebhookDeliverySucceeded
+	})
+	require.Len(t, deliveries[0].Attempts, 2)
+	require.Equal(t, http.StatusServiceUnavailable, deliveries[0].Attempts[0].StatusCode)
+	require.Equal(t, http.StatusOK, deliveries[0].Attempts[1].StatusCode)
+
+	var payload handlers.WebhookPayload
+	require.NoError(t, json.Unmarshal(deliveries[0].Payload, &payload))
+	require.Equal(t, types.WebhookOrderPaid, payload.Event)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", fmt.Sprintf("/webhooks/%s/deliveries/%s/redeliver", sub.WebhookID, deliveries[0].DeliveryID), nil))
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was never redelivered")
+	}
+	getDeliveries(t, r, sub.WebhookID, func(d []types.WebhookDelivery) bool {
+		return len(d) == 1 && d[0].Status == types.WebhookDeliverySucceeded && len(d[0].Attempts) == 3
+	})
+}
+
+// getDeliveries polls the delivery log until done returns true as deliveries are recorded in the
+// background
+func getDeliveries(t *testing.T, r http.Handler, webhookID string, done func([]types.WebhookDelivery) bool) []types.WebhookDelivery {
+	var deliveries []types.WebhookDelivery
+	require.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/webhooks/%s/deliveries", webhookID), nil))
+		if rr.Code != http.StatusOK {
+			return false
+		}
+		deliveries = nil
+		if err := json.NewDecoder(rr.Body).Decode(&deliveries); err != nil {
+			return false
+		}
+		return done(deliveries)
+	}, 5*time.Second, 10*time.Millisecond)
+	return deliveries
+}
+
+func TestWebhookDeliveryResumedAfterRestart(t *testing.T) {
+	db, err := store.NewDiskDataStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	var available atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	// The first attempt fails and the process stops while waiting an hour to retry
+	ctx, stop := context.WithCancel(context.Background())
+	dispatcher := handlers.NewWebhookDispatcher(db, zerolog.Nop(), 3, time.Hour)
+	dispatcher.Start(ctx)
+	r := chi.NewRouter()
+	r.Post("/webhooks", handlers.NewWebhookHandlers(db, dispatcher).AddWebhook)
+	r.Get("/webhooks/{id}/deliveries", handlers.NewWebhookHandlers(db, dispatcher).GetDeliveries)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/webhooks", strings.NewReader(fmt.Sprintf(`{"url":%q,"events":["order.paid"]}`, receiver.URL))))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var sub types.WebhookSubscription
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&sub))
+	dispatcher.Publish(types.WebhookOrderPaid, types.Order{OrderID: "1", UserID: "u1", IsPaid: true})
+	getDeliveries(t, r, sub.WebhookID, func(d []types.WebhookDelivery) bool {
+		return len(d) == 1 && len(d[0].Attempts) == 1
+	})
+
+	stop()
+
+	available.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted := handlers.NewWebhookDispatcher(db, zerolog.Nop(), 3, time.Millisecond)
+	restarted.Start(ctx)
+	deliveries := getDeliveries(t, r, sub.WebhookID, func(d []types.WebhookDelivery) bool {
+		return len(d) == 1 && d[0].Status == types.WebhookDeliverySucceeded
+	})
+	require.Len(t, deliveries[0].Attempts, 2)
+}
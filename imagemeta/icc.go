@@ -0,0 +1,176 @@
+package imagemeta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// The largest ICC profile we will decompress from a PNG. Real profiles are well under this
+const maxPNGProfileSize = 4 << 20
+
+// ICCProfile returns the ICC profile embedded in a JPEG, PNG or TIFF, or nil if there isn't one.
+// Profiles that are malformed are treated as missing
+func ICCProfile(data []byte) []byte {
+	switch Sniff(data) {
+	case ContentTypeJPEG:
+		return jpegICCProfile(data)
+	case ContentTypePNG:
+		return pngICCProfile(data)
+	case ContentTypeTIFF:
+		return tiffICCProfile(bytes.NewReader(data), int64(len(data)))
+	default:
+		return nil
+	}
+}
+
+// tiffICCProfile returns the profile in the ICC profile tag of a TIFF
+func tiffICCProfile(r io.ReaderAt, size int64) []byte {
+	entry, ok := readTIFFTag(r, size, 34675)
+	if !ok {
+		return nil
+	}
+	return entry.value
+}
+
+// RGBICCProfile returns the ICC profile embedded in a JPEG, PNG or TIFF if it is for the RGB color
+// space, or nil otherwise. Pictures are always rendered as RGB, so a gray or CMYK profile from the
+// original would describe the rendered pixels wrongly
+func RGBICCProfile(data []byte) []byte {
+	return RGBProfile(ICCProfile(data))
+}
+
+// RGBProfile returns the profile if it is for the RGB color space, or nil otherwise
+func RGBProfile(profile []byte) []byte {
+	if info, ok := ReadProfileInfo(profile); !ok || info.ColorSpace != "rgb" {
+		return nil
+	}
+	return profile
+}
+
+// jpegICCProfile joins the profile chunks from the APP2 segments before the image data
+func jpegICCProfile(data []byte) []byte {
+	type chunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []chunk
+	eachJPEGSegment(data, func(marker byte, segment []byte) {
+		if marker == 0xE2 && len(segment) > 14 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")) {
+			chunks = append(chunks, chunk{seq: segment[12], data: segment[14:]})
+		}
+	})
+	if len(chunks) == 0 {
+		return nil
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+	profile := []byte{}
+	for _, c := range chunks {
+		profile = append(profile, c.data...)
+	}
+	return profile
+}
+
+// pngICCProfile decompresses the profile in the iCCP chunk
+func pngICCProfile(data []byte) []byte {
+	var compressed []byte
+	eachPNGChunk(data, func(chunkType string, body []byte) {
+		if chunkType != "iCCP" || compressed != nil {
+			return
+		}
+		// The profile name, a null, the compression method and then the compressed profile
+		nameEnd := bytes.IndexByte(body, 0)
+		if nameEnd < 0 || nameEnd+2 > len(body) || body[nameEnd+1] != 0 {
+			return
+		}
+		compressed = body[nameEnd+2:]
+	})
+	if compressed == nil {
+		return nil
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	profile, err := io.ReadAll(io.LimitReader(reader, maxPNGProfileSize))
+	if err != nil {
+		return nil
+	}
+	return profile
+}
+
+// ReadProfileInfo reads the description and color space from the header and tags of an ICC
+// profile. It returns false if the profile is too short to have a header
+func ReadProfileInfo(profile []byte) (types.ICCProfileInfo, bool) {
+	if len(profile) < 132 {
+		return types.ICCProfileInfo{}, false
+	}
+	info := types.ICCProfileInfo{Size: len(profile)}
+	switch string(profile[16:20]) {
+	case "RGB ":
+		info.ColorSpace = "rgb"
+	case "GRAY":
+		info.ColorSpace = "gray"
+	case "CMYK":
+		info.ColorSpace = "cmyk"
+	}
+
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			break
+		}
+		if string(profile[entry:entry+4]) != "desc" {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			break
+		}
+		info.Description = profileDescription(profile[offset : offset+size])
+		break
+	}
+	return info, true
+}
+
+// profileDescription decodes a description tag, which is a textDescriptionType in version 2
+// profiles and a multiLocalizedUnicodeType in version 4. For the latter the first name is used
+func profileDescription(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		length := int(binary.BigEndian.Uint32(tag[8:]))
+		if length < 0 || 12+length > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+length]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if length < 0 || offset < 0 || offset+length > len(tag) {
+			return ""
+		}
+		name := tag[offset : offset+length]
+		units := make([]uint16, len(name)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(name[i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	default:
+		return ""
+	}
+}
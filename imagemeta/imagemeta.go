@@ -0,0 +1,287 @@
+// Package imagemeta identifies uploaded pictures from their contents and reads the metadata needed
+// to print them, like their dimensions, orientation and color profile
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+
+	_ "golang.org/x/image/tiff"
+)
+
+const (
+	ContentTypeJPEG = "image/jpeg"
+	ContentTypePNG  = "image/png"
+	ContentTypeTIFF = "image/tiff"
+)
+
+// The most of a picture that is read to find its headers, and the largest TIFF tag value that is
+// read. Real headers and profiles are well under this
+const maxHeaderSize = 4 << 20
+
+// Metadata is what we know about a picture from its contents
+type Metadata struct {
+	ContentType string
+	// The size of the picture as it is displayed, so the width and height are swapped for pictures
+	// that are rotated by their orientation
+	Width  int
+	Height int
+	// rgb, gray or cmyk
+	ColorSpace string
+	// The EXIF orientation from 1 to 8, 1 if the picture doesn't have one
+	Orientation int
+	// The embedded ICC profile, nil if there isn't one
+	ICCProfile []byte
+}
+
+// Sniff returns the content type of the image from its first bytes, or an empty string if it isn't
+// a JPEG, PNG or TIFF
+func Sniff(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return ContentTypeJPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ContentTypePNG
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return ContentTypeTIFF
+	default:
+		return ""
+	}
+}
+
+// Read reads the metadata from the picture. Only the image headers are decoded, so this doesn't
+// guarantee the image data itself is valid
+func Read(data []byte) (Metadata, error) {
+	contentType := Sniff(data)
+	if contentType == "" {
+		return Metadata{}, errors.New("picture is not a JPEG, PNG or TIFF")
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("unable to read picture: %w", err)
+	}
+	return newMetadata(contentType, config, Orientation(data), ICCProfile(data))
+}
+
+// ReadAt is like Read for a picture that isn't in memory, like an upload in a file. Only the headers
+// are read, which for JPEGs and PNGs all come before the image data, and for TIFFs are the tags
+// wherever they are in the file
+func ReadAt(r io.ReaderAt, size int64) (Metadata, error) {
+	head := make([]byte, min64(size, maxHeaderSize))
+	if _, err := r.ReadAt(head, 0); err != nil && !errors.Is(err, io.EOF) {
+		return Metadata{}, fmt.Errorf("unable to read picture: %w", err)
+	}
+	if Sniff(head) != ContentTypeTIFF {
+		return Read(head)
+	}
+	config, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("unable to read picture: %w", err)
+	}
+	return newMetadata(ContentTypeTIFF, config, tiffOrientation(r, size), tiffICCProfile(r, size))
+}
+
+func newMetadata(contentType string, config image.Config, orientation int, profile []byte) (Metadata, error) {
+	if config.Width <= 0 || config.Height <= 0 {
+		return Metadata{}, errors.New("picture is empty")
+	}
+	meta := Metadata{
+		ContentType: contentType,
+		Width:       config.Width,
+		Height:      config.Height,
+		ColorSpace:  colorSpace(config.ColorModel),
+		Orientation: orientation,
+		ICCProfile:  profile,
+	}
+	// Orientations 5 to 8 rotate the picture a quarter turn
+	if meta.Orientation >= 5 {
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+	// The profile is more specific than the color model, which is YCbCr for most JPEGs
+	if info, ok := ReadProfileInfo(meta.ICCProfile); ok && info.ColorSpace != "" {
+		meta.ColorSpace = info.ColorSpace
+	}
+	return meta, nil
+}
+
+func colorSpace(model color.Model) string {
+	switch model {
+	case color.GrayModel, color.Gray16Model:
+		return "gray"
+	case color.CMYKModel:
+		return "cmyk"
+	default:
+		return "rgb"
+	}
+}
+
+// Orientation returns the EXIF orientation of a JPEG, PNG or TIFF, or 1 if it doesn't have a valid
+// one
+func Orientation(data []byte) int {
+	exif := exifData(data)
+	if exif == nil {
+		return 1
+	}
+	return tiffOrientation(bytes.NewReader(exif), int64(len(exif)))
+}
+
+// tiffOrientation reads the orientation tag from a TIFF structure, returning 1 if it doesn't have a
+// valid one
+func tiffOrientation(r io.ReaderAt, size int64) int {
+	entry, ok := readTIFFTag(r, size, 274)
+	if !ok || entry.dataType != tiffShort || entry.count != 1 {
+		return 1
+	}
+	orientation := int(entry.order.Uint16(entry.value))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// exifData returns the TIFF structure holding the EXIF tags. For TIFFs this is the file itself
+func exifData(data []byte) []byte {
+	switch Sniff(data) {
+	case ContentTypeTIFF:
+		return data
+	case ContentTypeJPEG:
+		var exif []byte
+		eachJPEGSegment(data, func(marker byte, segment []byte) {
+			if exif == nil && marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				exif = segment[6:]
+			}
+		})
+		return exif
+	case ContentTypePNG:
+		var exif []byte
+		eachPNGChunk(data, func(chunkType string, body []byte) {
+			if chunkType == "eXIf" {
+				exif = body
+			}
+		})
+		return exif
+	default:
+		return nil
+	}
+}
+
+// eachJPEGSegment calls f for every segment before the image data, stopping at the first
+// malformed segment
+func eachJPEGSegment(data []byte, f func(marker byte, segment []byte)) {
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return
+		}
+		marker := data[pos+1]
+		// Start of scan, so there are no more headers
+		if marker == 0xDA {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return
+		}
+		f(marker, data[pos+4:pos+2+length])
+		pos += 2 + length
+	}
+}
+
+// eachPNGChunk calls f for every chunk before the image data, stopping at the first malformed
+// chunk
+func eachPNGChunk(data []byte, f func(chunkType string, body []byte)) {
+	pos := 8
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) || chunkType == "IDAT" || chunkType == "IEND" {
+			return
+		}
+		f(chunkType, data[pos+8:pos+8+length])
+		pos += 12 + length
+	}
+}
+
+// The TIFF type for an unsigned 16 bit integer
+const tiffShort = 3
+
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+type tiffTag struct {
+	order    binary.ByteOrder
+	dataType uint16
+	count    uint32
+	value    []byte
+}
+
+// readTIFFTag finds the tag in the first IFD of a TIFF structure that is size bytes long
+func readTIFFTag(r io.ReaderAt, size int64, tag uint16) (tiffTag, bool) {
+	// readAt reads exactly n bytes at the offset, failing if any of them are past the end
+	readAt := func(offset int64, n int64) ([]byte, bool) {
+		if offset < 0 || offset+n > size {
+			return nil, false
+		}
+		buf := make([]byte, n)
+		if _, err := r.ReadAt(buf, offset); err != nil && !(errors.Is(err, io.EOF) && offset+n == size) {
+			return nil, false
+		}
+		return buf, true
+	}
+	header, ok := readAt(0, 8)
+	if !ok {
+		return tiffTag{}, false
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return tiffTag{}, false
+	}
+	ifd := int64(order.Uint32(header[4:]))
+	rawCount, ok := readAt(ifd, 2)
+	if !ok {
+		return tiffTag{}, false
+	}
+	count := int64(order.Uint16(rawCount))
+	for i := int64(0); i < count; i++ {
+		entry, ok := readAt(ifd+2+i*12, 12)
+		if !ok {
+			return tiffTag{}, false
+		}
+		if order.Uint16(entry) != tag {
+			continue
+		}
+		dataType := order.Uint16(entry[2:])
+		valueCount := order.Uint32(entry[4:])
+		valueSize := int64(tiffTypeSizes[dataType]) * int64(valueCount)
+		if valueSize == 0 || valueSize > maxHeaderSize {
+			return tiffTag{}, false
+		}
+		// Values of 4 bytes or less are stored in the entry, otherwise the entry has their offset
+		value := entry[8:12]
+		if valueSize > 4 {
+			if value, ok = readAt(int64(order.Uint32(entry[8:])), valueSize); !ok {
+				return tiffTag{}, false
+			}
+		}
+		return tiffTag{order: order, dataType: dataType, count: valueCount, value: value[:min64(valueSize, int64(len(value)))]}, true
+	}
+	return tiffTag{}, false
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,103 @@
+package imagemeta_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/imagemeta"
+	"github.com/thomastaylor312/printing-api/render"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+// testProfile builds a minimal version 2 ICC profile with a description tag
+func testProfile(description string) []byte {
+	return testProfileFor("RGB ", description)
+}
+
+// testProfileFor builds a minimal version 2 ICC profile for the given ICC color space signature
+func testProfileFor(colorSpace string, description string) []byte {
+	desc := append([]byte("desc\x00\x00\x00\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(description)+1))...)
+	desc = append(desc, description...)
+	desc = append(desc, 0)
+
+	profile := make([]byte, 144)
+	copy(profile[16:], colorSpace)
+	binary.BigEndian.PutUint32(profile[128:], 1)
+	copy(profile[132:], "desc")
+	binary.BigEndian.PutUint32(profile[136:], 144)
+	binary.BigEndian.PutUint32(profile[140:], uint32(len(desc)))
+	profile = append(profile, desc...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func TestReadJPEG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	require.NoError(t, jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 40, 30)), nil))
+	data := buf.Bytes()
+
+	meta, err := imagemeta.Read(data)
+	require.NoError(t, err)
+	require.Equal(t, imagemeta.Metadata{ContentType: imagemeta.ContentTypeJPEG, Width: 40, Height: 30, ColorSpace: "gray", Orientation: 1}, meta)
+
+	// A big endian EXIF segment with the orientation set to rotate the picture a quarter turn
+	exif := []byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	segment := append([]byte{0xFF, 0xE1}, binary.BigEndian.AppendUint16(nil, uint16(len(exif)+2))...)
+	withExif := append(append(append([]byte{}, data[:2]...), append(segment, exif...)...), data[2:]...)
+
+	meta, err = imagemeta.Read(withExif)
+	require.NoError(t, err)
+	require.Equal(t, 6, meta.Orientation)
+	require.Equal(t, 30, meta.Width)
+	require.Equal(t, 40, meta.Height)
+
+	_, err = imagemeta.Read([]byte("GIF89a"))
+	require.Error(t, err)
+	_, err = imagemeta.Read(data[:20])
+	require.Error(t, err, "truncated header should fail")
+}
+
+func TestICCProfile(t *testing.T) {
+	profile := testProfile("Test RGB")
+	info, ok := imagemeta.ReadProfileInfo(profile)
+	require.True(t, ok)
+	require.Equal(t, types.ICCProfileInfo{Description: "Test RGB", ColorSpace: "rgb", Size: len(profile)}, info)
+
+	picture := image.NewRGBA(image.Rect(0, 0, 10, 20))
+	for _, format := range []types.PrintFileFormat{types.PrintFileFormatTIFF, types.PrintFileFormatJPEG} {
+		buf := new(bytes.Buffer)
+		require.NoError(t, render.Encode(buf, picture, format, 300, 90, profile))
+		require.Equal(t, profile, imagemeta.ICCProfile(buf.Bytes()), format)
+
+		meta, err := imagemeta.Read(buf.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, render.ContentType(format), meta.ContentType)
+		require.Equal(t, "rgb", meta.ColorSpace)
+		require.Equal(t, 10, meta.Width)
+
+		// Reading from a ReaderAt finds the same metadata without the picture being in memory
+		fromReader, err := imagemeta.ReadAt(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		require.Equal(t, meta, fromReader, format)
+	}
+}
+
+func TestRGBICCProfile(t *testing.T) {
+	picture := image.NewRGBA(image.Rect(0, 0, 10, 20))
+	encode := func(profile []byte) []byte {
+		buf := new(bytes.Buffer)
+		require.NoError(t, render.Encode(buf, picture, types.PrintFileFormatJPEG, 300, 90, profile))
+		return buf.Bytes()
+	}
+
+	rgb := testProfile("Test RGB")
+	require.Equal(t, rgb, imagemeta.RGBICCProfile(encode(rgb)))
+	for _, colorSpace := range []string{"GRAY", "CMYK"} {
+		require.Nil(t, imagemeta.RGBICCProfile(encode(testProfileFor(colorSpace, "Test"))), colorSpace)
+	}
+	require.Nil(t, imagemeta.RGBICCProfile(encode(nil)))
+}
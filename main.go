@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"fmt"
 	"net/http"
+	"os"
 	"path/filepath"
 	"sync/atomic"
+	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/coreos/go-oidc/v3/oidc"
@@ -13,6 +17,7 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog"
 	"github.com/thomastaylor312/printing-api/handlers"
+	"github.com/thomastaylor312/printing-api/notify"
 	"github.com/thomastaylor312/printing-api/payment"
 	"github.com/thomastaylor312/printing-api/store"
 	"github.com/thomastaylor312/printing-api/types"
@@ -28,7 +33,20 @@ func main() {
 		logger.Fatal().Err(err).Msg("Error creating data store")
 	}
 
-	storage := store.NewDiskImageStore(filepath.Join(xdg.DataHome, "printing-api", "storage"))
+	// Pictures are stored in S3 when a bucket is configured, otherwise on local disk. Disk URLs are
+	// served by the API, and are signed with FILE_URL_SECRET so they keep working across restarts
+	diskStorage := store.NewDiskImageStoreWithURLs(filepath.Join(xdg.DataHome, "printing-api", "storage"), store.DiskURLOptions{
+		Prefix: os.Getenv("FILE_URL_PREFIX"),
+		Secret: []byte(os.Getenv("FILE_URL_SECRET")),
+	})
+	var storage store.ImageStore = diskStorage
+	if os.Getenv("S3_BUCKET") != "" {
+		s3Storage, err := store.NewS3ImageStoreFromEnv()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error creating S3 image store")
+		}
+		storage = s3Storage
+	}
 
 	// Do an initial fetch of the config
 	data, err := db.Get("config")
@@ -46,10 +64,64 @@ func main() {
 		logger.Fatal().Err(err).Msg("Error creating payment client")
 	}
 
-	conf := atomic.Value{}
+	// Customer emails are only sent when an SMTP server is configured, otherwise they are logged
+	var sender notify.Sender = notify.NewLogSender(logger)
+	if os.Getenv("SMTP_HOST") != "" {
+		smtpSender, err := notify.NewSMTPFromEnv()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Error creating SMTP sender")
+		}
+		sender = smtpSender
+	}
+	notifier := handlers.NewNotifier(db, sender, logger)
+	webhooks := handlers.NewWebhookDispatcher(db, logger, 5, 30*time.Second)
+	webhooks.Start(context.Background())
+
+	// Start the reconciler that makes sure outstanding orders match the payment provider
+	reconcileInterval, err := durationFromEnv("RECONCILE_INTERVAL", 15*time.Minute)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error configuring reconciler")
+	}
+	orderExpiry, err := durationFromEnv("ORDER_PAYMENT_EXPIRY", 72*time.Hour)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error configuring reconciler")
+	}
+	reconciler := handlers.NewReconciler(db, paymentClient, notifier, webhooks, logger, reconcileInterval, orderExpiry)
+	reconciler.Start(context.Background())
+
+	// Start generating derivatives, sweeping for pictures that are missing them
+	derivativeSweepInterval, err := durationFromEnv("DERIVATIVE_SWEEP_INTERVAL", 10*time.Minute)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error configuring derivative generation")
+	}
+	derivatives := handlers.NewDerivativeGenerator(db, storage, logger, derivativeSweepInterval)
+	derivatives.Start(context.Background())
+
+	conf := &atomic.Value{}
 
 	conf.Store(config)
 
+	// Start cleaning up uploads that were abandoned partway through
+	uploadCleanupInterval, err := durationFromEnv("UPLOAD_CLEANUP_INTERVAL", time.Hour)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error configuring upload cleanup")
+	}
+	uploadExpiry, err := durationFromEnv("UPLOAD_EXPIRY", 24*time.Hour)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error configuring upload cleanup")
+	}
+	uploadPictureHandler := handlers.NewPictureHandlers(db, storage, conf, webhooks, derivatives)
+	resumableUploadHandler := handlers.NewResumableUploadHandlers(uploadPictureHandler, logger, uploadCleanupInterval, uploadExpiry)
+	resumableUploadHandler.Start(context.Background())
+
+	// Start cleaning up deleted and unused pictures and files that nothing references
+	retentionInterval, err := durationFromEnv("PICTURE_RETENTION_INTERVAL", time.Hour)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Error configuring picture retention")
+	}
+	retention := handlers.NewPictureRetention(db, storage, conf, logger, retentionInterval)
+	retention.Start(context.Background())
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
@@ -81,24 +153,52 @@ func main() {
 			paperHandler := handlers.NewPaperHandlers(db)
 			r.Get("/papers", paperHandler.GetPapers)
 
-			cartHandler := handlers.NewCartHandlers(db, conf)
+			userHandler := handlers.NewUserHandlers(db)
+			r.Get("/users/{userId}/addresses", userHandler.GetUserAddresses)
+			r.Put("/users/{userId}/addresses", userHandler.PutUserAddresses)
+
+			cartHandler := handlers.NewCartHandlers(db, conf, webhooks)
 			r.Get("/carts/{userId}", cartHandler.GetUserCart)
 			r.Put("/carts/{userId}", cartHandler.PutCart)
 			r.Put("/carts/{userId}/print", cartHandler.AddPrintToCart)
 
-			orderHandler := handlers.NewOrderHandlers(db, conf, paymentClient)
+			shippingHandler := handlers.NewShippingHandlers(db, conf)
+			r.Get("/carts/{userId}/shipping", shippingHandler.GetShippingQuotes)
+
+			orderHandler := handlers.NewOrderHandlers(db, storage, conf, paymentClient, notifier, webhooks)
 			r.Get("/orders/{userId}", orderHandler.GetOrdersByUser)
 			r.Get("/orders/{userId}/{id}", orderHandler.GetOrderForUser)
 			r.Post("/orders/{userId}", orderHandler.AddOrder)
 			r.Put("/orders/{userId}/{id}", orderHandler.ConfirmOrderPayed)
 
+			// Direct and resumable uploads and tags don't send the picture as the body, so they are
+			// outside of the picture group
+			r.Post("/pictures/{userId}/{id}/upload-url", uploadPictureHandler.CreateUploadURL)
+			r.Post("/pictures/{userId}/{id}/upload-complete", uploadPictureHandler.CompleteUpload)
+			r.Post("/pictures/{userId}/{id}/uploads", resumableUploadHandler.CreateUpload)
+			r.Head("/pictures/{userId}/{id}/uploads/{uploadId}", resumableUploadHandler.GetUploadOffset)
+			r.Patch("/pictures/{userId}/{id}/uploads/{uploadId}", resumableUploadHandler.PatchUpload)
+			r.Delete("/pictures/{userId}/{id}/uploads/{uploadId}", resumableUploadHandler.DeleteUpload)
+			r.Put("/pictures/{userId}/{id}/tags", uploadPictureHandler.PutPictureTags)
+
+			albumHandler := handlers.NewAlbumHandlers(db)
+			r.Get("/albums/{userId}", albumHandler.GetAlbumsByUser)
+			r.Post("/albums/{userId}", albumHandler.CreateAlbum)
+			r.Put("/albums/{userId}/order", albumHandler.ReorderAlbums)
+			r.Get("/albums/{userId}/{id}", albumHandler.GetAlbum)
+			r.Put("/albums/{userId}/{id}", albumHandler.UpdateAlbum)
+			r.Delete("/albums/{userId}/{id}", albumHandler.DeleteAlbum)
+			r.Post("/albums/{userId}/{id}/pictures", albumHandler.AddAlbumPictures)
+			r.Delete("/albums/{userId}/{id}/pictures/{pictureId}", albumHandler.RemoveAlbumPicture)
+
 			// For pictures, create a new group that uses the content type middleware
 			r.Group(func(r chi.Router) {
 				r.Use(middleware.AllowContentType("image/jpeg", "image/png", "image/tiff"))
 
-				pictureHandler := handlers.NewPictureHandlers(db, storage)
+				pictureHandler := handlers.NewPictureHandlers(db, storage, conf, webhooks, derivatives)
 				r.Post("/pictures/{userId}", pictureHandler.CreatePicture)
 				r.Get("/pictures/{userId}", pictureHandler.GetPicturesByUser)
+				r.Get("/pictures/{userId}/usage", pictureHandler.GetUsage)
 				r.Get("/pictures/{userId}/{id}", pictureHandler.GetPictureInfo)
 				r.Put("/pictures/{userId}/{id}", pictureHandler.UploadPicture)
 				r.Delete("/pictures/{userId}/{id}", pictureHandler.DeletePicture)
@@ -106,10 +206,17 @@ func main() {
 		})
 	})
 
+	// Files on disk are served from signed URLs, so these don't go through authentication
+	if storage == diskStorage {
+		fileHandler := handlers.NewFileHandlers(diskStorage)
+		r.Get("/files/{container}/{id}", fileHandler.ServeFile)
+		r.Head("/files/{container}/{id}", fileHandler.ServeFile)
+	}
+
 	// Mount the admin sub-router
 	r.Group(func(r chi.Router) {
 		// TODO: jwt middleware: https://github.com/go-chi/jwtauth
-		r.Mount("/admin/api", adminRouter(db, storage, conf, paymentClient))
+		r.Mount("/admin/api", adminRouter(db, storage, conf, paymentClient, notifier, webhooks, reconciler, derivatives, retention))
 		// TODO: Admin routes
 	})
 
@@ -117,30 +224,72 @@ func main() {
 }
 
 // A completely separate router for administrator routes
-func adminRouter(db store.DataStore, storage store.ImageStore, conf atomic.Value, paymentClient payment.Payment) http.Handler {
+func adminRouter(db store.DataStore, storage store.ImageStore, conf *atomic.Value, paymentClient payment.Payment, notifier *handlers.Notifier, webhooks *handlers.WebhookDispatcher, reconciler *handlers.Reconciler, derivatives *handlers.DerivativeGenerator, retention *handlers.PictureRetention) http.Handler {
 	r := chi.NewRouter()
 	r.Use(AdminOnly)
 
 	paperHandler := handlers.NewPaperHandlers(db)
+	r.Get("/papers", paperHandler.GetAllPapers)
 	r.Post("/papers", paperHandler.AddPaper)
 	r.Put("/papers/{id}", paperHandler.UpdatePaper)
 	r.Delete("/papers/{id}", paperHandler.DeletePaper)
 
-	cartHandler := handlers.NewCartHandlers(db, conf)
+	cartHandler := handlers.NewCartHandlers(db, conf, webhooks)
 	r.Get("/carts", cartHandler.GetCarts)
 	r.Get("/carts/{userId}", cartHandler.GetUserCart)
 
-	orderHandler := handlers.NewOrderHandlers(db, conf, paymentClient)
+	orderHandler := handlers.NewOrderHandlers(db, storage, conf, paymentClient, notifier, webhooks)
 	r.Get("/orders", orderHandler.GetOrders)
 	r.Get("/orders/{userId}", orderHandler.GetOrdersByUser)
 	r.Get("/orders/{userId}/{id}", orderHandler.GetOrderForUser)
 	r.Put("/orders/{userId}/{id}", orderHandler.UpdateOrder)
+	r.Post("/orders/{userId}/{id}/shipments", orderHandler.AddShipment)
+	r.Post("/orders/{userId}/{id}/delivered", orderHandler.MarkDelivered)
+
+	documentHandler := handlers.NewDocumentHandlers(db, storage, conf)
+	r.Get("/orders/{userId}/{id}/packing-slip", documentHandler.GetPackingSlip)
+	r.Get("/orders/{userId}/{id}/shipping-label", documentHandler.GetShippingLabel)
 	r.Delete("/orders/{userId}/{id}", orderHandler.DeleteOrder)
 
-	pictureHandler := handlers.NewPictureHandlers(db, storage)
+	productionHandler := handlers.NewProductionHandlers(db, storage, conf)
+	r.Get("/production/queue", productionHandler.GetQueue)
+	r.Get("/production/jobs/{id}", productionHandler.GetJob)
+	r.Put("/production/jobs/{id}/assignment", productionHandler.AssignJob)
+	r.Put("/production/jobs/{id}/status", productionHandler.UpdateJobStatus)
+	r.Post("/production/jobs/{id}/print-file", productionHandler.RenderPrintFile)
+	r.Get("/production/jobs/{id}/print-file", productionHandler.GetPrintFile)
+	r.Get("/production/orders/{orderId}/jobs", productionHandler.GetOrderJobs)
+	r.Post("/production/orders/{orderId}/jobs", productionHandler.CreateOrderJobs)
+
+	r.Get("/reconciliation", reconciler.GetReport)
+	r.Post("/reconciliation", reconciler.RunReconciliation)
+
+	r.Get("/cleanup", retention.GetCleanupReport)
+	r.Post("/cleanup", retention.RunCleanup)
+
+	pictureHandler := handlers.NewPictureHandlers(db, storage, conf, webhooks, derivatives)
 	r.Get("/pictures", pictureHandler.GetPictures)
 	r.Get("/pictures/{userId}", pictureHandler.GetPicturesByUser)
 	r.Get("/pictures/{userId}/{id}", pictureHandler.GetPictureInfo)
+	r.Post("/pictures/{userId}/{id}/derivatives", pictureHandler.RegenerateDerivatives)
+	r.Get("/pictures/{userId}/usage", pictureHandler.GetUsage)
+	r.Get("/pictures/{userId}/quota", pictureHandler.GetUserQuota)
+	r.Put("/pictures/{userId}/quota", pictureHandler.PutUserQuota)
+	r.Delete("/pictures/{userId}/quota", pictureHandler.DeleteUserQuota)
+
+	webhookHandler := handlers.NewWebhookHandlers(db, webhooks)
+	r.Get("/webhooks", webhookHandler.GetWebhooks)
+	r.Post("/webhooks", webhookHandler.AddWebhook)
+	r.Put("/webhooks/{id}", webhookHandler.UpdateWebhook)
+	r.Delete("/webhooks/{id}", webhookHandler.DeleteWebhook)
+	r.Get("/webhooks/{id}/deliveries", webhookHandler.GetDeliveries)
+	r.Post("/webhooks/{id}/deliveries/{deliveryId}/redeliver", webhookHandler.Redeliver)
+
+	notificationHandler := handlers.NewNotificationHandlers(db)
+	r.Get("/notifications/templates", notificationHandler.GetTemplates)
+	r.Get("/notifications/templates/{event}", notificationHandler.GetTemplate)
+	r.Put("/notifications/templates/{event}", notificationHandler.PutTemplate)
+	r.Delete("/notifications/templates/{event}", notificationHandler.DeleteTemplate)
 
 	configHandler := handlers.NewConfigHandlers(db, conf)
 	r.Get("/config", configHandler.GetConfig)
@@ -148,6 +297,19 @@ func adminRouter(db store.DataStore, storage store.ImageStore, conf atomic.Value
 	return r
 }
 
+// durationFromEnv parses the duration in the given env var, returning the default if it isn't set
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a valid duration: %w", name, err)
+	}
+	return d, nil
+}
+
 func AdminOnly(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		//   ctx := r.Context()
@@ -0,0 +1,22 @@
+package notify
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+// LogSender logs messages instead of sending them. This is useful for local development and when
+// no mail server is configured
+type LogSender struct {
+	logger zerolog.Logger
+}
+
+func NewLogSender(logger zerolog.Logger) *LogSender {
+	return &LogSender{logger: logger}
+}
+
+func (l *LogSender) Send(ctx context.Context, msg Message) error {
+	l.logger.Info().Str("to", msg.To).Str("subject", msg.Subject).Str("body", msg.Body).Msg("Sending email")
+	return nil
+}
@@ -0,0 +1,15 @@
+package notify
+
+import "context"
+
+// Message is a single plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Sender interface {
+	// Send delivers the message, returning once the receiving server has accepted it
+	Send(ctx context.Context, msg Message) error
+}
@@ -0,0 +1,183 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultSMTPPort = "587"
+
+// SMTP sends messages through an SMTP server. STARTTLS is used whenever the server supports it
+type SMTP struct {
+	addr      string
+	host      string
+	auth      smtp.Auth
+	from      mail.Address
+	tlsConfig *tls.Config
+}
+
+// NewSMTP creates an SMTP sender for the server at host:port. Authentication is only used if a
+// username is given
+func NewSMTP(host string, port string, username string, password string, from string) (*SMTP, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	s := &SMTP{
+		addr:      net.JoinHostPort(host, port),
+		host:      host,
+		from:      *fromAddr,
+		tlsConfig: &tls.Config{ServerName: host},
+	}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s, nil
+}
+
+// NewSMTPFromEnv is a helper function to create a new SMTP sender from configuration given by
+// environment variable
+func NewSMTPFromEnv() (*SMTP, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, errors.New("SMTP_HOST must be set")
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		return nil, errors.New("SMTP_FROM must be set")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = defaultSMTPPort
+	}
+	s, err := NewSMTP(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	if err != nil {
+		return nil, err
+	}
+	if caFile := os.Getenv("SMTP_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading SMTP_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("SMTP_CA_FILE does not contain any PEM certificates")
+		}
+		s.SetRootCAs(pool)
+	}
+	return s, nil
+}
+
+// SetRootCAs sets the certificate authorities the server's certificate is verified with. This is
+// only needed for servers with certificates from a private CA, otherwise the system roots are used
+func (s *SMTP) SetRootCAs(pool *x509.CertPool) {
+	s.tlsConfig.RootCAs = pool
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid to address: %w", err)
+	}
+	body, err := s.buildMessage(*to, msg)
+	if err != nil {
+		return fmt.Errorf("error building message: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+	// net/smtp doesn't take a context, so use the deadline to bound the whole conversation
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		// A config can't be changed once crypto/tls has used it, so each connection gets a copy
+		if err := client.StartTLS(s.tlsConfig.Clone()); err != nil {
+			return fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+	if s.auth != nil {
+		if err := client.Auth(s.auth); err != nil {
+			return fmt.Errorf("error authenticating with SMTP server: %w", err)
+		}
+	}
+	if err := client.Mail(s.from.Address); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	wc, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	if _, err := wc.Write(body); err != nil {
+		wc.Close()
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return client.Quit()
+}
+
+// buildMessage builds the headers and quoted-printable encoded body of the message
+func (s *SMTP) buildMessage(to mail.Address, msg Message) ([]byte, error) {
+	// Newlines in the subject would let it inject headers
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, errors.New("subject cannot contain newlines")
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", s.from.String())
+	fmt.Fprintf(buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s@%s>\r\n", newMessageID(), s.host)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(buf)
+	body := strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n")
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newMessageID() string {
+	buf := make([]byte, 16)
+	// crypto/rand only fails if the OS can't provide randomness, in which case the time is unique
+	// enough for a message ID
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,189 @@
+package notify_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/notify"
+)
+
+// smtpSink is a minimal SMTP server that accepts every message and sends it on the channel. If it
+// has a TLS config it offers STARTTLS
+type smtpSink struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	messages  chan sinkMessage
+}
+
+type sinkMessage struct {
+	from string
+	to   []string
+	data string
+	// Whether the message was sent after STARTTLS and the credentials it was sent with
+	tls  bool
+	auth string
+}
+
+func newSMTPSink(t *testing.T, tlsConfig *tls.Config) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sink := &smtpSink{listener: listener, tlsConfig: tlsConfig, messages: make(chan sinkMessage, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.handle(conn)
+		}
+	}()
+	return sink
+}
+
+func (s *smtpSink) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+	write := func(line string) { io.WriteString(conn, line+"\r\n") }
+	write("220 localhost ESMTP sink")
+	var msg sinkMessage
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			write("250-localhost")
+			if s.tlsConfig != nil && !msg.tls {
+				write("250-STARTTLS")
+			}
+			write("250 AUTH PLAIN")
+		case cmd == "STARTTLS" && s.tlsConfig != nil:
+			write("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+			msg.tls = true
+		case strings.HasPrefix(cmd, "AUTH PLAIN "):
+			msg.auth = line[len("AUTH PLAIN "):]
+			write("235 Authenticated")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+			write("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			write("250 OK")
+		case cmd == "DATA":
+			write("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			msg.data = data.String()
+			s.messages <- msg
+			msg = sinkMessage{tls: msg.tls, auth: msg.auth}
+			write("250 OK")
+		case cmd == "QUIT":
+			write("221 Bye")
+			return
+		default:
+			write("250 OK")
+		}
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	sink := newSMTPSink(t, nil)
+	host, port, err := net.SplitHostPort(sink.listener.Addr().String())
+	require.NoError(t, err)
+
+	sender, err := notify.NewSMTP(host, port, "", "", "Print Shop <shop@example.com>")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = sender.Send(ctx, notify.Message{
+		To:      "customer@example.com",
+		Subject: "Your order has shipped – track it",
+		Body:    "Hi there,\nYour order is on its way.",
+	})
+	require.NoError(t, err)
+
+	var received sinkMessage
+	select {
+	case received = <-sink.messages:
+	case <-ctx.Done():
+		t.Fatal("sink never received the message")
+	}
+	require.Equal(t, "shop@example.com", received.from)
+	require.Equal(t, []string{"customer@example.com"}, received.to)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(received.data))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Your order has shipped – track it", subject)
+	body, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	require.NoError(t, err)
+	require.Equal(t, "Hi there,\r\nYour order is on its way.", strings.TrimRight(string(body), "\r\n"))
+
+	err = sender.Send(ctx, notify.Message{To: "customer@example.com", Subject: "Bad\r\nBcc: someone@example.com"})
+	require.Error(t, err, "newlines in the subject should be rejected")
+}
+
+func TestSMTPSendStartTLS(t *testing.T) {
+	// Borrow the test server's certificate, which is valid for 127.0.0.1
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	sink := newSMTPSink(t, &tls.Config{Certificates: server.TLS.Certificates})
+	host, port, err := net.SplitHostPort(sink.listener.Addr().String())
+	require.NoError(t, err)
+
+	sender, err := notify.NewSMTP(host, port, "shop", "secret", "shop@example.com")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg := notify.Message{To: "customer@example.com", Subject: "Your order has shipped", Body: "On its way"}
+	require.Error(t, sender.Send(ctx, msg), "the server's certificate isn't trusted")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	sender.SetRootCAs(pool)
+	require.NoError(t, sender.Send(ctx, msg))
+
+	var received sinkMessage
+	select {
+	case received = <-sink.messages:
+	case <-ctx.Done():
+		t.Fatal("sink never received the message")
+	}
+	require.True(t, received.tls, "the message should be sent after STARTTLS")
+	require.NotEmpty(t, received.auth, "the sender should authenticate")
+	require.Equal(t, []string{"customer@example.com"}, received.to)
+}
@@ -1,6 +1,7 @@
 package payment
 
 import (
+	"context"
 	"net/url"
 
 	"github.com/thomastaylor312/printing-api/types"
@@ -8,8 +9,16 @@ import (
 
 type Payment interface {
 	// CreateOrder creates a new order with the payment provider and returns the external order ID
-	// and optional URL to the payment page
-	CreateOrder(order types.Order) (string, *url.URL, error)
+	// and optional URL to the payment page. The order must already have its internal ID set so it
+	// can be used as a reference with the provider
+	CreateOrder(ctx context.Context, order types.Order) (string, *url.URL, error)
 	// ValidateOrderPaid checks if the order with the provided external ID has been paid for
-	ValidateOrderPaid(externalOrderID string) (bool, error)
+	ValidateOrderPaid(ctx context.Context, externalOrderID string) (bool, error)
+	// GetShippingAddress returns the shipping address the customer entered with the payment
+	// provider for the order with the provided external ID, or nil if they haven't entered one
+	GetShippingAddress(ctx context.Context, externalOrderID string) (*types.Address, error)
+	// CancelOrder cancels the order with the provided external ID so it can no longer be paid for.
+	// Cancelling an order that has been paid for fails, and cancelling one that is already
+	// cancelled does nothing
+	CancelOrder(ctx context.Context, externalOrderID string) error
 }
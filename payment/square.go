@@ -2,24 +2,67 @@ package payment
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/httplog"
 	"github.com/thomastaylor312/printing-api/types"
 )
 
+const (
+	defaultSquareTimeout      = 10 * time.Second
+	defaultSquareMaxRetries   = 3
+	defaultSquareRetryBackoff = 500 * time.Millisecond
+)
+
 type Square struct {
-	baseHeaders http.Header
-	baseURL     url.URL
-	redirectUrl url.URL
-	locationID  string
+	client       *http.Client
+	timeout      time.Duration
+	baseHeaders  http.Header
+	baseURL      url.URL
+	redirectUrl  url.URL
+	locationID   string
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+// SquareOption is an option for configuring the Square client
+type SquareOption func(*Square)
+
+// WithHTTPClient sets the HTTP client used for requests to Square. The client is used as is, so
+// any timeout should be configured on the client itself
+func WithHTTPClient(client *http.Client) SquareOption {
+	return func(s *Square) {
+		s.client = client
+	}
+}
+
+// WithTimeout sets the timeout for each individual request to Square when using the default HTTP
+// client. Retried requests each get their own timeout
+func WithTimeout(timeout time.Duration) SquareOption {
+	return func(s *Square) {
+		s.timeout = timeout
+	}
+}
+
+// WithRetries sets the maximum number of times a request is retried when Square returns a 429 or
+// 5xx status code (or the request fails to send) and the initial backoff between attempts. The
+// backoff doubles after each attempt
+func WithRetries(maxRetries int, backoff time.Duration) SquareOption {
+	return func(s *Square) {
+		s.maxRetries = maxRetries
+		s.retryBackoff = backoff
+	}
 }
 
 type PaymentLinkResponse struct {
@@ -55,14 +98,38 @@ type OrderResponse struct {
 // SquareOrder is the abbreviated struct for the Square Order API, only including the fields we
 // actually need
 type SquareOrder struct {
-	ID          string    `json:"id"`
-	LocationID  string    `json:"location_id"`
-	ReferenceID string    `json:"reference_id"`
-	CustomerID  string    `json:"customer_id"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	State       string    `json:"state"`
-	Version     int       `json:"version"`
+	ID           string              `json:"id"`
+	LocationID   string              `json:"location_id"`
+	ReferenceID  string              `json:"reference_id"`
+	CustomerID   string              `json:"customer_id"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+	State        string              `json:"state"`
+	Version      int                 `json:"version"`
+	Fulfillments []SquareFulfillment `json:"fulfillments"`
+}
+
+// SquareFulfillment is the abbreviated struct for a fulfillment on a Square order
+type SquareFulfillment struct {
+	Type            string `json:"type"`
+	ShipmentDetails *struct {
+		Recipient struct {
+			DisplayName string         `json:"display_name"`
+			Address     *SquareAddress `json:"address"`
+		} `json:"recipient"`
+	} `json:"shipment_details"`
+}
+
+// SquareAddress is the address type used by the Square API
+type SquareAddress struct {
+	FirstName                    string `json:"first_name,omitempty"`
+	LastName                     string `json:"last_name,omitempty"`
+	AddressLine1                 string `json:"address_line_1"`
+	AddressLine2                 string `json:"address_line_2,omitempty"`
+	Locality                     string `json:"locality"`
+	AdministrativeDistrictLevel1 string `json:"administrative_district_level_1,omitempty"`
+	PostalCode                   string `json:"postal_code,omitempty"`
+	Country                      string `json:"country"`
 }
 
 type SquareErrorResponse struct {
@@ -79,8 +146,9 @@ type SquareErrorResponse struct {
 // not the full URL. Will fail if the URL can't parse.
 //
 // Redirect URL is the URL that the user will be redirected to after they complete their order and
-// location ID is the ID of the square location to use for the order
-func NewSquare(token string, domain string, redirectUrl url.URL, locationID string) (*Square, error) {
+// location ID is the ID of the square location to use for the order. Any additional options are
+// applied on top of the defaults of a 10 second timeout and 3 retries
+func NewSquare(token string, domain string, redirectUrl url.URL, locationID string, opts ...SquareOption) (*Square, error) {
 	baseURL, err := url.Parse(fmt.Sprintf("https://%s/v2/", domain))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URL: %w", err)
@@ -89,12 +157,22 @@ func NewSquare(token string, domain string, redirectUrl url.URL, locationID stri
 		"Square-Version": {"2023-06-08"},
 		"Authorization":  {"Bearer " + token},
 	}
-	return &Square{
-		baseHeaders: baseHeaders,
-		baseURL:     *baseURL,
-		redirectUrl: redirectUrl,
-		locationID:  locationID,
-	}, nil
+	s := &Square{
+		timeout:      defaultSquareTimeout,
+		baseHeaders:  baseHeaders,
+		baseURL:      *baseURL,
+		redirectUrl:  redirectUrl,
+		locationID:   locationID,
+		maxRetries:   defaultSquareMaxRetries,
+		retryBackoff: defaultSquareRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: s.timeout}
+	}
+	return s, nil
 }
 
 // NewSquareFromEnv is a helper function to create a new Square payment handler from configuration
@@ -128,35 +206,71 @@ func NewSquareFromEnv() (*Square, error) {
 		return nil, errors.New("PAYMENT_API_DOMAIN must be set")
 	}
 
-	return NewSquare(token, domain, *parsedURL, locationID)
+	// The timeout and retry settings are optional
+	var opts []SquareOption
+	if rawTimeout := os.Getenv("PAYMENT_API_TIMEOUT"); rawTimeout != "" {
+		timeout, err := time.ParseDuration(rawTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("PAYMENT_API_TIMEOUT must be a valid duration: %w", err)
+		}
+		opts = append(opts, WithTimeout(timeout))
+	}
+	if rawRetries := os.Getenv("PAYMENT_API_MAX_RETRIES"); rawRetries != "" {
+		retries, err := strconv.Atoi(rawRetries)
+		if err != nil || retries < 0 {
+			return nil, errors.New("PAYMENT_API_MAX_RETRIES must be a non-negative integer")
+		}
+		opts = append(opts, WithRetries(retries, defaultSquareRetryBackoff))
+	}
+
+	return NewSquare(token, domain, *parsedURL, locationID, opts...)
 }
 
-func (s *Square) CreateOrder(order types.Order) (externalOrderID string, paymentLink *url.URL, err error) {
+func (s *Square) CreateOrder(ctx context.Context, order types.Order) (externalOrderID string, paymentLink *url.URL, err error) {
+	if order.ID() == "" {
+		return "", nil, errors.New("failed to create order page: order must have an ID")
+	}
+
 	// Set up the request body
 	lineItems := make([]map[string]interface{}, len(order.Prints))
 	for i, print := range order.Prints {
 		lineItems[i] = map[string]interface{}{
-			"quantity": "1",
-			"base_price_money": map[string]interface{}{
-				"amount":   print.Cost,
-				"currency": "USD",
-			},
-			"item_type": "ITEM",
-			"name":      "Custom Print",
+			"quantity":         strconv.FormatUint(uint64(print.Count()), 10),
+			"base_price_money": squareMoney(print.Cost),
+			"item_type":        "ITEM",
+			"name":             lineItemName(print),
+			"note":             fmt.Sprintf("Picture %s", print.PictureID),
+		}
+	}
+
+	// The idempotency key comes from the order so Square deduplicates the retries below and any
+	// other attempt to create a payment link for the same order. The creation time keeps it unique
+	// if order IDs are ever reused, like when the database is reset
+	idempotencyKey := orderIdempotencyKey(order)
+
+	// If we already have the address, fill it in for the customer so they only need to confirm it
+	prePopulatedData := map[string]interface{}{}
+	if address := order.ShippingDetails.Address; address != nil {
+		prePopulatedData["buyer_address"] = SquareAddress{
+			FirstName:                    address.Name,
+			AddressLine1:                 address.Line1,
+			AddressLine2:                 address.Line2,
+			Locality:                     address.City,
+			AdministrativeDistrictLevel1: address.State,
+			PostalCode:                   address.PostalCode,
+			Country:                      address.Country,
 		}
 	}
 
 	requestBody, err := json.Marshal(map[string]interface{}{
-		"idempotency_key": order.ID(),
+		"idempotency_key":    idempotencyKey,
+		"pre_populated_data": prePopulatedData,
 		"checkout_options": map[string]interface{}{
 			"allow_tipping":            false,
 			"ask_for_shipping_address": true,
 			"shipping_fee": map[string]interface{}{
-				"charge": map[string]interface{}{
-					"amount":   order.ShippingDetails.ShippingProfile.Cost,
-					"currency": "USD",
-				},
-				"name": order.ShippingDetails.ShippingProfile.Name,
+				"charge": squareMoney(order.ShippingDetails.Cost),
+				"name":   order.ShippingDetails.ShippingProfile.Name,
 			},
 			"redirect_url": s.redirectUrl.String(),
 		},
@@ -164,24 +278,14 @@ func (s *Square) CreateOrder(order types.Order) (externalOrderID string, payment
 			"location_id":  s.locationID,
 			"customer_id":  order.UserID,
 			"line_items":   lineItems,
-			"reference_id": "internal-id",
+			"reference_id": order.ID(),
 		},
 	})
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to create order page: %w", err)
 	}
 
-	headers := s.baseHeaders.Clone()
-	headers.Set("Content-Type", "application/json")
-	// Set up the request
-	req := http.Request{
-		Method: http.MethodPost,
-		URL:    s.baseURL.JoinPath("online-checkout/payment-links"),
-		Body:   io.NopCloser(bytes.NewReader(requestBody)),
-		Header: headers,
-	}
-
-	resp, err := http.DefaultClient.Do(&req)
+	resp, err := s.do(ctx, http.MethodPost, "online-checkout/payment-links", requestBody)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to create order page: %w", err)
 	}
@@ -189,13 +293,7 @@ func (s *Square) CreateOrder(order types.Order) (externalOrderID string, payment
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		var errorResp SquareErrorResponse
-		// Ignore the error if it fails to decode as we can't do anything about it. Just log it
-		if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
-			// TODO: Set up zerolog outside of http requests
-			log.Printf("failed to decode error response from square: %s", err)
-		}
-		return "", nil, fmt.Errorf("failed to create order page. Got status code %d with errors: %v", resp.StatusCode, errorResp.Errors)
+		return "", nil, fmt.Errorf("failed to create order page. %w", s.responseError(ctx, resp))
 	}
 
 	var paymentLinkResp PaymentLinkResponse
@@ -213,36 +311,181 @@ func (s *Square) CreateOrder(order types.Order) (externalOrderID string, payment
 	return externalOrderID, paymentLink, nil
 }
 
-func (s *Square) ValidateOrderPaid(orderID string) (bool, error) {
-	headers := s.baseHeaders.Clone()
-	headers.Set("Content-Type", "application/json")
-	// Set up the request
-	req := http.Request{
-		Method: http.MethodGet,
-		URL:    s.baseURL.JoinPath("orders/" + orderID),
-		Header: headers,
+func (s *Square) ValidateOrderPaid(ctx context.Context, orderID string) (bool, error) {
+	order, err := s.getOrder(ctx, orderID)
+	if err != nil {
+		return false, fmt.Errorf("failed to validate order: %w", err)
 	}
 
-	resp, err := http.DefaultClient.Do(&req)
+	return order.State == "COMPLETED", nil
+}
+
+func (s *Square) GetShippingAddress(ctx context.Context, orderID string) (*types.Address, error) {
+	order, err := s.getOrder(ctx, orderID)
 	if err != nil {
-		return false, fmt.Errorf("failed to validate order: %w", err)
+		return nil, fmt.Errorf("failed to get shipping address: %w", err)
+	}
+
+	for _, fulfillment := range order.Fulfillments {
+		if fulfillment.ShipmentDetails == nil || fulfillment.ShipmentDetails.Recipient.Address == nil {
+			continue
+		}
+		recipient := fulfillment.ShipmentDetails.Recipient
+		name := recipient.DisplayName
+		if name == "" {
+			name = strings.TrimSpace(recipient.Address.FirstName + " " + recipient.Address.LastName)
+		}
+		return &types.Address{
+			Name:       name,
+			Line1:      recipient.Address.AddressLine1,
+			Line2:      recipient.Address.AddressLine2,
+			City:       recipient.Address.Locality,
+			State:      recipient.Address.AdministrativeDistrictLevel1,
+			PostalCode: recipient.Address.PostalCode,
+			Country:    recipient.Address.Country,
+		}, nil
+	}
+	return nil, nil
+}
+
+// CancelOrder cancels the order, which stops its payment link from taking payments. The update is
+// made against the version of the order we read, so it fails if the order was paid for in the
+// meantime
+func (s *Square) CancelOrder(ctx context.Context, orderID string) error {
+	order, err := s.getOrder(ctx, orderID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	switch order.State {
+	case "CANCELED":
+		return nil
+	case "COMPLETED":
+		return errors.New("failed to cancel order: order has been paid for")
+	}
+
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"idempotency_key": fmt.Sprintf("cancel-%s-%d", orderID, order.Version),
+		"order": map[string]interface{}{
+			"location_id": s.locationID,
+			"version":     order.Version,
+			"state":       "CANCELED",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	resp, err := s.do(ctx, http.MethodPut, "orders/"+orderID, requestBody)
+	if err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to cancel order. %w", s.responseError(ctx, resp))
+	}
+	return nil
+}
+
+func (s *Square) getOrder(ctx context.Context, orderID string) (SquareOrder, error) {
+	resp, err := s.do(ctx, http.MethodGet, "orders/"+orderID, nil)
+	if err != nil {
+		return SquareOrder{}, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		var errorResp SquareErrorResponse
-		// Ignore the error if it fails to decode as we can't do anything about it. Just log it
-		if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
-			log.Printf("failed to decode error response from square: %s", err)
-		}
-		return false, fmt.Errorf("failed to validate order. Got status code %d with errors: %v", resp.StatusCode, errorResp.Errors)
+		return SquareOrder{}, s.responseError(ctx, resp)
 	}
 
 	var orderResp OrderResponse
 	if err := json.NewDecoder(resp.Body).Decode(&orderResp); err != nil {
-		return false, fmt.Errorf("failed to validate order: %w", err)
+		return SquareOrder{}, err
 	}
+	return orderResp.Order, nil
+}
+
+// do sends a request to the given path of the Square API, retrying with exponential backoff if the
+// request fails to send or Square responds with a 429 or 5xx. The last response is returned if we
+// run out of retries, so callers should still check the status code
+func (s *Square) do(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	logger := httplog.LogEntry(ctx).With().Str("method", method).Str("path", path).Logger()
+	backoff := s.retryBackoff
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, s.baseURL.JoinPath(path).String(), reader)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = s.baseHeaders.Clone()
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := s.client.Do(req)
+		retryable := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		if !retryable || attempt >= s.maxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+
+		wait := backoff
+		if err != nil {
+			logger.Warn().Err(err).Int("attempt", attempt+1).Msg("Request to square failed, retrying")
+		} else {
+			logger.Warn().Int("status", resp.StatusCode).Int("attempt", attempt+1).Msg("Square returned a retryable status, retrying")
+			// Respect Square's requested delay if it is longer than our backoff
+			if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(retryAfter)*time.Second > wait {
+				wait = time.Duration(retryAfter) * time.Second
+			}
+			// Drain the body so the connection can be reused
+			io.Copy(io.Discard, resp.Body) //nolint:errcheck
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// responseError builds an error from a non-successful Square response, including any errors Square
+// returned in the body
+func (s *Square) responseError(ctx context.Context, resp *http.Response) error {
+	var errorResp SquareErrorResponse
+	// Ignore the error if it fails to decode as we can't do anything about it. Just log it
+	if err := json.NewDecoder(resp.Body).Decode(&errorResp); err != nil {
+		logger := httplog.LogEntry(ctx)
+		logger.Warn().Err(err).Msg("Failed to decode error response from square")
+	}
+	return fmt.Errorf("Got status code %d with errors: %v", resp.StatusCode, errorResp.Errors)
+}
+
+// squareMoney converts a dollar amount to Square's money type, which is an integer amount in the
+// smallest denomination of the currency
+func squareMoney(amount float64) map[string]interface{} {
+	return map[string]interface{}{
+		"amount":   int64(math.Round(amount * 100)),
+		"currency": "USD",
+	}
+}
+
+// lineItemName returns a human readable description of the print for display on the checkout page
+func lineItemName(print types.Print) string {
+	name := fmt.Sprintf("%g\" x %g\" Print", print.Width, print.Height)
+	if print.Paper != nil {
+		name += " on " + print.Paper.Name
+	}
+	if print.BorderSize > 0 {
+		name += fmt.Sprintf(" with %g\" border", print.BorderSize)
+	}
+	return name
+}
 
-	return orderResp.Order.State == "COMPLETED", nil
+func orderIdempotencyKey(order types.Order) string {
+	return fmt.Sprintf("order-%s-%d", order.ID(), order.CreatedAt.UnixNano())
 }
@@ -0,0 +1,141 @@
+package payment_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/payment"
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+func newTestSquare(t *testing.T, handler http.HandlerFunc) *payment.Square {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	square, err := payment.NewSquare("token", serverURL.Host, url.URL{Scheme: "https", Host: "example.com"}, "location",
+		payment.WithHTTPClient(server.Client()), payment.WithRetries(3, time.Millisecond))
+	require.NoError(t, err)
+	return square
+}
+
+func TestCreateOrderRetriesAndLineItems(t *testing.T) {
+	var attempts int32
+	var keys []string
+	square := newTestSquare(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v2/online-checkout/payment-links", r.URL.Path)
+		var body struct {
+			IdempotencyKey string `json:"idempotency_key"`
+			Order          struct {
+				ReferenceID string `json:"reference_id"`
+				LineItems   []struct {
+					Quantity       string `json:"quantity"`
+					Name           string `json:"name"`
+					BasePriceMoney struct {
+						Amount int64 `json:"amount"`
+					} `json:"base_price_money"`
+				} `json:"line_items"`
+			} `json:"order"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		keys = append(keys, body.IdempotencyKey)
+		require.Equal(t, "42", body.Order.ReferenceID)
+		require.Len(t, body.Order.LineItems, 1)
+		require.Equal(t, "3", body.Order.LineItems[0].Quantity)
+		require.Equal(t, `8" x 10" Print on Lustre`, body.Order.LineItems[0].Name)
+		require.Equal(t, int64(1250), body.Order.LineItems[0].BasePriceMoney.Amount)
+
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"payment_link": {"url": "https://square.link/u/abc"}, "related_resources": {"orders": [{"id": "external"}]}}`)) //nolint:errcheck
+	})
+
+	order := types.Order{
+		OrderID: "42",
+		UserID:  "1",
+		Prints: []types.Print{
+			{Width: 8, Height: 10, Paper: &types.PaperType{Name: "Lustre"}, Cost: 12.5, Quantity: 3},
+		},
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	externalID, link, err := square.CreateOrder(context.Background(), order)
+	require.NoError(t, err)
+	require.Equal(t, "external", externalID)
+	require.Equal(t, "https://square.link/u/abc", link.String())
+	require.Equal(t, int32(3), attempts)
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1], "retries should reuse the same idempotency key")
+	require.Equal(t, keys[0], keys[2], "retries should reuse the same idempotency key")
+
+	// Creating the same order again uses the same key so Square doesn't make a second payment link,
+	// but a different order doesn't
+	_, _, err = square.CreateOrder(context.Background(), order)
+	require.NoError(t, err)
+	require.Equal(t, keys[0], keys[3], "the key should come from the order")
+	order.CreatedAt = order.CreatedAt.Add(time.Second)
+	_, _, err = square.CreateOrder(context.Background(), order)
+	require.NoError(t, err)
+	require.NotEqual(t, keys[0], keys[4], "orders that reuse an ID should get a different key")
+}
+
+func TestValidateOrderPaidGivesUp(t *testing.T) {
+	var attempts int32
+	square := newTestSquare(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	_, err := square.ValidateOrderPaid(context.Background(), "external")
+	require.Error(t, err)
+	// One initial attempt plus 3 retries
+	require.Equal(t, int32(4), attempts)
+}
+
+func TestValidateOrderPaidNoRetryOnClientError(t *testing.T) {
+	var attempts int32
+	square := newTestSquare(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	_, err := square.ValidateOrderPaid(context.Background(), "external")
+	require.Error(t, err)
+	require.Equal(t, int32(1), attempts)
+}
+
+func TestCancelOrder(t *testing.T) {
+	state := "OPEN"
+	square := newTestSquare(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v2/orders/external", r.URL.Path)
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"order": {"id": "external", "state": "` + state + `", "version": 3}}`)) //nolint:errcheck
+			return
+		}
+		require.Equal(t, http.MethodPut, r.Method)
+		var body struct {
+			Order struct {
+				Version int    `json:"version"`
+				State   string `json:"state"`
+			} `json:"order"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Equal(t, 3, body.Order.Version, "the update should fail if the order changed since it was read")
+		state = body.Order.State
+		w.Write([]byte(`{"order": {"id": "external", "state": "` + state + `", "version": 4}}`)) //nolint:errcheck
+	})
+
+	require.NoError(t, square.CancelOrder(context.Background(), "external"))
+	require.Equal(t, "CANCELED", state)
+	require.NoError(t, square.CancelOrder(context.Background(), "external"), "cancelling twice should do nothing")
+	state = "COMPLETED"
+	require.Error(t, square.CancelOrder(context.Background(), "external"), "paid orders can't be cancelled")
+}
@@ -0,0 +1,219 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/thomastaylor312/printing-api/types"
+)
+
+const (
+	defaultJPEGQuality = 95
+	// The most profile data that fits in a single JPEG APP2 segment
+	maxICCChunk = 65535 - 2 - 14
+)
+
+// Encode writes the image in the given format with its resolution set to dpi so print software
+// lays it out at the right physical size. If profile is set it is embedded as the image's ICC
+// profile. A quality of 0 uses the default JPEG quality and is ignored for TIFFs
+func Encode(w io.Writer, img *image.RGBA, format types.PrintFileFormat, dpi uint, quality int, profile []byte) error {
+	switch format {
+	case types.PrintFileFormatTIFF, "":
+		return encodeTIFF(w, img, dpi, profile)
+	case types.PrintFileFormatJPEG:
+		if quality == 0 {
+			quality = defaultJPEGQuality
+		}
+		return encodeJPEG(w, img, dpi, quality, profile)
+	default:
+		return fmt.Errorf("unsupported format %s", format)
+	}
+}
+
+// ContentType returns the MIME type for the format
+func ContentType(format types.PrintFileFormat) string {
+	if format == types.PrintFileFormatJPEG {
+		return "image/jpeg"
+	}
+	return "image/tiff"
+}
+
+// Extension returns the file extension for the format
+func Extension(format types.PrintFileFormat) string {
+	if format == types.PrintFileFormatJPEG {
+		return ".jpg"
+	}
+	return ".tif"
+}
+
+// encodeJPEG encodes the image with the standard library and then adds a JFIF header with the
+// resolution and the ICC profile, neither of which image/jpeg writes
+func encodeJPEG(w io.Writer, img *image.RGBA, dpi uint, quality int, profile []byte) error {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	encoded := buf.Bytes()
+	if len(encoded) < 2 || encoded[0] != 0xFF || encoded[1] != 0xD8 {
+		return errors.New("encoded JPEG is missing its start of image marker")
+	}
+	if dpi > 0xFFFF {
+		return fmt.Errorf("DPI %d is too large for a JPEG", dpi)
+	}
+	chunks := (len(profile) + maxICCChunk - 1) / maxICCChunk
+	if chunks > 255 {
+		return errors.New("ICC profile is too large to embed in a JPEG")
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xFF, 0xD8})
+
+	// JFIF APP0 with the density in dots per inch
+	app0 := []byte{0xFF, 0xE0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 2, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(app0[12:], uint16(dpi))
+	binary.BigEndian.PutUint16(app0[14:], uint16(dpi))
+	bw.Write(app0)
+
+	for i := 0; i < chunks; i++ {
+		chunk := profile[i*maxICCChunk:]
+		if len(chunk) > maxICCChunk {
+			chunk = chunk[:maxICCChunk]
+		}
+		header := []byte{0xFF, 0xE2, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(2+14+len(chunk)))
+		bw.Write(header)
+		bw.WriteString("ICC_PROFILE\x00")
+		bw.Write([]byte{byte(i + 1), byte(chunks)})
+		bw.Write(chunk)
+	}
+
+	bw.Write(encoded[2:])
+	return bw.Flush()
+}
+
+// tiffEntry is a single IFD entry. Values longer than 4 bytes are written after the IFD
+type tiffEntry struct {
+	tag      uint16
+	dataType uint16
+	count    uint32
+	value    []byte
+}
+
+const (
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+)
+
+func tiffShorts(tag uint16, values ...uint16) tiffEntry {
+	value := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(value[2*i:], v)
+	}
+	return tiffEntry{tag: tag, dataType: tiffShort, count: uint32(len(values)), value: value}
+}
+
+func tiffLongs(tag uint16, values ...uint32) tiffEntry {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(value[4*i:], v)
+	}
+	return tiffEntry{tag: tag, dataType: tiffLong, count: uint32(len(values)), value: value}
+}
+
+func tiffRationalValue(tag uint16, numerator uint32, denominator uint32) tiffEntry {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint32(value, numerator)
+	binary.LittleEndian.PutUint32(value[4:], denominator)
+	return tiffEntry{tag: tag, dataType: tiffRational, count: 1, value: value}
+}
+
+// encodeTIFF writes an uncompressed 8 bit RGB TIFF. x/image/tiff can't write the resolution or an
+// ICC profile, so we write the file ourselves
+func encodeTIFF(w io.Writer, img *image.RGBA, dpi uint, profile []byte) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	stripSize := uint64(width) * uint64(height) * 3
+	if stripSize > 0xFFFFFFFF-(1<<20)-uint64(len(profile)) {
+		return errors.New("image is too large to write as a TIFF")
+	}
+
+	entries := []tiffEntry{
+		tiffLongs(256, uint32(width)),
+		tiffLongs(257, uint32(height)),
+		tiffShorts(258, 8, 8, 8),
+		// No compression
+		tiffShorts(259, 1),
+		// RGB
+		tiffShorts(262, 2),
+		// The strip offset is filled in once we know where the pixels start
+		tiffLongs(273, 0),
+		tiffShorts(277, 3),
+		tiffLongs(278, uint32(height)),
+		tiffLongs(279, uint32(stripSize)),
+		tiffRationalValue(282, uint32(dpi), 1),
+		tiffRationalValue(283, uint32(dpi), 1),
+		tiffShorts(284, 1),
+		// Inches
+		tiffShorts(296, 2),
+	}
+	if len(profile) > 0 {
+		entries = append(entries, tiffEntry{tag: 34675, dataType: tiffUndefined, count: uint32(len(profile)), value: profile})
+	}
+
+	// The header, then the IFD, then any values that didn't fit in their entry and finally the pixels
+	ifdOffset := uint32(8)
+	extraOffset := ifdOffset + 2 + uint32(len(entries))*12 + 4
+	extra := new(bytes.Buffer)
+	ifd := new(bytes.Buffer)
+	binary.Write(ifd, binary.LittleEndian, uint16(len(entries)))
+	var stripOffsetPos int
+	for _, entry := range entries {
+		binary.Write(ifd, binary.LittleEndian, entry.tag)
+		binary.Write(ifd, binary.LittleEndian, entry.dataType)
+		binary.Write(ifd, binary.LittleEndian, entry.count)
+		if entry.tag == 273 {
+			stripOffsetPos = ifd.Len()
+		}
+		if len(entry.value) <= 4 {
+			value := make([]byte, 4)
+			copy(value, entry.value)
+			ifd.Write(value)
+			continue
+		}
+		binary.Write(ifd, binary.LittleEndian, extraOffset+uint32(extra.Len()))
+		extra.Write(entry.value)
+		// Values have to start on a word boundary
+		if extra.Len()%2 == 1 {
+			extra.WriteByte(0)
+		}
+	}
+	binary.Write(ifd, binary.LittleEndian, uint32(0))
+	ifdBytes := ifd.Bytes()
+	binary.LittleEndian.PutUint32(ifdBytes[stripOffsetPos:], extraOffset+uint32(extra.Len()))
+
+	bw := bufio.NewWriterSize(w, 1<<16)
+	bw.Write([]byte{'I', 'I', 42, 0})
+	binary.Write(bw, binary.LittleEndian, ifdOffset)
+	bw.Write(ifdBytes)
+	bw.Write(extra.Bytes())
+
+	row := make([]byte, width*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pixels := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < width; x++ {
+			copy(row[x*3:x*3+3], pixels[x*4:x*4+3])
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,36 @@
+package render
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+// Fit scales the picture down so its longest side is at most longest pixels, drawing it on a white
+// background. Pictures that are already small enough keep their size
+func Fit(picture image.Image, longest int) *image.RGBA {
+	bounds := picture.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > longest || height > longest {
+		if width >= height {
+			height = max1(height * longest / width)
+			width = longest
+		} else {
+			width = max1(width * longest / height)
+			height = longest
+		}
+	}
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(out, out.Bounds(), picture, bounds, draw.Over, nil)
+	return out
+}
+
+// max1 keeps very thin pictures from scaling down to nothing
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
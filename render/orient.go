@@ -0,0 +1,53 @@
+package render
+
+import (
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// Orient returns the picture as it should be displayed given its EXIF orientation. Orientation 1
+// and invalid orientations return the picture unchanged
+func Orient(picture image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return picture
+	}
+	bounds := picture.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), picture, bounds.Min, draw.Src)
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5 to 8 are rotated a quarter turn, so the width and height swap
+	outWidth, outHeight := w, h
+	if orientation >= 5 {
+		outWidth, outHeight = h, w
+	}
+	// source returns the pixel in the stored picture that ends up at x, y
+	source := func(x, y int) (int, int) {
+		switch orientation {
+		case 2:
+			return w - 1 - x, y
+		case 3:
+			return w - 1 - x, h - 1 - y
+		case 4:
+			return x, h - 1 - y
+		case 5:
+			return y, x
+		case 6:
+			return y, h - 1 - x
+		case 7:
+			return w - 1 - y, h - 1 - x
+		default:
+			return w - 1 - y, x
+		}
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			sx, sy := source(x, y)
+			copy(out.Pix[out.PixOffset(x, y):out.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return out
+}
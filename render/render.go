@@ -0,0 +1,96 @@
+// Package render turns uploaded pictures into print-ready files by cropping them to the print's
+// aspect ratio, scaling them to the physical print size and adding the border
+package render
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/thomastaylor312/printing-api/types"
+	"golang.org/x/image/draw"
+)
+
+// The largest image we will render, which is about 1GB in memory. This is a 40x60 print at 300 DPI
+const maxPixels = 250_000_000
+
+// Layout is where the picture ends up in a rendered print
+type Layout struct {
+	// The size of the whole print in pixels, including the border
+	Width  int
+	Height int
+	// The area of the print the picture is drawn into
+	ImageArea image.Rectangle
+	// The area of the source picture that is drawn
+	Crop image.Rectangle
+}
+
+// PrintLayout works out the layout of a print at the given DPI for a source picture with the given
+// bounds. The crop is the largest area of the picture with the same aspect ratio as the area inside
+// the border. CropX and CropY are the top left corner of the crop in picture pixels, and the crop is
+// centered on any axis they aren't set for
+func PrintLayout(print types.Print, source image.Rectangle, dpi uint) (Layout, error) {
+	if print.Width <= 0 || print.Height <= 0 {
+		return Layout{}, errors.New("print must have a width and height")
+	}
+	if print.BorderSize < 0 || print.BorderSize*2 >= math.Min(print.Width, print.Height) {
+		return Layout{}, errors.New("border must leave room for the picture")
+	}
+	if dpi == 0 {
+		return Layout{}, errors.New("DPI must be greater than 0")
+	}
+	if source.Empty() {
+		return Layout{}, errors.New("picture is empty")
+	}
+
+	width := int(math.Round(print.Width * float64(dpi)))
+	height := int(math.Round(print.Height * float64(dpi)))
+	if width*height > maxPixels {
+		return Layout{}, fmt.Errorf("a %gx%g print at %d DPI is too large to render", print.Width, print.Height, dpi)
+	}
+	border := int(math.Round(print.BorderSize * float64(dpi)))
+	area := image.Rect(border, border, width-border, height-border)
+
+	// Find the largest crop with the same aspect ratio as the image area
+	aspect := float64(area.Dx()) / float64(area.Dy())
+	cropWidth, cropHeight := source.Dx(), source.Dy()
+	if float64(cropWidth)/float64(cropHeight) > aspect {
+		cropWidth = int(math.Round(float64(cropHeight) * aspect))
+	} else {
+		cropHeight = int(math.Round(float64(cropWidth) / aspect))
+	}
+	// Very thin prints of small pictures can round down to nothing
+	if cropWidth == 0 || cropHeight == 0 {
+		return Layout{}, errors.New("picture is too small for the print's aspect ratio")
+	}
+
+	x := (source.Dx() - cropWidth) / 2
+	if print.CropX != nil {
+		x = int(*print.CropX)
+	}
+	y := (source.Dy() - cropHeight) / 2
+	if print.CropY != nil {
+		y = int(*print.CropY)
+	}
+	crop := image.Rect(x, y, x+cropWidth, y+cropHeight).Add(source.Min)
+	if !crop.In(source) {
+		return Layout{}, fmt.Errorf("crop at %d,%d goes outside of the %dx%d picture", x, y, source.Dx(), source.Dy())
+	}
+
+	return Layout{Width: width, Height: height, ImageArea: area, Crop: crop}, nil
+}
+
+// Print renders the picture for the print at the given DPI on a white background
+func Print(picture image.Image, print types.Print, dpi uint) (*image.RGBA, error) {
+	layout, err := PrintLayout(print, picture.Bounds(), dpi)
+	if err != nil {
+		return nil, err
+	}
+	out := image.NewRGBA(image.Rect(0, 0, layout.Width, layout.Height))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	// Transparent areas of the picture are left as blank paper
+	draw.CatmullRom.Scale(out, layout.ImageArea, picture, layout.Crop, draw.Over, nil)
+	return out, nil
+}
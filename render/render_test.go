@@ -0,0 +1,95 @@
+package render_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/imagemeta"
+	"github.com/thomastaylor312/printing-api/render"
+	"github.com/thomastaylor312/printing-api/types"
+	"golang.org/x/image/tiff"
+)
+
+func TestPrintLayout(t *testing.T) {
+	// A 3:2 landscape picture printed as a 4x4 with a half inch border
+	source := image.Rect(0, 0, 600, 400)
+	print := types.Print{Width: 4, Height: 4, BorderSize: 0.5}
+
+	layout, err := render.PrintLayout(print, source, 100)
+	require.NoError(t, err)
+	require.Equal(t, 400, layout.Width)
+	require.Equal(t, 400, layout.Height)
+	require.Equal(t, image.Rect(50, 50, 350, 350), layout.ImageArea)
+	// The crop is square and centered when no crop position is given
+	require.Equal(t, image.Rect(100, 0, 500, 400), layout.Crop)
+
+	x := uint(200)
+	print.CropX = &x
+	layout, err = render.PrintLayout(print, source, 100)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(200, 0, 600, 400), layout.Crop)
+
+	x = 201
+	_, err = render.PrintLayout(print, source, 100)
+	require.Error(t, err, "crop past the edge of the picture should fail")
+
+	_, err = render.PrintLayout(types.Print{Width: 4, Height: 4, BorderSize: 2}, source, 100)
+	require.Error(t, err, "border that covers the print should fail")
+}
+
+func TestRenderAndEncode(t *testing.T) {
+	picture := image.NewRGBA(image.Rect(0, 0, 60, 40))
+	draw.Draw(picture, image.Rect(0, 0, 60, 20), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	rendered, err := render.Print(picture, types.Print{Width: 2, Height: 3, BorderSize: 0.25}, 20)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 40, 60), rendered.Bounds())
+	// The border is white, the top half of the picture is black and the transparent bottom half is
+	// left white
+	require.Equal(t, color.RGBA{255, 255, 255, 255}, rendered.RGBAAt(1, 1))
+	require.Equal(t, color.RGBA{0, 0, 0, 255}, rendered.RGBAAt(20, 15))
+	require.Equal(t, color.RGBA{255, 255, 255, 255}, rendered.RGBAAt(20, 45))
+
+	profile := bytes.Repeat([]byte("profile"), 20000)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, render.Encode(buf, rendered, types.PrintFileFormatTIFF, 20, 0, profile))
+	decoded, err := tiff.Decode(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, rendered.Bounds(), decoded.Bounds())
+	require.True(t, bytes.Contains(buf.Bytes(), profile), "TIFF should contain the ICC profile")
+
+	buf.Reset()
+	require.NoError(t, render.Encode(buf, rendered, types.PrintFileFormatJPEG, 20, 90, profile))
+	decoded, err = jpeg.Decode(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, rendered.Bounds(), decoded.Bounds())
+	// The profile is bigger than a single JPEG segment so this also checks it is reassembled
+	require.Equal(t, profile, imagemeta.ICCProfile(buf.Bytes()))
+}
+
+func TestOrient(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	picture := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	picture.SetRGBA(0, 0, red)
+	picture.SetRGBA(1, 0, blue)
+
+	require.Same(t, picture, render.Orient(picture, 1).(*image.RGBA))
+
+	// Rotated clockwise the left pixel ends up on top
+	oriented := render.Orient(picture, 6).(*image.RGBA)
+	require.Equal(t, image.Rect(0, 0, 1, 2), oriented.Bounds())
+	require.Equal(t, red, oriented.RGBAAt(0, 0))
+	require.Equal(t, blue, oriented.RGBAAt(0, 1))
+
+	oriented = render.Orient(picture, 8).(*image.RGBA)
+	require.Equal(t, blue, oriented.RGBAAt(0, 0))
+
+	oriented = render.Orient(picture, 2).(*image.RGBA)
+	require.Equal(t, blue, oriented.RGBAAt(0, 0))
+}
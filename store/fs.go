@@ -1,21 +1,81 @@
 package store
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	defaultDiskURLPrefix = "/files"
+	defaultDiskURLExpiry = 15 * time.Minute
+)
+
+var (
+	ErrURLExpired          = errors.New("URL has expired")
+	ErrURLSignatureInvalid = errors.New("URL signature is invalid")
+)
+
+// DiskURLOptions configures the URLs returned by DiskImageStore. Zero values use the defaults
+type DiskURLOptions struct {
+	// Where the file serving route is mounted, which can be a full URL if it is served from another
+	// host. Defaults to /files
+	Prefix string
+	// The key URLs are signed with. If it isn't set a random key is used, so URLs stop working when
+	// the process restarts
+	Secret []byte
+	// How long URLs work for. Defaults to 15 minutes
+	Expiry time.Duration
+}
+
+// DiskImageStore stores images on the local disk. The URLs it returns are signed and expire, and
+// they are for a route that serves the files after checking them with Verify, so the location of
+// the files on disk is never exposed
 type DiskImageStore struct {
 	rootPath string
+	prefix   string
+	secret   []byte
+	expiry   time.Duration
 }
 
-// NewDiskImageStore creates a new DiskImageStore that stores images in the given rootPath. If you
-// want to use this to actually serve files, this should be a path you expose as part of your server
+// NewDiskImageStore creates a new DiskImageStore that stores images in the given rootPath, using the
+// default URL options
 func NewDiskImageStore(rootPath string) *DiskImageStore {
-	return &DiskImageStore{rootPath: rootPath}
+	return NewDiskImageStoreWithURLs(rootPath, DiskURLOptions{})
+}
+
+// NewDiskImageStoreWithURLs creates a new DiskImageStore that stores images in the given rootPath
+// and returns URLs with the given options
+func NewDiskImageStoreWithURLs(rootPath string, options DiskURLOptions) *DiskImageStore {
+	if options.Prefix == "" {
+		options.Prefix = defaultDiskURLPrefix
+	}
+	if len(options.Secret) == 0 {
+		options.Secret = make([]byte, 32)
+		// This only fails if the OS has no randomness, in which case nothing else will work either
+		if _, err := rand.Read(options.Secret); err != nil {
+			panic(fmt.Sprintf("unable to generate URL secret: %v", err))
+		}
+	}
+	if options.Expiry == 0 {
+		options.Expiry = defaultDiskURLExpiry
+	}
+	return &DiskImageStore{
+		rootPath: rootPath,
+		prefix:   strings.TrimSuffix(options.Prefix, "/"),
+		secret:   options.Secret,
+		expiry:   options.Expiry,
+	}
 }
 
 func (d *DiskImageStore) Get(container string, id string) (*url.URL, error) {
@@ -25,18 +85,87 @@ func (d *DiskImageStore) Get(container string, id string) (*url.URL, error) {
 	} else if err != nil {
 		return nil, err
 	}
-	return &url.URL{Path: url.PathEscape(fileLocation)}, nil
+	return d.SignedURL(container, id, time.Now().Add(d.expiry))
+}
+
+// SignedURL returns a URL for the image that works until the given time. The image isn't checked
+func (d *DiskImageStore) SignedURL(container string, id string, expires time.Time) (*url.URL, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/%s/%s", d.prefix, url.PathEscape(container), url.PathEscape(id)))
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiresAt)
+	query.Set("signature", hex.EncodeToString(d.sign(container, id, expiresAt)))
+	u.RawQuery = query.Encode()
+	return u, nil
+}
+
+// Verify checks that the query of a URL for the image has a valid signature and hasn't expired
+func (d *DiskImageStore) Verify(container string, id string, query url.Values) error {
+	// Signatures are only made for real IDs, but make sure nothing can escape the root anyway
+	if !filepath.IsLocal(filepath.Join(container, id)) {
+		return ErrURLSignatureInvalid
+	}
+	expiresAt := query.Get("expires")
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil || !hmac.Equal(signature, d.sign(container, id, expiresAt)) {
+		return ErrURLSignatureInvalid
+	}
+	expires, err := strconv.ParseInt(expiresAt, 10, 64)
+	if err != nil {
+		return ErrURLSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+// sign returns the HMAC of the container, ID and expiry. They are separated by newlines, which
+// can't be in an ID, so different values can't produce the same message
+func (d *DiskImageStore) sign(container string, id string, expires string) []byte {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(container + "\n" + id + "\n" + expires))
+	return mac.Sum(nil)
 }
 
 func (d *DiskImageStore) Set(container string, id string, expected_length uint, value io.ReadCloser) (*url.URL, error) {
 	fileLocation := filepath.Join(d.rootPath, container, id)
+	if err := os.MkdirAll(filepath.Dir(fileLocation), 0700); err != nil {
+		return nil, err
+	}
 	file, err := os.OpenFile(fileLocation, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
-	_, err = io.Copy(file, value)
-	// TODO: Validate that this is an image
-	return &url.URL{Path: url.PathEscape(fileLocation)}, err
+	defer file.Close()
+	// Read one byte past the expected length so a body that is too long is caught too
+	written, err := io.Copy(file, io.LimitReader(value, int64(expected_length)+1))
+	if err == nil && written != int64(expected_length) {
+		err = fmt.Errorf("expected %d bytes but got %d", expected_length, written)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		// Don't leave a partial file behind
+		os.Remove(fileLocation)
+		return nil, err
+	}
+	// The contents are validated by the handlers before they get here, so this only stores bytes
+	return d.SignedURL(container, id, time.Now().Add(d.expiry))
+}
+
+func (d *DiskImageStore) Open(container string, id string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(d.rootPath, container, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrImageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return file, nil
 }
 
 func (d *DiskImageStore) Delete(container string, id string) error {
@@ -48,3 +177,37 @@ func (d *DiskImageStore) Delete(container string, id string) error {
 	}
 	return nil
 }
+
+// List returns every image in the store
+func (d *DiskImageStore) List() ([]ImageInfo, error) {
+	containers, err := os.ReadDir(d.rootPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	images := []ImageInfo{}
+	for _, container := range containers {
+		if !container.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(d.rootPath, container.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				// Deleted since the directory was read
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			images = append(images, ImageInfo{Container: container.Name(), ID: entry.Name(), Size: info.Size(), ModifiedAt: info.ModTime()})
+		}
+	}
+	return images, nil
+}
@@ -1 +1,226 @@
 package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	defaultS3Region    = "us-east-1"
+	defaultS3URLExpiry = 15 * time.Minute
+)
+
+// S3Config configures an S3ImageStore
+type S3Config struct {
+	Bucket string
+	// Prepended to every key, so one bucket can be shared with other things. Optional
+	Prefix string
+	// Only needed for S3 compatible services like MinIO. Setting it also switches to path style
+	// addressing, which those services generally need
+	Endpoint string
+	// Defaults to us-east-1
+	Region string
+	// How long the URLs returned by Get work for. Defaults to 15 minutes
+	URLExpiry time.Duration
+}
+
+// S3ImageStore stores images in an S3 bucket under <prefix>/<container>/<id>. Credentials come from
+// the usual AWS environment variables, shared config or instance role
+type S3ImageStore struct {
+	client    *s3.S3
+	uploader  *s3manager.Uploader
+	bucket    string
+	prefix    string
+	urlExpiry time.Duration
+}
+
+// NewS3ImageStore creates an S3ImageStore with the given configuration
+func NewS3ImageStore(config S3Config) (*S3ImageStore, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("bucket must be set")
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	if config.URLExpiry == 0 {
+		config.URLExpiry = defaultS3URLExpiry
+	}
+	awsConfig := aws.NewConfig().WithRegion(config.Region)
+	if config.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AWS session: %w", err)
+	}
+	client := s3.New(sess)
+	return &S3ImageStore{
+		client:    client,
+		uploader:  s3manager.NewUploaderWithClient(client),
+		bucket:    config.Bucket,
+		prefix:    strings.Trim(config.Prefix, "/"),
+		urlExpiry: config.URLExpiry,
+	}, nil
+}
+
+// NewS3ImageStoreFromEnv is a helper function to create a new S3ImageStore from configuration given
+// by environment variable
+func NewS3ImageStoreFromEnv() (*S3ImageStore, error) {
+	config := S3Config{
+		Bucket:   os.Getenv("S3_BUCKET"),
+		Prefix:   os.Getenv("S3_PREFIX"),
+		Endpoint: os.Getenv("S3_ENDPOINT"),
+		Region:   os.Getenv("S3_REGION"),
+	}
+	if raw := os.Getenv("S3_URL_EXPIRY"); raw != "" {
+		expiry, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3_URL_EXPIRY: %w", err)
+		}
+		config.URLExpiry = expiry
+	}
+	return NewS3ImageStore(config)
+}
+
+func (s *S3ImageStore) key(container string, id string) string {
+	return path.Join(s.prefix, container, id)
+}
+
+// Get returns a presigned URL for the image. To avoid a request to S3 for every URL, this doesn't
+// check the image exists, so the URL for a missing image returns a 404 when it is used
+func (s *S3ImageStore) Get(container string, id string) (*url.URL, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(container, id)),
+	})
+	signed, err := req.Presign(s.urlExpiry)
+	if err != nil {
+		return nil, fmt.Errorf("error presigning URL: %w", err)
+	}
+	return url.Parse(signed)
+}
+
+// Set streams the image to the bucket, using a multipart upload for large images. The upload is
+// aborted if the value isn't exactly expected_length bytes
+func (s *S3ImageStore) Set(container string, id string, expected_length uint, value io.ReadCloser) (*url.URL, error) {
+	defer value.Close()
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(container, id)),
+		Body:   &lengthCheckReader{reader: value, remaining: int64(expected_length)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error uploading image: %w", err)
+	}
+	return s.Get(container, id)
+}
+
+// UploadURL returns a presigned PUT URL. The content type and length are signed, so S3 rejects
+// uploads that don't match them
+func (s *S3ImageStore) UploadURL(container string, id string, contentType string, length uint, expiry time.Duration) (*url.URL, error) {
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(s.key(container, id)),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(int64(length)),
+	})
+	signed, err := req.Presign(expiry)
+	if err != nil {
+		return nil, fmt.Errorf("error presigning URL: %w", err)
+	}
+	return url.Parse(signed)
+}
+
+func (s *S3ImageStore) Open(container string, id string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(container, id)),
+	})
+	if isS3NotFound(err) {
+		return nil, ErrImageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Delete removes the image. S3 deletes succeed for missing objects, so it checks the image exists
+// first to return ErrImageNotFound like the other stores
+func (s *S3ImageStore) Delete(container string, id string) error {
+	key := s.key(container, id)
+	_, err := s.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if isS3NotFound(err) {
+		return ErrImageNotFound
+	} else if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	return err
+}
+
+// List returns every image under the prefix
+func (s *S3ImageStore) List() ([]ImageInfo, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)}
+	if s.prefix != "" {
+		input.Prefix = aws.String(s.prefix + "/")
+	}
+	images := []ImageInfo{}
+	err := s.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(aws.StringValue(object.Key), aws.StringValue(input.Prefix))
+			container, id, ok := strings.Cut(key, "/")
+			if !ok || container == "" || id == "" {
+				continue
+			}
+			images = append(images, ImageInfo{Container: container, ID: id, Size: aws.Int64Value(object.Size), ModifiedAt: aws.TimeValue(object.LastModified)})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+	return images, nil
+}
+
+// isS3NotFound returns true if the error is S3 saying the object doesn't exist. HEAD requests don't
+// have a body so they only have the status code
+func isS3NotFound(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
+// lengthCheckReader returns an error instead of EOF if the reader doesn't have exactly the expected
+// number of bytes, which makes the uploader abort the upload
+type lengthCheckReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *lengthCheckReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errors.New("image is longer than expected")
+	}
+	if err == io.EOF && l.remaining > 0 {
+		return n, fmt.Errorf("image is %d bytes shorter than expected", l.remaining)
+	}
+	return n, err
+}
@@ -0,0 +1,194 @@
+package store_test
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thomastaylor312/printing-api/store"
+)
+
+// fakeS3 is an in memory bucket that handles the path style requests the store makes. It doesn't
+// check signatures
+type fakeS3 struct {
+	bucket  string
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+type listObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []listObject
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			// Like S3, HEAD responses don't have a body to say what went wrong
+			if r.Method == http.MethodGet {
+				_, _ = io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	result := listBucketResult{Name: f.bucket, Prefix: prefix, Contents: []listObject{}}
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, listObject{Key: key, Size: int64(len(data)), LastModified: time.Now().UTC()})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+func newFakeS3Store(t *testing.T, prefix string) (*store.S3ImageStore, *fakeS3, *httptest.Server) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	fake := &fakeS3{bucket: "pictures", objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s3Store, err := store.NewS3ImageStore(store.S3Config{Bucket: "pictures", Prefix: prefix, Endpoint: server.URL})
+	require.NoError(t, err)
+	return s3Store, fake, server
+}
+
+func TestS3ImageStore(t *testing.T) {
+	s3Store, fake, server := newFakeS3Store(t, "/printing/")
+
+	u, err := s3Store.Set("u1", "beach.jpg", 5, io.NopCloser(strings.NewReader("hello")))
+	require.NoError(t, err)
+	data, ok := fake.object("printing/u1/beach.jpg")
+	require.True(t, ok, "the image should be stored under the prefix")
+	require.Equal(t, "hello", string(data))
+
+	// Get returns a presigned URL for the object that expires after the default 15 minutes
+	require.True(t, strings.HasPrefix(u.String(), server.URL+"/pictures/printing/u1/beach.jpg?"), u.String())
+	require.Equal(t, "900", u.Query().Get("X-Amz-Expires"))
+	require.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+	resp, err := http.Get(u.String())
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(body))
+
+	reader, err := s3Store.Open("u1", "beach.jpg")
+	require.NoError(t, err)
+	body, err = io.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(body))
+
+	// Uploads that don't match the expected length are aborted
+	_, err = s3Store.Set("u1", "short.jpg", 10, io.NopCloser(strings.NewReader("hello")))
+	require.ErrorContains(t, err, "5 bytes shorter than expected")
+	_, ok = fake.object("printing/u1/short.jpg")
+	require.False(t, ok, "short uploads shouldn't be stored")
+	_, err = s3Store.Set("u1", "long.jpg", 3, io.NopCloser(strings.NewReader("hello")))
+	require.ErrorContains(t, err, "longer than expected")
+	_, ok = fake.object("printing/u1/long.jpg")
+	require.False(t, ok, "long uploads shouldn't be stored")
+
+	// Upload URLs are signed for the content type and length
+	u, err = s3Store.UploadURL("u1", "direct.jpg", "image/jpeg", 5, time.Hour)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(u.String(), server.URL+"/pictures/printing/u1/direct.jpg?"), u.String())
+	require.Equal(t, "3600", u.Query().Get("X-Amz-Expires"))
+	signed := strings.Split(u.Query().Get("X-Amz-SignedHeaders"), ";")
+	require.Contains(t, signed, "content-type")
+	require.Contains(t, signed, "content-length")
+
+	// Missing images are reported as not found
+	_, err = s3Store.Open("u1", "missing.jpg")
+	require.True(t, errors.Is(err, store.ErrImageNotFound), err)
+	err = s3Store.Delete("u1", "missing.jpg")
+	require.True(t, errors.Is(err, store.ErrImageNotFound), err)
+
+	require.NoError(t, s3Store.Delete("u1", "beach.jpg"))
+	_, ok = fake.object("printing/u1/beach.jpg")
+	require.False(t, ok)
+	_, err = s3Store.Open("u1", "beach.jpg")
+	require.True(t, errors.Is(err, store.ErrImageNotFound), err)
+}
+
+func TestS3ImageStoreList(t *testing.T) {
+	s3Store, fake, _ := newFakeS3Store(t, "printing")
+	fake.objects["printing/u1/a.jpg"] = []byte("a")
+	fake.objects["printing/blobs/b.jpg"] = []byte("bb")
+	// Objects without a container and objects outside the prefix aren't images
+	fake.objects["printing/stray.jpg"] = []byte("c")
+	fake.objects["other/u1/d.jpg"] = []byte("d")
+
+	images, err := s3Store.List()
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	require.Equal(t, "blobs", images[0].Container)
+	require.Equal(t, "b.jpg", images[0].ID)
+	require.Equal(t, int64(2), images[0].Size)
+	require.False(t, images[0].ModifiedAt.IsZero())
+	require.Equal(t, "u1", images[1].Container)
+	require.Equal(t, "a.jpg", images[1].ID)
+}
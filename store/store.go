@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"net/url"
+	"time"
 )
 
 var (
@@ -27,5 +28,30 @@ type ImageStore interface {
 	// Set an image to the store, returning the URL to the image. This allows an implementation
 	// to do things like generating a token to a CDN
 	Set(container string, id string, expected_length uint, value io.ReadCloser) (*url.URL, error)
+	// Open returns a reader for the contents of an image. This is for server side processing and
+	// shouldn't be used to serve images to clients
+	Open(container string, id string) (io.ReadCloser, error)
 	Delete(container string, id string) error
 }
+
+// DirectUploader is implemented by image stores that clients can upload to directly, so large
+// uploads don't have to go through the API
+type DirectUploader interface {
+	// UploadURL returns a URL the image can be PUT to until the expiry passes. The upload must have
+	// the given Content-Type and Content-Length
+	UploadURL(container string, id string, contentType string, length uint, expiry time.Duration) (*url.URL, error)
+}
+
+// ImageInfo describes an image in an image store
+type ImageInfo struct {
+	Container  string
+	ID         string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+// ImageLister is implemented by image stores that can list their images, which is needed to find
+// images that were left behind without anything referencing them
+type ImageLister interface {
+	List() ([]ImageInfo, error)
+}
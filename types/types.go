@@ -1,11 +1,20 @@
 package types
 
 import (
+	"encoding/json"
 	"net/url"
+	"time"
 )
 
 type ShippingMethod string
+type ShippingProfileKind string
 type PaperFinish string
+type Carrier string
+type NotificationEvent string
+type WebhookEvent string
+type WebhookDeliveryStatus string
+type JobStatus string
+type PrintFileFormat string
 
 const (
 	ShippingMethodStandard  ShippingMethod = "standard"
@@ -14,6 +23,45 @@ const (
 	PaperFinishGlossy       PaperFinish    = "glossy"
 	PaperFinishMatte        PaperFinish    = "matte"
 	PaperFinishLuster       PaperFinish    = "luster"
+	// An empty kind is treated as flat so profiles from before kinds existed keep working
+	ShippingProfileKindFlat              ShippingProfileKind = "flat"
+	ShippingProfileKindPerItem           ShippingProfileKind = "perItem"
+	ShippingProfileKindWeightTiered      ShippingProfileKind = "weightTiered"
+	ShippingProfileKindFreeOverThreshold ShippingProfileKind = "freeOverThreshold"
+	CarrierUSPS                          Carrier             = "usps"
+	CarrierUPS                           Carrier             = "ups"
+	CarrierFedEx                         Carrier             = "fedex"
+	CarrierDHL                           Carrier             = "dhl"
+	CarrierOther                         Carrier             = "other"
+	NotificationOrderCreated             NotificationEvent   = "order.created"
+	NotificationOrderPaid                NotificationEvent   = "order.paid"
+	NotificationOrderShipped             NotificationEvent   = "order.shipped"
+	NotificationOrderDelivered           NotificationEvent   = "order.delivered"
+)
+
+const (
+	WebhookOrderCreated      WebhookEvent          = "order.created"
+	WebhookOrderPaid         WebhookEvent          = "order.paid"
+	WebhookOrderShipped      WebhookEvent          = "order.shipped"
+	WebhookOrderDelivered    WebhookEvent          = "order.delivered"
+	WebhookCartUpdated       WebhookEvent          = "cart.updated"
+	WebhookPictureUploaded   WebhookEvent          = "picture.uploaded"
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+const (
+	JobStatusQueued   JobStatus = "queued"
+	JobStatusPrinting JobStatus = "printing"
+	JobStatusPrinted  JobStatus = "printed"
+	JobStatusQAFailed JobStatus = "qaFailed"
+	JobStatusPacked   JobStatus = "packed"
+)
+
+const (
+	PrintFileFormatTIFF PrintFileFormat = "tiff"
+	PrintFileFormatJPEG PrintFileFormat = "jpeg"
 )
 
 // User represents a user in the system
@@ -22,6 +70,8 @@ type User struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	IsAdmin  bool   `json:"isAdmin"`
+	// Addresses the user has saved for shipping
+	Addresses []Address `json:"addresses"`
 }
 
 func (u *User) ID() string {
@@ -39,21 +89,90 @@ type Print struct {
 	BorderSize  float64 `json:"borderSize"`
 	PaperTypeID string  `json:"paperTypeId"`
 	PictureID   string  `json:"pictureId"`
+	// The hash of the picture's upload when it was ordered. This is only set on prints that are part
+	// of an order so the order is printed from the upload that was ordered
+	PictureHash string  `json:"pictureHash,omitempty"`
 	CropX       *uint   `json:"cropX"`
 	CropY       *uint   `json:"cropY"`
 	Cost        float64 `json:"cost"`
 	Quantity    uint    `json:"quantity"`
+	// The breakdown of the cost of a single print, set whenever the cost is calculated
+	Price *PriceBreakdown `json:"price,omitempty"`
+	// A copy of the paper as it was when the print was ordered. This is only set on prints that are
+	// part of an order so the order stays readable if the paper is later changed or archived
+	Paper *PaperType `json:"paper,omitempty"`
+	// The resolution the picture will be printed at given the size and crop. This is 0 if the
+	// picture's dimensions aren't known
+	EffectiveDPI float64 `json:"effectiveDpi,omitempty"`
+	// Problems with the print that don't stop it from being ordered, like a low resolution
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// PriceBreakdown is the breakdown of the cost of a single print
+type PriceBreakdown struct {
+	PaperCost float64 `json:"paperCost"`
+	InkCost   float64 `json:"inkCost"`
+	Profit    float64 `json:"profit"`
+	UnitPrice float64 `json:"unitPrice"`
+}
+
+// Count returns the number of copies of the print. A quantity of 0 is treated as a single print
+func (p *Print) Count() uint {
+	if p.Quantity == 0 {
+		return 1
+	}
+	return p.Quantity
+}
+
+// TotalCost returns the cost of all copies of the print
+func (p *Print) TotalCost() float64 {
+	return p.Cost * float64(p.Count())
 }
 
 type Picture struct {
 	PictureID string `json:"id"`
 	UserID    string `json:"userId"`
 	Name      string `json:"name"`
+	// The size of the uploaded picture in pixels as it is displayed, so with its EXIF orientation
+	// applied. 0 until the picture is uploaded
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// The following are read from the uploaded picture and are empty until it is uploaded
+	ContentType string `json:"contentType,omitempty"`
+	// The size of the uploaded file in bytes
+	Size int64 `json:"size,omitempty"`
+	// The hex encoded SHA-256 of the uploaded file. Uploads are stored by their hash so identical
+	// files are only stored once
+	Hash string `json:"hash,omitempty"`
+	// rgb, gray or cmyk
+	ColorSpace string `json:"colorSpace,omitempty"`
+	// The EXIF orientation from 1 to 8
+	Orientation int             `json:"orientation,omitempty"`
+	ICCProfile  *ICCProfileInfo `json:"iccProfile,omitempty"`
+	// Free-form labels for finding the picture. Tags are trimmed and lower case
+	Tags []string `json:"tags,omitempty"`
+	// When the current file was uploaded
+	UploadedAt *time.Time `json:"uploadedAt,omitempty"`
+	// Set while the client is uploading straight to storage. The upload isn't used until it is
+	// completed and validated
+	PendingUpload *PendingUpload `json:"pendingUpload,omitempty"`
+	// When the picture was last uploaded, added to a cart or ordered. Pictures that haven't been
+	// used for a while are cleaned up. It is stored separately and only set when fetching a picture
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	// Set when the picture was deleted while orders still needed it. Deleted pictures are hidden from
+	// the user and removed once no order needs them
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// Web sized copies of the picture. These are generated in the background after an upload, so
+	// they are missing until that finishes. They are stored separately and only set when fetching a
+	// picture
+	Derivatives []Derivative `json:"derivatives,omitempty"`
 	// This is the URL the picture is distributed from, which could be a CDN or directly from a
 	// bucket. This is generally only set after uploading or fetching a picture and isn't stored in
 	// the database
 	URL *url.URL `json:"url,omitempty"`
-	// TODO: We should probably store a last used time so we can clean up old pictures
+	// The largest print that can be made from the picture at the configured warning resolution. This
+	// is calculated when fetching a picture and isn't stored in the database
+	MaxPrintSize *PrintSize `json:"maxPrintSize,omitempty"`
 }
 
 func (p *Picture) ID() string {
@@ -64,10 +183,152 @@ func (p *Picture) SetID(id string) {
 	p.PictureID = id
 }
 
-// ShippingDetails represents the shipping details for an order
+// Album is an ordered collection of a user's pictures. A picture can be in any number of albums
+type Album struct {
+	AlbumID string `json:"id"`
+	UserID  string `json:"userId"`
+	Name    string `json:"name"`
+	// The pictures in the album in the order they are shown
+	PictureIDs []string  `json:"pictureIds,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func (a *Album) ID() string {
+	return a.AlbumID
+}
+
+func (a *Album) SetID(id string) {
+	a.AlbumID = id
+}
+
+// PendingUpload is a direct upload that has been started but not completed
+type PendingUpload struct {
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// DirectUploadRequest asks for a URL to upload a picture straight to storage
+type DirectUploadRequest struct {
+	ContentType string `json:"contentType"`
+	// The size of the picture in bytes
+	Size int64 `json:"size"`
+}
+
+// DirectUpload is where and how to upload a picture straight to storage. The picture must be sent
+// with the given method and headers before ExpiresAt, then the upload must be completed through the
+// API
+type DirectUpload struct {
+	URL       *url.URL          `json:"url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// ResumableUpload is a picture upload sent in chunks, so it can be resumed from where it stopped if
+// the connection drops
+type ResumableUpload struct {
+	UploadID  string `json:"id"`
+	UserID    string `json:"userId"`
+	PictureID string `json:"pictureId"`
+	// The size of the whole picture in bytes
+	Length int64 `json:"length"`
+	// How many bytes have been received so far
+	Offset int64 `json:"offset"`
+	// The SHA-256 of the whole picture, checked when the last chunk is received. Optional
+	Checksum  []byte        `json:"checksum,omitempty"`
+	Chunks    []UploadChunk `json:"chunks"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+func (u *ResumableUpload) ID() string {
+	return u.UploadID
+}
+
+func (u *ResumableUpload) SetID(id string) {
+	u.UploadID = id
+}
+
+// UploadChunk is one part of a resumable upload, kept in the image store until the upload completes
+type UploadChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	FileID string `json:"fileId"`
+}
+
+// DerivativeSize is the name of a size pictures are scaled down to for the web
+type DerivativeSize string
+
+const (
+	DerivativeThumbnail DerivativeSize = "thumbnail"
+	DerivativeSmall     DerivativeSize = "small"
+	DerivativePreview   DerivativeSize = "preview"
+	DerivativeLarge     DerivativeSize = "large"
+)
+
+// Derivative is a smaller copy of a picture for displaying on the web. It is stored in the same
+// container as the picture
+type Derivative struct {
+	Size        DerivativeSize `json:"size"`
+	FileID      string         `json:"fileId"`
+	ContentType string         `json:"contentType"`
+	Width       int            `json:"width"`
+	Height      int            `json:"height"`
+	// Like the picture's URL, this is only set when fetching a picture
+	URL *url.URL `json:"url,omitempty"`
+}
+
+// ICCProfileInfo describes the color profile embedded in a picture
+type ICCProfileInfo struct {
+	Description string `json:"description,omitempty"`
+	ColorSpace  string `json:"colorSpace,omitempty"`
+	// The size of the profile in bytes
+	Size int `json:"size"`
+}
+
+// PrintSize is the size of a print in inches
+type PrintSize struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Address is a postal address. Country is an ISO 3166-1 alpha-2 code and State is the state,
+// province or region for countries that use them
+type Address struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	State      string `json:"state,omitempty"`
+	PostalCode string `json:"postalCode,omitempty"`
+	Country    string `json:"country"`
+}
+
+// ShippingDetails represents the shipping details for an order. The shipping profile is a copy of
+// the profile at the time the order was placed
 type ShippingDetails struct {
 	ShippingProfile ShippingProfile `json:"shippingProfile"`
-	TrackingNumber  *string         `json:"trackingNumber,omitempty"`
+	// The name of the shipping zone the profile came from, empty if the default profiles were used
+	Zone string `json:"zone,omitempty"`
+	// The cost of shipping calculated from the profile and the prints in the order
+	Cost          float64            `json:"cost"`
+	CostBreakdown []ShippingCostLine `json:"costBreakdown,omitempty"`
+	// The address to ship to. This can be empty when the order is created if the customer enters it
+	// with the payment provider instead
+	Address *Address `json:"address,omitempty"`
+	// The tracking number of the first shipment, kept for clients that only support one shipment
+	TrackingNumber *string `json:"trackingNumber,omitempty"`
+	// All shipments for the order. Large orders can be split across multiple packages
+	Shipments []Shipment `json:"shipments"`
+}
+
+// Shipment is a single package sent for an order
+type Shipment struct {
+	Carrier        Carrier   `json:"carrier"`
+	TrackingNumber string    `json:"trackingNumber"`
+	TrackingURL    string    `json:"trackingUrl,omitempty"`
+	ShippedAt      time.Time `json:"shippedAt"`
 }
 
 // Order represents an order in the system
@@ -80,9 +341,18 @@ type Order struct {
 	PaymentLink     *url.URL        `json:"paymentLink"`
 	ExternalOrderID string          `json:"externalOrderId"`
 	ShippingDetails ShippingDetails `json:"shippingDetails"`
+	CreatedAt       time.Time       `json:"createdAt"`
 	IsPaid          bool            `json:"isPaid"`
-	HasShipped      bool            `json:"hasShipped"`
-	IsDelivered     bool            `json:"isDelivered"`
+	// Whether the order was never paid for and its payment link is no longer considered valid
+	IsExpired bool `json:"isExpired"`
+	// Whether every production job for the order has been packed
+	ReadyToShip bool `json:"readyToShip"`
+	HasShipped  bool `json:"hasShipped"`
+	IsDelivered bool `json:"isDelivered"`
+	// When the order was marked as delivered
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	// Whether the order's references to its pictures have been released after the retention period
+	PicturesReleased bool `json:"-"`
 }
 
 func (o *Order) ID() string {
@@ -93,6 +363,54 @@ func (o *Order) SetID(id string) {
 	o.OrderID = id
 }
 
+// ProductionJob is a single print from a paid order that needs to be printed. Jobs are grouped by
+// paper and size on the shop floor so similar prints can be run together
+type ProductionJob struct {
+	JobID   string `json:"id"`
+	OrderID string `json:"orderId"`
+	UserID  string `json:"userId"`
+	// The index of the print in the order
+	PrintIndex int       `json:"printIndex"`
+	Print      Print     `json:"print"`
+	Status     JobStatus `json:"status"`
+	// The printer and operator the job is assigned to, empty if it hasn't been assigned
+	Printer  string            `json:"printer,omitempty"`
+	Operator string            `json:"operator,omitempty"`
+	History  []JobStatusChange `json:"history"`
+	// The print-ready file for the job, nil until it is rendered
+	PrintFile *PrintFile `json:"printFile,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// PrintFile is a rendered print-ready file in the image store
+type PrintFile struct {
+	Container string          `json:"container"`
+	FileID    string          `json:"fileId"`
+	Format    PrintFileFormat `json:"format"`
+	DPI       uint            `json:"dpi"`
+	// The size of the file in pixels
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (j *ProductionJob) ID() string {
+	return j.JobID
+}
+
+func (j *ProductionJob) SetID(id string) {
+	j.JobID = id
+}
+
+// JobStatusChange is a single change to the status of a production job
+type JobStatusChange struct {
+	Status   JobStatus `json:"status"`
+	At       time.Time `json:"at"`
+	Operator string    `json:"operator,omitempty"`
+	Note     string    `json:"note,omitempty"`
+}
+
 // Cart represents the current items in a user's cart
 type Cart struct {
 	UserID string  `json:"userId"`
@@ -105,6 +423,11 @@ type PaperType struct {
 	Name              string      `json:"name"`
 	CostPerSquareInch float64     `json:"costPerSquareInch"`
 	Finish            PaperFinish `json:"finish"`
+	// The weight of the paper in grams per square meter, used for weight based shipping
+	GramsPerSquareMeter float64 `json:"gramsPerSquareMeter"`
+	// Archived papers can no longer be added to carts but are kept around because open orders
+	// reference them
+	Archived bool `json:"archived"`
 }
 
 func (p *PaperType) ID() string {
@@ -123,16 +446,190 @@ type SupplyCosts struct {
 	ShippingProfiles             []ShippingProfile `json:"shippingProfiles"`
 }
 
-// TODO: We'll eventually need to support multiple types of shipping profiles (like weight and
-// quantity based)
+// ShippingProfile is how shipping is charged for a shipping method. The Kind determines which of
+// the cost fields are used
 type ShippingProfile struct {
-	ShippingMethod ShippingMethod `json:"shippingMethod"`
-	Cost           float64        `json:"cost"`
-	Name           string         `json:"name"`
+	ShippingMethod ShippingMethod      `json:"shippingMethod"`
+	Kind           ShippingProfileKind `json:"kind"`
+	// The cost for flat profiles, the base cost for per item profiles and the cost below the
+	// threshold for free over threshold profiles
+	Cost float64 `json:"cost"`
+	Name string  `json:"name"`
+	// The additional cost for each print for per item profiles
+	CostPerItem float64 `json:"costPerItem,omitempty"`
+	// The weight tiers for weight tiered profiles, sorted from lightest to heaviest
+	WeightTiers []WeightTier `json:"weightTiers,omitempty"`
+	// The prints subtotal at or above which shipping is free for free over threshold profiles
+	FreeOver float64 `json:"freeOver,omitempty"`
+}
+
+// WeightTier is the cost of shipping everything up to and including MaxGrams
+type WeightTier struct {
+	MaxGrams float64 `json:"maxGrams"`
+	Cost     float64 `json:"cost"`
+}
+
+// ShippingCostLine is a single line in the breakdown of a shipping cost
+type ShippingCostLine struct {
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+// ShippingZone is a set of destinations that have their own shipping profiles. Countries is
+// required and the other criteria only limit the zone further when set. Shipping methods that
+// don't have a profile in the zone are unavailable for its destinations
+type ShippingZone struct {
+	Name string `json:"name"`
+	// ISO 3166-1 alpha-2 country codes
+	Countries        []string          `json:"countries"`
+	States           []string          `json:"states,omitempty"`
+	PostalCodeRanges []PostalCodeRange `json:"postalCodeRanges,omitempty"`
+	ShippingProfiles []ShippingProfile `json:"shippingProfiles"`
+}
+
+// PostalCodeRange is an inclusive range of postal codes. Codes are compared as strings, so both
+// ends should have the same format as the codes being matched
+type PostalCodeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// NotificationTemplate is the email sent to a customer for an event. Subject and Body are Go
+// text/template templates
+type NotificationTemplate struct {
+	Event   NotificationEvent `json:"event"`
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"`
+}
+
+// WebhookSubscription is an endpoint that is sent events as they happen. Every request is signed
+// with the secret so the receiver can verify it came from us
+type WebhookSubscription struct {
+	WebhookID string         `json:"id"`
+	URL       string         `json:"url"`
+	Secret    string         `json:"secret"`
+	Events    []WebhookEvent `json:"events"`
+	// Disabled subscriptions are kept but aren't sent any events
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s *WebhookSubscription) ID() string {
+	return s.WebhookID
+}
+
+func (s *WebhookSubscription) SetID(id string) {
+	s.WebhookID = id
+}
+
+// WebhookDelivery is a single event sent to a subscription along with every attempt to send it
+type WebhookDelivery struct {
+	DeliveryID string                `json:"id"`
+	WebhookID  string                `json:"webhookId"`
+	Event      WebhookEvent          `json:"event"`
+	Payload    json.RawMessage       `json:"payload"`
+	Status     WebhookDeliveryStatus `json:"status"`
+	Attempts   []WebhookAttempt      `json:"attempts"`
+	CreatedAt  time.Time             `json:"createdAt"`
+}
+
+func (d *WebhookDelivery) ID() string {
+	return d.DeliveryID
+}
+
+func (d *WebhookDelivery) SetID(id string) {
+	d.DeliveryID = id
+}
+
+// WebhookAttempt is the result of a single request to a subscription. StatusCode is 0 if no
+// response was received
+type WebhookAttempt struct {
+	At         time.Time     `json:"at"`
+	StatusCode int           `json:"statusCode"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
 }
 
 type Config struct {
 	// The max size of the image on its shortest side in inches
 	MaxSize float64     `json:"maxSize"`
 	Costs   SupplyCosts `json:"costs"`
+	// Zones are checked in order and the first one that matches an address is used. Addresses that
+	// don't match any zone can't be shipped to. Without any zones, every address uses the shipping
+	// profiles in Costs
+	ShippingZones []ShippingZone `json:"shippingZones"`
+	// The address orders are shipped from, printed on shipping labels
+	ReturnAddress *Address `json:"returnAddress,omitempty"`
+	// How print-ready files are rendered
+	Rendering RenderSettings `json:"rendering"`
+	// The resolutions prints are checked against
+	PrintQuality PrintQualitySettings `json:"printQuality"`
+	// Limits on uploaded pictures
+	Uploads UploadSettings `json:"uploads"`
+	// How long pictures are kept
+	Retention RetentionSettings `json:"retention"`
+	// The default quotas for every user. These can be overridden for each user
+	Quotas QuotaSettings `json:"quotas"`
+}
+
+// QuotaSettings limit how much a user can store and how often they can upload. Zero values mean
+// there is no limit
+type QuotaSettings struct {
+	// The most pictures a user can have
+	MaxPictures int `json:"maxPictures"`
+	// The most bytes a user's uploaded pictures can add up to
+	MaxBytes int64 `json:"maxBytes"`
+	// The most uploads a user can start in an hour
+	UploadsPerHour int `json:"uploadsPerHour"`
+}
+
+// StorageUsage is how much a user has stored compared to their quota
+type StorageUsage struct {
+	UserID   string        `json:"userId"`
+	Pictures int           `json:"pictures"`
+	Bytes    int64         `json:"bytes"`
+	Quota    QuotaSettings `json:"quota"`
+	// What is left of each quota. These are not set for quotas that don't have a limit
+	RemainingPictures *int   `json:"remainingPictures,omitempty"`
+	RemainingBytes    *int64 `json:"remainingBytes,omitempty"`
+	RemainingUploads  *int   `json:"remainingUploads,omitempty"`
+}
+
+// RetentionSettings are how long pictures are kept. Zero values use the defaults
+type RetentionSettings struct {
+	// The number of days after an order is delivered that its pictures are kept, even if the
+	// customer deletes them. Defaults to 30
+	OrderedPictureDays int `json:"orderedPictureDays"`
+	// Pictures that haven't been used for this many days are deleted, unless a cart or order needs
+	// them. Defaults to 0, which never deletes them
+	UnusedPictureDays int `json:"unusedPictureDays"`
+}
+
+// UploadSettings are the limits on uploaded pictures. Zero values use the defaults
+type UploadSettings struct {
+	// The largest file that can be uploaded. Defaults to 100MB
+	MaxBytes int64 `json:"maxBytes"`
+	// The most pixels an uploaded picture can have. Defaults to 200 megapixels
+	MaxPixels int64 `json:"maxPixels"`
+}
+
+// PrintQualitySettings are the resolution thresholds for prints. Zero values use the defaults
+type PrintQualitySettings struct {
+	// Prints below this DPI are allowed but get a warning. Defaults to 150
+	WarnBelowDPI float64 `json:"warnBelowDpi"`
+	// Prints below this DPI are rejected. Defaults to 72
+	RejectBelowDPI float64 `json:"rejectBelowDpi"`
+}
+
+// RenderSettings configures how print-ready files are rendered. Zero values use the defaults
+type RenderSettings struct {
+	// Defaults to 300
+	DPI uint `json:"dpi"`
+	// Defaults to TIFF
+	Format PrintFileFormat `json:"format"`
+	// Only used for JPEGs, defaults to 95
+	JPEGQuality int `json:"jpegQuality"`
+	// The ICC profile embedded in files for pictures that don't have their own profile. This should
+	// be the profile untagged pictures are assumed to be in, which is normally sRGB
+	DefaultICCProfile []byte `json:"defaultIccProfile,omitempty"`
 }